@@ -0,0 +1,293 @@
+// Package cache provides the cache-aside pattern on top of memcached.
+//
+// The value is stored with a header which has the soft expiration.
+// memcached keeps the item until the hard expiration which is StaleTTL longer than the soft expiration.
+// Between them, GetOrLoad returns the stale value immediately and only one caller refreshes the value in background.
+// The refresh is deduplicated in the process by singleflight and across the processes by the lease key.
+package cache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// ErrNotFound is returned by Loader when the value doesn't exist.
+// The absence is cached for NegativeTTL.
+var ErrNotFound = errors.New("cache: not found")
+
+const (
+	kindValue    byte = 1
+	kindNegative byte = 2
+
+	headerSize  = 9
+	leaseSuffix = ":lease"
+)
+
+// Loader loads the value from the source of truth.
+type Loader func(ctx context.Context) ([]byte, error)
+
+// Client is the interface of the memcached client which Cache uses.
+// *client.Client satisfies this interface.
+type Client interface {
+	GetAsync(key []byte) (<-chan *client.Item, error)
+	SetAsync(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error)
+	AddAsync(key, value, flag []byte, expiration int) (<-chan *client.Item, error)
+}
+
+type Cache struct {
+	Client Client
+	// StaleTTL is the duration which the stale value can be returned after the soft TTL.
+	StaleTTL time.Duration
+	// NegativeTTL is the duration which ErrNotFound is cached. Zero disables the negative caching.
+	NegativeTTL time.Duration
+	// Jitter randomizes TTL by the ratio. e.g. 0.1 makes TTL in [0.9*ttl, 1.1*ttl].
+	Jitter float64
+	// LoadTimeout is the timeout of the loader which is shared by the concurrent calls on miss.
+	LoadTimeout time.Duration
+	// RefreshTimeout is the timeout of the background refresh.
+	RefreshTimeout time.Duration
+	// LeaseTTL is the TTL of the lease which is held by the process refreshing the stale value.
+	LeaseTTL time.Duration
+
+	group  group
+	mu     sync.Mutex
+	random *rand.Rand
+	now    func() time.Time
+}
+
+func New(c Client) *Cache {
+	return &Cache{
+		Client:         c,
+		StaleTTL:       time.Minute,
+		NegativeTTL:    10 * time.Second,
+		Jitter:         0.1,
+		LoadTimeout:    10 * time.Second,
+		RefreshTimeout: 10 * time.Second,
+		LeaseTTL:       10 * time.Second,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:            time.Now,
+	}
+}
+
+// GetOrLoad returns the cached value of key.
+// On miss, GetOrLoad calls loader, stores the result for ttl and returns it.
+// The concurrent calls for the same key share one loader call. The loader is called with the context which is detached
+// from the callers and is limited by LoadTimeout, so the cancellation of a caller doesn't fail the others.
+// If the cached value is older than ttl but younger than ttl+StaleTTL, GetOrLoad returns it and refreshes it in background.
+func (c *Cache) GetOrLoad(ctx context.Context, key string, ttl time.Duration, loader Loader) ([]byte, error) {
+	item, err := c.get(ctx, key)
+	switch err {
+	case nil:
+	case client.ErrKeyNotFound:
+		return c.load(ctx, key, ttl, loader)
+	case context.Canceled, context.DeadlineExceeded:
+		return nil, err
+	default:
+		// memcached is unavailable. Fall back to the source of truth.
+		return c.load(ctx, key, ttl, loader)
+	}
+
+	kind, softExpireAt, value, ok := decode(item.Value)
+	if !ok {
+		return c.load(ctx, key, ttl, loader)
+	}
+	if !c.now().Before(softExpireAt) {
+		c.refresh(key, ttl, loader)
+	}
+
+	if kind == kindNegative {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (c *Cache) get(ctx context.Context, key string) (*client.Item, error) {
+	res, err := c.Client.GetAsync([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case v := <-res:
+		if v.Err != nil {
+			return nil, v.Err
+		}
+		return v, nil
+	}
+}
+
+// load calls loader and stores the result. The concurrent calls for key share one loader call.
+// Each caller waits for the result only until its ctx is done.
+func (c *Cache) load(ctx context.Context, key string, ttl time.Duration, loader Loader) ([]byte, error) {
+	call := c.group.do(key, func() ([]byte, error) {
+		ctx, cancel := detach(c.LoadTimeout)
+		defer cancel()
+		return c.loadAndStore(ctx, key, ttl, loader)
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-call.done:
+		return call.value, call.err
+	}
+}
+
+// refresh loads the value in background if no one is refreshing key.
+// The refresh has its own key in the group. It returns nothing if the other process holds the lease,
+// so the caller which missed the key must not share it.
+func (c *Cache) refresh(key string, ttl time.Duration, loader Loader) {
+	c.group.start(key+leaseSuffix, func() ([]byte, error) {
+		if !c.acquireLease(key) {
+			return nil, nil
+		}
+
+		ctx, cancel := detach(c.RefreshTimeout)
+		defer cancel()
+		return c.loadAndStore(ctx, key, ttl, loader)
+	})
+}
+
+// detach returns the context which doesn't belong to any caller. Zero timeout means no timeout.
+func detach(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(context.Background(), timeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// acquireLease reports whether this process is responsible for refreshing key.
+func (c *Cache) acquireLease(key string) bool {
+	if c.LeaseTTL <= 0 {
+		return true
+	}
+
+	res, err := c.Client.AddAsync([]byte(key+leaseSuffix), []byte{1}, make([]byte, 4), client.Expiration(c.LeaseTTL))
+	if err != nil {
+		return false
+	}
+	return (<-res).Err == nil
+}
+
+func (c *Cache) loadAndStore(ctx context.Context, key string, ttl time.Duration, loader Loader) ([]byte, error) {
+	value, err := loader(ctx)
+	switch err {
+	case nil:
+		softTTL := c.jitter(ttl)
+		c.store(key, encode(kindValue, c.now().Add(softTTL), value), softTTL+c.StaleTTL)
+		return value, nil
+	case ErrNotFound:
+		if c.NegativeTTL > 0 {
+			negativeTTL := c.jitter(c.NegativeTTL)
+			c.store(key, encode(kindNegative, c.now().Add(negativeTTL), nil), negativeTTL)
+		}
+		return nil, ErrNotFound
+	default:
+		return nil, err
+	}
+}
+
+// store writes the value without waiting for the response. The failure of the cache is not the failure of the caller.
+func (c *Cache) store(key string, value []byte, ttl time.Duration) {
+	c.Client.SetAsync([]byte(key), value, 0, make([]byte, 4), client.Expiration(ttl))
+}
+
+func (c *Cache) jitter(ttl time.Duration) time.Duration {
+	if c.Jitter <= 0 {
+		return ttl
+	}
+
+	c.mu.Lock()
+	r := c.random.Float64()
+	c.mu.Unlock()
+	return time.Duration(float64(ttl) * (1 + c.Jitter*(2*r-1)))
+}
+
+func encode(kind byte, softExpireAt time.Time, value []byte) []byte {
+	b := make([]byte, headerSize+len(value))
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:9], uint64(softExpireAt.UnixNano()))
+	copy(b[headerSize:], value)
+
+	return b
+}
+
+func decode(b []byte) (kind byte, softExpireAt time.Time, value []byte, ok bool) {
+	if len(b) < headerSize {
+		return 0, time.Time{}, nil, false
+	}
+	kind = b[0]
+	if kind != kindValue && kind != kindNegative {
+		return 0, time.Time{}, nil, false
+	}
+
+	return kind, time.Unix(0, int64(binary.BigEndian.Uint64(b[1:9]))), b[headerSize:], true
+}
+
+type call struct {
+	done  chan struct{}
+	value []byte
+	err   error
+}
+
+// group deduplicates the concurrent function calls for the same key.
+type group struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do calls fn unless the call for key is in flight, and returns the call which the caller waits for.
+func (g *group) do(key string, fn func() ([]byte, error)) *call {
+	g.mu.Lock()
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return c
+	}
+	c := g.begin(key)
+	g.mu.Unlock()
+
+	go g.run(key, c, fn)
+	return c
+}
+
+// start calls fn in background unless the call for key is in flight.
+func (g *group) start(key string, fn func() ([]byte, error)) {
+	g.mu.Lock()
+	if _, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		return
+	}
+	c := g.begin(key)
+	g.mu.Unlock()
+
+	go g.run(key, c, fn)
+}
+
+// begin registers the call of key. g.mu must be held.
+func (g *group) begin(key string) *call {
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+
+	return c
+}
+
+func (g *group) run(key string, c *call, fn func() ([]byte, error)) {
+	c.value, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+}
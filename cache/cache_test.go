@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+type testClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+}
+
+func newTestCache(t *testing.T) (*Cache, *memcachedtest.Server, *testClock) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	c, err := client.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{t: time.Unix(1500000000, 0)}
+	s.Now = clock.Now
+
+	cache := New(c)
+	cache.Jitter = 0
+	cache.now = clock.Now
+	return cache, s, clock
+}
+
+// waitFor waits until the value of key is stored to the server.
+func waitFor(t *testing.T, s *memcachedtest.Server, key string, f func([]byte) bool) {
+	for i := 0; i < 100; i++ {
+		if v, ok := s.Value(key); ok && f(v) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s is not stored", key)
+}
+
+func TestCache_GetOrLoad(t *testing.T) {
+	cache, s, _ := newTestCache(t)
+
+	var called int32
+	loader := func(_ context.Context) ([]byte, error) {
+		atomic.AddInt32(&called, 1)
+		return []byte("value"), nil
+	}
+
+	v, err := cache.GetOrLoad(context.Background(), "key", time.Minute, loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value" {
+		t.Fatalf("unexpected value: %s", v)
+	}
+	waitFor(t, s, "key", func(_ []byte) bool { return true })
+
+	v, err = cache.GetOrLoad(context.Background(), "key", time.Minute, loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "value" {
+		t.Fatalf("unexpected value: %s", v)
+	}
+	if called != 1 {
+		t.Errorf("expected the loader is called once but %d", called)
+	}
+}
+
+func TestCache_GetOrLoad_Singleflight(t *testing.T) {
+	cache, _, _ := newTestCache(t)
+
+	var called int32
+	release := make(chan struct{})
+	loader := func(_ context.Context) ([]byte, error) {
+		atomic.AddInt32(&called, 1)
+		<-release
+		return []byte("value"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := cache.GetOrLoad(context.Background(), "key", time.Minute, loader)
+			if err != nil || string(v) != "value" {
+				t.Errorf("unexpected result: %s %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if called != 1 {
+		t.Errorf("expected the loader is called once but %d", called)
+	}
+}
+
+func TestCache_GetOrLoad_CancelFirstCaller(t *testing.T) {
+	cache, _, _ := newTestCache(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loader := func(ctx context.Context) ([]byte, error) {
+		close(started)
+		select {
+		case <-release:
+			return []byte("value"), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.GetOrLoad(ctx, "key", time.Minute, loader)
+		first <- err
+	}()
+	<-started
+	second := make(chan []byte, 1)
+	go func() {
+		v, err := cache.GetOrLoad(context.Background(), "key", time.Minute, loader)
+		if err != nil {
+			t.Errorf("the other caller fails: %v", err)
+		}
+		second <- v
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// The first caller gives up but the shared load continues.
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Errorf("expected context.Canceled but got %v", err)
+	}
+	close(release)
+	if v := <-second; string(v) != "value" {
+		t.Errorf("unexpected value: %q", v)
+	}
+}
+
+func TestCache_GetOrLoad_Stale(t *testing.T) {
+	cache, s, clock := newTestCache(t)
+	cache.StaleTTL = time.Minute
+
+	if _, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, func(_ context.Context) ([]byte, error) {
+		return []byte("old"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, s, "key", func(_ []byte) bool { return true })
+	clock.Advance(30 * time.Second)
+
+	var called int32
+	release := make(chan struct{})
+	loader := func(_ context.Context) ([]byte, error) {
+		atomic.AddInt32(&called, 1)
+		<-release
+		return []byte("new"), nil
+	}
+	for i := 0; i < 3; i++ {
+		v, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, loader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != "old" {
+			t.Fatalf("expected the stale value but got %s", v)
+		}
+	}
+	close(release)
+	waitFor(t, s, "key", func(v []byte) bool {
+		_, _, value, _ := decode(v)
+		return string(value) == "new"
+	})
+	if called != 1 {
+		t.Errorf("expected the loader is called once but %d", called)
+	}
+
+	v, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, loader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "new" {
+		t.Fatalf("expected the refreshed value but got %s", v)
+	}
+
+	// The stale value is expired after StaleTTL
+	clock.Advance(10*time.Second + time.Minute)
+	if _, ok := s.Value("key"); ok {
+		t.Fatal("the value should be expired")
+	}
+}
+
+// leaseBlockingClient blocks the lease until release is closed.
+type leaseBlockingClient struct {
+	*client.Client
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *leaseBlockingClient) AddAsync(key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
+	close(c.started)
+	<-c.release
+	return c.Client.AddAsync(key, value, flag, expiration)
+}
+
+func TestCache_GetOrLoad_MissWhileLeaseDenied(t *testing.T) {
+	cache, s, clock := newTestCache(t)
+	c := cache.Client.(*client.Client)
+	if _, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, func(_ context.Context) ([]byte, error) {
+		return []byte("old"), nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, s, "key", func(_ []byte) bool { return true })
+	clock.Advance(30 * time.Second)
+
+	// The other process holds the lease.
+	if err := c.Add([]byte("key"+leaseSuffix), []byte{1}, make([]byte, 4), 60); err != nil {
+		t.Fatal(err)
+	}
+	blocking := &leaseBlockingClient{Client: c, started: make(chan struct{}), release: make(chan struct{})}
+	cache.Client = blocking
+	loader := func(_ context.Context) ([]byte, error) {
+		return []byte("new"), nil
+	}
+	if _, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, loader); err != nil {
+		t.Fatal(err)
+	}
+	<-blocking.started
+
+	// The key is evicted while the refresh is waiting for the lease.
+	if err := c.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		value []byte
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := cache.GetOrLoad(context.Background(), "key", 10*time.Second, loader)
+		done <- result{value: v, err: err}
+	}()
+	var r result
+	select {
+	case r = <-done:
+		close(blocking.release)
+	case <-time.After(100 * time.Millisecond):
+		close(blocking.release)
+		r = <-done
+	}
+	if r.err != nil || string(r.value) != "new" {
+		t.Errorf("expected the value of the loader but got %q %v", r.value, r.err)
+	}
+}
+
+func TestCache_GetOrLoad_Negative(t *testing.T) {
+	cache, _, clock := newTestCache(t)
+	cache.NegativeTTL = 10 * time.Second
+
+	var called int32
+	loader := func(_ context.Context) ([]byte, error) {
+		atomic.AddInt32(&called, 1)
+		return nil, ErrNotFound
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetOrLoad(context.Background(), "key", time.Minute, loader); err != ErrNotFound {
+			t.Fatalf("expected ErrNotFound but got %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if called != 1 {
+		t.Errorf("expected the loader is called once but %d", called)
+	}
+
+	clock.Advance(10 * time.Second)
+	cache.GetOrLoad(context.Background(), "key", time.Minute, loader)
+	if called != 2 {
+		t.Errorf("expected the loader is called after the negative TTL but %d", called)
+	}
+}
+
+func TestCache_GetOrLoad_Error(t *testing.T) {
+	cache, s, _ := newTestCache(t)
+
+	loadErr := errors.New("database is down")
+	if _, err := cache.GetOrLoad(context.Background(), "key", time.Minute, func(_ context.Context) ([]byte, error) {
+		return nil, loadErr
+	}); err != loadErr {
+		t.Fatalf("expected the error of the loader but got %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := s.Value("key"); ok {
+		t.Fatal("the error should not be cached")
+	}
+}
+
+func TestCache_Jitter(t *testing.T) {
+	cache := New(nil)
+	cache.Jitter = 0.1
+
+	for i := 0; i < 1000; i++ {
+		d := cache.jitter(100 * time.Second)
+		if d < 90*time.Second || d > 110*time.Second {
+			t.Fatalf("out of range: %v", d)
+		}
+	}
+}
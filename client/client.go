@@ -1,27 +1,56 @@
 package client
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
+	"math"
 	"net"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 const (
 	MagicRequest  = 0x80
 	MagicResponse = 0x81
 
-	OpcodeGet     = 0x00
-	OpcodeSet     = 0x01
-	OpcodeAdd     = 0x02
-	OpcodeReplace = 0x03
-	OpcodeDel     = 0x04
-	OpcodeIncr    = 0x05
-	OpcodeDecr    = 0x06
+	OpcodeGet      = 0x00
+	OpcodeSet      = 0x01
+	OpcodeAdd      = 0x02
+	OpcodeReplace  = 0x03
+	OpcodeDel      = 0x04
+	OpcodeIncr     = 0x05
+	OpcodeDecr     = 0x06
+	OpcodeQuit     = 0x07
+	OpcodeFlush    = 0x08
+	OpcodeGetQ     = 0x09
+	OpcodeNoop     = 0x0a
+	OpcodeVersion  = 0x0b
+	OpcodeGetK     = 0x0c
+	OpcodeGetKQ    = 0x0d
+	OpcodeAppend   = 0x0e
+	OpcodePrepend  = 0x0f
+	OpcodeStat     = 0x10
+	OpcodeSetQ     = 0x11
+	OpcodeAddQ     = 0x12
+	OpcodeReplaceQ = 0x13
+	OpcodeDelQ     = 0x14
+	OpcodeIncrQ    = 0x15
+	OpcodeDecrQ    = 0x16
+	OpcodeQuitQ    = 0x17
+	OpcodeFlushQ   = 0x18
+	OpcodeAppendQ  = 0x19
+	OpcodePrependQ = 0x1a
+	OpcodeTouch    = 0x1c
+	OpcodeGAT      = 0x1d
+	OpcodeGATQ     = 0x1e
+	OpcodeGATK     = 0x23
+	OpcodeGATKQ    = 0x24
 
 	StatusNoError                       = 0x0000
 	StatusKeyNotFound                   = 0x0001
@@ -45,15 +74,68 @@ var (
 	ErrKeyNotFound      = errors.New("client: key not found")
 	ErrKeyAlreadyExists = errors.New("client: key already exists")
 	ErrValueTooLarge    = errors.New("client: value too large")
+	ErrInvalidArguments = errors.New("client: invalid arguments")
+	ErrItemNotStored    = errors.New("client: item not stored")
+	ErrNonNumericValue  = errors.New("client: incr/decr on non-numeric value")
+	ErrUnknownCommand   = errors.New("client: unknown command")
+	ErrOutOfMemory      = errors.New("client: out of memory")
+	ErrNotSupported     = errors.New("client: not supported")
+	ErrInternalError    = errors.New("client: internal error")
+	ErrBusy             = errors.New("client: busy")
+	ErrTemporaryFailure = errors.New("client: temporary failure")
+	ErrInvalidResponse  = errors.New("client: invalid response")
+
+	ErrClosed             = errors.New("client: connection closed")
+	ErrInvalidAddress     = errors.New("client: invalid address")
+	ErrUnsupportedNetwork = errors.New("client: unsupported network")
 )
 
+// ExpirationNoCreate is the expiration of incr and decr which doesn't create the item if the key doesn't exist.
+const ExpirationNoCreate = -1
+
+// MaxRelativeExpiration is the largest expiration which memcached treats as the relative seconds.
+// The larger expiration is treated as the unix time.
+const MaxRelativeExpiration = 60 * 60 * 24 * 30
+
+// Expiration converts ttl to the expiration of memcached. ttl is rounded up to seconds and is at least a second.
+// The ttl which is longer than MaxRelativeExpiration is converted to the unix time.
+func Expiration(ttl time.Duration) int {
+	return ExpirationAt(ttl, time.Now())
+}
+
+// ExpirationAt converts ttl to the expiration of memcached as Expiration does, assuming that the current time is now.
+func ExpirationAt(ttl time.Duration, now time.Time) int {
+	sec := int(math.Ceil(ttl.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	if sec > MaxRelativeExpiration {
+		return int(now.Unix()) + sec
+	}
+
+	return sec
+}
+
 type Item struct {
-	Key   []byte
-	Value []byte
-	Extra []byte
-	CAS   uint64
-	Err   error
-	Raw   []byte
+	Key    []byte
+	Value  []byte
+	Extra  []byte
+	CAS    uint64
+	Status uint16
+	Err    error
+	Raw    []byte
+}
+
+// Counter returns the value of the response of incr and decr.
+func (item *Item) Counter() (uint64, error) {
+	if item.Err != nil {
+		return 0, item.Err
+	}
+	if len(item.Value) != 8 {
+		return 0, ErrInvalidResponse
+	}
+
+	return binary.BigEndian.Uint64(item.Value), nil
 }
 
 type Client struct {
@@ -62,18 +144,68 @@ type Client struct {
 	asyncRequest    map[uint32]chan *Item
 	mu              *sync.Mutex
 	writeBufferPool *sync.Pool
+	// err is the error of the connection. If err is not nil, the client can't send any request.
+	err error
+	// streams are the requests which receive multiple responses. The channel is closed after the last response.
+	streams map[uint32]struct{}
+	// network and address are the address of the server which Redial connects to.
+	network, address string
+	// closed is true after Close is called. The closed client is never redialed.
+	closed bool
 }
 
 func NewClient(host string, port int) (*Client, error) {
-	conn, err := net.Dial("tcp", host+":"+strconv.Itoa(port))
+	return Dial(net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// Dial connects to the server at addr.
+// addr is either "host:port" or an address qualified with the network
+// such as "tcp://127.0.0.1:11211" or "unix:///var/run/memcached.sock".
+func Dial(addr string) (*Client, error) {
+	network, address, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial(network, address)
 	if err != nil {
 		return nil, err
 	}
+	client := newClient(conn)
+	client.network, client.address = network, address
+
+	return client, nil
+}
+
+// ParseAddr splits addr into the network and the address which can be passed to net.Dial or net.Listen.
+// The address without the network is treated as tcp.
+func ParseAddr(addr string) (network, address string, err error) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		if addr == "" {
+			return "", "", ErrInvalidAddress
+		}
+		return "tcp", addr, nil
+	}
 
+	network, address = addr[:i], addr[i+3:]
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return "", "", ErrUnsupportedNetwork
+	}
+	if address == "" {
+		return "", "", ErrInvalidAddress
+	}
+
+	return network, address, nil
+}
+
+func newClient(conn net.Conn) *Client {
 	client := &Client{
 		conn:         conn,
 		sequence:     0,
 		asyncRequest: make(map[uint32]chan *Item),
+		streams:      make(map[uint32]struct{}),
 		mu:           &sync.Mutex{},
 		writeBufferPool: &sync.Pool{
 			New: func() interface{} {
@@ -83,7 +215,57 @@ func NewClient(host string, port int) (*Client, error) {
 	}
 	go client.readConn()
 
-	return client, nil
+	return client
+}
+
+// Close closes the connection. The outstanding requests fail with ErrClosed.
+func (client *Client) Close() error {
+	client.mu.Lock()
+	client.closed = true
+	conn := client.conn
+	client.mu.Unlock()
+
+	return conn.Close()
+}
+
+// Redial connects to the server again if the connection failed. It does nothing if the connection is alive.
+// The requests which are sent after Redial returns nil use the new connection.
+// timeout is the timeout of the dial. Zero means no timeout.
+func (client *Client) Redial(timeout time.Duration) error {
+	client.mu.Lock()
+	closed, err := client.closed, client.err
+	client.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if err == nil {
+		return nil
+	}
+	if client.address == "" {
+		return ErrInvalidAddress
+	}
+
+	conn, err := net.DialTimeout(client.network, client.address, timeout)
+	if err != nil {
+		return err
+	}
+
+	client.mu.Lock()
+	if client.closed || client.err == nil {
+		// Closed or redialed by another goroutine while dialing
+		client.mu.Unlock()
+		conn.Close()
+		if client.closed {
+			return ErrClosed
+		}
+		return nil
+	}
+	client.conn = conn
+	client.err = nil
+	client.mu.Unlock()
+	go client.readConn()
+
+	return nil
 }
 
 func (client *Client) GetAsync(key []byte) (<-chan *Item, error) {
@@ -113,6 +295,73 @@ func (client *Client) Get(key []byte) (*Item, error) {
 	return v, nil
 }
 
+// GetMulti gets the items of keys in one round trip.
+// The returned map is keyed by the key and doesn't have the keys which are not found.
+func (client *Client) GetMulti(keys [][]byte) (map[string]*Item, error) {
+	b := client.writeBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		b.Reset()
+		client.writeBufferPool.Put(b)
+	}()
+
+	// The server responds only to the hits of GetKQ. The response of Noop indicates that all responses have arrived.
+	opaques := make([]uint32, len(keys))
+	results := make([]chan *Item, len(keys))
+	header := make([]byte, 24)
+	for i, key := range keys {
+		opaques[i] = client.nextOpaque()
+		results[i] = make(chan *Item, 1)
+		encodeRequestHeader(header, OpcodeGetKQ, len(key), 0, len(key), opaques[i], 0)
+		b.Write(header)
+		b.Write(key)
+	}
+	noopOpaque := client.nextOpaque()
+	noop := make(chan *Item, 1)
+	encodeRequestHeader(header, OpcodeNoop, 0, 0, 0, noopOpaque, 0)
+	b.Write(header)
+
+	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		return nil, client.err
+	}
+	for i := range keys {
+		client.asyncRequest[opaques[i]] = results[i]
+	}
+	client.asyncRequest[noopOpaque] = noop
+	conn := client.conn
+	client.mu.Unlock()
+
+	if n, err := conn.Write(b.Bytes()); err != nil || b.Len() != n {
+		client.mu.Lock()
+		for _, v := range opaques {
+			delete(client.asyncRequest, v)
+		}
+		delete(client.asyncRequest, noopOpaque)
+		client.mu.Unlock()
+		return nil, err
+	}
+
+	if v := <-noop; v.Err != nil {
+		return nil, v.Err
+	}
+	items := make(map[string]*Item)
+	client.mu.Lock()
+	for i, key := range keys {
+		select {
+		case v := <-results[i]:
+			if v.Err == nil {
+				items[string(key)] = v
+			}
+		default:
+			delete(client.asyncRequest, opaques[i])
+		}
+	}
+	client.mu.Unlock()
+
+	return items, nil
+}
+
 func (client *Client) SetAsync(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *Item, error) {
 	return client.setAsync(OpcodeSet, key, value, cas, flag, expiration)
 }
@@ -156,6 +405,22 @@ func (client *Client) Replace(key, value []byte, cas uint64, flag []byte, expira
 }
 
 func (client *Client) DelAsync(key []byte) (<-chan *Item, error) {
+	return client.DelCASAsync(key, 0)
+}
+
+func (client *Client) Del(key []byte) error {
+	c, err := client.DelAsync(key)
+	if err != nil {
+		return err
+	}
+
+	v := <-c
+	return v.Err
+}
+
+// DelCASAsync deletes the item only if the CAS value of the item is cas.
+// If cas is zero, the item is deleted unconditionally.
+func (client *Client) DelCASAsync(key []byte, cas uint64) (<-chan *Item, error) {
 	buf := make([]byte, 24)
 	buf[0] = MagicRequest
 	buf[1] = OpcodeDel
@@ -163,12 +428,43 @@ func (client *Client) DelAsync(key []byte) (<-chan *Item, error) {
 	binary.BigEndian.PutUint32(buf[8:12], uint32(len(key)))
 	sequence := client.nextOpaque()
 	binary.BigEndian.PutUint32(buf[12:16], sequence)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
 
 	return client.callAsync(sequence, buf, key)
 }
 
-func (client *Client) Del(key []byte) error {
-	c, err := client.DelAsync(key)
+func (client *Client) DelCAS(key []byte, cas uint64) error {
+	c, err := client.DelCASAsync(key, cas)
+	if err != nil {
+		return err
+	}
+
+	v := <-c
+	return v.Err
+}
+
+// AppendAsync appends value to the existing item. If cas is not zero, the item is changed only if the CAS value of the item is cas.
+func (client *Client) AppendAsync(key, value []byte, cas uint64) (<-chan *Item, error) {
+	return client.concatAsync(OpcodeAppend, key, value, cas)
+}
+
+func (client *Client) Append(key, value []byte, cas uint64) error {
+	c, err := client.AppendAsync(key, value, cas)
+	if err != nil {
+		return err
+	}
+
+	v := <-c
+	return v.Err
+}
+
+// PrependAsync prepends value to the existing item. If cas is not zero, the item is changed only if the CAS value of the item is cas.
+func (client *Client) PrependAsync(key, value []byte, cas uint64) (<-chan *Item, error) {
+	return client.concatAsync(OpcodePrepend, key, value, cas)
+}
+
+func (client *Client) Prepend(key, value []byte, cas uint64) error {
+	c, err := client.PrependAsync(key, value, cas)
 	if err != nil {
 		return err
 	}
@@ -177,6 +473,117 @@ func (client *Client) Del(key []byte) error {
 	return v.Err
 }
 
+func (client *Client) concatAsync(opcode byte, key, value []byte, cas uint64) (<-chan *Item, error) {
+	buf := make([]byte, 24)
+	sequence := client.nextOpaque()
+	encodeRequestHeader(buf, opcode, len(key), 0, len(key)+len(value), sequence, cas)
+
+	return client.callAsync(sequence, buf, key, value)
+}
+
+// TouchAsync changes the expiration of the item.
+func (client *Client) TouchAsync(key []byte, expiration int) (<-chan *Item, error) {
+	return client.touchAsync(OpcodeTouch, key, expiration)
+}
+
+func (client *Client) Touch(key []byte, expiration int) error {
+	c, err := client.TouchAsync(key, expiration)
+	if err != nil {
+		return err
+	}
+
+	v := <-c
+	return v.Err
+}
+
+// GATAsync gets the item and changes its expiration.
+func (client *Client) GATAsync(key []byte, expiration int) (<-chan *Item, error) {
+	return client.touchAsync(OpcodeGAT, key, expiration)
+}
+
+func (client *Client) GAT(key []byte, expiration int) (*Item, error) {
+	c, err := client.GATAsync(key, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	v := <-c
+	if v.Err != nil {
+		return nil, v.Err
+	}
+	return v, nil
+}
+
+func (client *Client) touchAsync(opcode byte, key []byte, expiration int) (<-chan *Item, error) {
+	buf := make([]byte, 28)
+	sequence := client.nextOpaque()
+	encodeRequestHeader(buf, opcode, len(key), 4, len(key)+4, sequence, 0)
+	binary.BigEndian.PutUint32(buf[24:28], uint32(expiration))
+
+	return client.callAsync(sequence, buf, key)
+}
+
+// NoopAsync sends Noop. The response arrives after all preceding requests have been answered.
+// It is used to check that the server is alive.
+func (client *Client) NoopAsync() (<-chan *Item, error) {
+	buf := make([]byte, 24)
+	sequence := client.nextOpaque()
+	encodeRequestHeader(buf, OpcodeNoop, 0, 0, 0, sequence, 0)
+
+	return client.callAsync(sequence, buf)
+}
+
+func (client *Client) Noop() error {
+	c, err := client.NoopAsync()
+	if err != nil {
+		return err
+	}
+
+	v := <-c
+	return v.Err
+}
+
+// Stat is a statistic which is returned by the stats command.
+type Stat struct {
+	Name  string
+	Value string
+}
+
+// StatsAsync sends the stats command of group. The empty group is the general statistics.
+// The channel receives a response per statistic and the terminator which has no key, and is closed after the terminator.
+// The caller must receive until the channel is closed.
+func (client *Client) StatsAsync(group string) (<-chan *Item, error) {
+	buf := make([]byte, 24)
+	sequence := client.nextOpaque()
+	encodeRequestHeader(buf, OpcodeStat, len(group), 0, len(group), sequence, 0)
+
+	return client.call(sequence, make(chan *Item, 64), true, buf, []byte(group))
+}
+
+// Stats returns the statistics of group in the order of the response of the server.
+func (client *Client) Stats(group string) ([]Stat, error) {
+	c, err := client.StatsAsync(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats []Stat
+	for v := range c {
+		if v.Err != nil {
+			err = v.Err
+			continue
+		}
+		if len(v.Key) > 0 {
+			stats = append(stats, Stat{Name: string(v.Key), Value: string(v.Value)})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
 func (client *Client) IncrAsync(key []byte, delta, initial int64, expiration int) (<-chan *Item, error) {
 	return client.incrAndDecrAsync(OpcodeIncr, key, delta, initial, expiration)
 }
@@ -188,7 +595,7 @@ func (client *Client) Incr(key []byte, delta, initial int64, expiration int) (ui
 	}
 
 	v := <-c
-	return binary.BigEndian.Uint64(v.Value), nil
+	return v.Counter()
 }
 
 func (client *Client) DecrAsync(key []byte, delta, initial int64, expiration int) (<-chan *Item, error) {
@@ -202,7 +609,7 @@ func (client *Client) Decr(key []byte, delta, initial int64, expiration int) (ui
 	}
 
 	v := <-c
-	return binary.BigEndian.Uint64(v.Value), nil
+	return v.Counter()
 }
 
 func (client *Client) incrAndDecrAsync(opcode byte, key []byte, delta, initial int64, expiration int) (<-chan *Item, error) {
@@ -243,7 +650,23 @@ func (client *Client) setAsync(opcode byte, key, value []byte, cas uint64, flag
 	return client.callAsync(sequence, buf, flag, b, key, value)
 }
 
+func encodeRequestHeader(buf []byte, opcode byte, keyLength, extraLength, bodyLength int, opaque uint32, cas uint64) {
+	buf[0] = MagicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(keyLength))
+	buf[4] = byte(extraLength)
+	buf[5] = 0
+	binary.BigEndian.PutUint16(buf[6:8], 0)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(bodyLength))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+}
+
 func (client *Client) callAsync(sequence uint32, buffers ...[]byte) (<-chan *Item, error) {
+	return client.call(sequence, make(chan *Item, 1), false, buffers...)
+}
+
+func (client *Client) call(sequence uint32, result chan *Item, stream bool, buffers ...[]byte) (<-chan *Item, error) {
 	b := client.writeBufferPool.Get().(*bytes.Buffer)
 	defer func() {
 		b.Reset()
@@ -253,14 +676,22 @@ func (client *Client) callAsync(sequence uint32, buffers ...[]byte) (<-chan *Ite
 		b.Write(v)
 	}
 
-	result := make(chan *Item, 1)
 	client.mu.Lock()
+	if client.err != nil {
+		client.mu.Unlock()
+		return nil, client.err
+	}
 	client.asyncRequest[sequence] = result
+	if stream {
+		client.streams[sequence] = struct{}{}
+	}
+	conn := client.conn
 	client.mu.Unlock()
 
-	if n, err := client.conn.Write(b.Bytes()); err != nil || b.Len() != n {
+	if n, err := conn.Write(b.Bytes()); err != nil || b.Len() != n {
 		client.mu.Lock()
 		delete(client.asyncRequest, sequence)
+		delete(client.streams, sequence)
 		client.mu.Unlock()
 		return nil, err
 	}
@@ -273,26 +704,46 @@ func (client *Client) nextOpaque() uint32 {
 }
 
 func (client *Client) readConn() {
-	messageBuf := &bytes.Buffer{}
-	buf := make([]byte, 1500)
+	client.mu.Lock()
+	conn := client.conn
+	client.mu.Unlock()
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, 24)
 	for {
-		n, err := client.conn.Read(buf)
-		if err == io.EOF {
-			break
+		if _, err := io.ReadFull(r, header); err != nil {
+			client.fail(err)
+			return
 		}
-		messageBuf.Write(buf[:n])
-		if n == 1500 {
-			continue
-		}
-		if messageBuf.Len() < 24 {
-			messageBuf.Reset()
-			continue
+		bodySize := int(binary.BigEndian.Uint32(header[8:12]))
+		buf := make([]byte, 24+bodySize)
+		copy(buf, header)
+		if _, err := io.ReadFull(r, buf[24:]); err != nil {
+			client.fail(err)
+			return
 		}
 
-		b := make([]byte, messageBuf.Len())
-		copy(b, messageBuf.Bytes())
-		client.dispatch(b)
-		messageBuf.Reset()
+		client.dispatch(buf)
+	}
+}
+
+// fail notifies err to all outstanding requests. The client can't be used after fail is called until Redial succeeds.
+func (client *Client) fail(err error) {
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, net.ErrClosed) {
+		err = ErrClosed
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.err = err
+	for opaque, c := range client.asyncRequest {
+		c <- &Item{Status: StatusInternalError, Err: err}
+		delete(client.asyncRequest, opaque)
+		if _, ok := client.streams[opaque]; ok {
+			close(c)
+			delete(client.streams, opaque)
+		}
 	}
 }
 
@@ -310,30 +761,66 @@ func (client *Client) dispatch(buf []byte) {
 	bodySize := int(binary.BigEndian.Uint32(buf[8:12]))
 	opaque := binary.BigEndian.Uint32(buf[12:16])
 	cas := binary.BigEndian.Uint64(buf[16:24])
+	if keySize+extraSize > bodySize || len(buf) < 24+bodySize {
+		return
+	}
 	extra := buf[24 : 24+extraSize]
 	var key []byte
 	if keySize > 0 {
 		key = buf[24+extraSize : 24+extraSize+keySize]
 	}
+	// bodySize is the total length of extra, key and value
 	var body []byte
-	if bodySize > 0 {
-		body = buf[24+keySize+extraSize : 24+keySize+extraSize+bodySize]
+	if valueSize := bodySize - keySize - extraSize; valueSize > 0 {
+		body = buf[24+keySize+extraSize : 24+bodySize]
 	}
 
-	var err error
-	switch status {
-	case StatusKeyNotFound:
-		err = ErrKeyNotFound
-	case StatusKeyExists:
-		err = ErrKeyAlreadyExists
-	case StatusValueTooLarge:
-		err = ErrValueTooLarge
-	}
+	err := StatusError(status)
 
 	client.mu.Lock()
 	if c, ok := client.asyncRequest[opaque]; ok {
-		c <- &Item{Key: key, Value: body, Extra: extra, CAS: cas, Err: err, Raw: buf}
-		delete(client.asyncRequest, opaque)
+		c <- &Item{Key: key, Value: body, Extra: extra, CAS: cas, Status: status, Err: err, Raw: buf}
+		if _, stream := client.streams[opaque]; !stream {
+			delete(client.asyncRequest, opaque)
+		} else if keySize == 0 || status != StatusNoError {
+			// The response without the key terminates the stream
+			close(c)
+			delete(client.asyncRequest, opaque)
+			delete(client.streams, opaque)
+		}
 	}
 	client.mu.Unlock()
 }
+
+// StatusError returns the error which corresponds to status of the response.
+// StatusError returns nil if status is StatusNoError.
+func StatusError(status uint16) error {
+	switch status {
+	case StatusNoError:
+		return nil
+	case StatusKeyNotFound:
+		return ErrKeyNotFound
+	case StatusKeyExists:
+		return ErrKeyAlreadyExists
+	case StatusValueTooLarge:
+		return ErrValueTooLarge
+	case StatusInvalidArguments:
+		return ErrInvalidArguments
+	case StatusItemNotStored:
+		return ErrItemNotStored
+	case StatusNonNumericValue:
+		return ErrNonNumericValue
+	case StatusUnknownCommand:
+		return ErrUnknownCommand
+	case StatusOutOfMemory:
+		return ErrOutOfMemory
+	case StatusNotSupported:
+		return ErrNotSupported
+	case StatusBusy:
+		return ErrBusy
+	case StatusTemporaryFailure:
+		return ErrTemporaryFailure
+	default:
+		return ErrInternalError
+	}
+}
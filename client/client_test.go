@@ -1,9 +1,249 @@
 package client
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/internal/memcachedtest"
 )
 
+func TestParseAddr(t *testing.T) {
+	cases := []struct {
+		Addr    string
+		Network string
+		Address string
+		Err     error
+	}{
+		{Addr: "127.0.0.1:11211", Network: "tcp", Address: "127.0.0.1:11211"},
+		{Addr: "tcp://127.0.0.1:11211", Network: "tcp", Address: "127.0.0.1:11211"},
+		{Addr: "tcp6://[::1]:11211", Network: "tcp6", Address: "[::1]:11211"},
+		{Addr: "unix:///var/run/memcached.sock", Network: "unix", Address: "/var/run/memcached.sock"},
+		{Addr: "udp://127.0.0.1:11211", Err: ErrUnsupportedNetwork},
+		{Addr: "unix://", Err: ErrInvalidAddress},
+		{Addr: "", Err: ErrInvalidAddress},
+	}
+
+	for _, c := range cases {
+		network, address, err := ParseAddr(c.Addr)
+		if err != c.Err {
+			t.Errorf("%s: expected error %v but got %v", c.Addr, c.Err, err)
+			continue
+		}
+		if network != c.Network || address != c.Address {
+			t.Errorf("%s: expected %s %s but got %s %s", c.Addr, c.Network, c.Address, network, address)
+		}
+	}
+}
+
+func TestExpiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	cases := []struct {
+		TTL    time.Duration
+		Expect int
+	}{
+		{TTL: 0, Expect: 1},
+		{TTL: 1500 * time.Millisecond, Expect: 2},
+		{TTL: time.Hour, Expect: 3600},
+		{TTL: MaxRelativeExpiration * time.Second, Expect: MaxRelativeExpiration},
+		{TTL: 31 * 24 * time.Hour, Expect: 1600000000 + 31*24*60*60},
+	}
+	for _, c := range cases {
+		if got := ExpirationAt(c.TTL, now); got != c.Expect {
+			t.Errorf("%v: expected %d but got %d", c.TTL, c.Expect, got)
+		}
+	}
+}
+
+func TestDial_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "memcached.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := Dial("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.conn.RemoteAddr().Network() != "unix" {
+		t.Errorf("expected unix socket but not: %s", c.conn.RemoteAddr().Network())
+	}
+}
+
+func TestClient_DelCAS(t *testing.T) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set([]byte("key"), []byte("value"), 0, []byte{0, 0, 0, 1}, 0); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.Get([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item.Value) != "value" || string(item.Extra) != "\x00\x00\x00\x01" {
+		t.Fatalf("unexpected item: %q %q", item.Value, item.Extra)
+	}
+
+	if err := c.DelCAS([]byte("key"), item.CAS+1); err != ErrKeyAlreadyExists {
+		t.Fatalf("expected ErrKeyAlreadyExists but got %v", err)
+	}
+	if err := c.DelCAS([]byte("key"), item.CAS); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound but got %v", err)
+	}
+}
+
+func TestClient_Redial(t *testing.T) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Redial(time.Second); err != nil {
+		t.Fatalf("the alive connection is redialed: %v", err)
+	}
+
+	s.Close()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := c.Get([]byte("key")); err == ErrClosed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the connection is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.Redial(time.Second); err == nil {
+		t.Fatal("expected the error while the server is down")
+	}
+
+	// The server restarts on the same address.
+	s, err = memcachedtest.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := c.Redial(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set([]byte("key"), []byte("value"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if err := c.Redial(time.Second); err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close but got %v", err)
+	}
+}
+
+func TestClient_GetMulti(t *testing.T) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "c"} {
+		if err := c.Set([]byte(k), []byte("value-"+k), 0, make([]byte, 4), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := c.GetMulti([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items but got %d", len(items))
+	}
+	for _, k := range []string{"a", "c"} {
+		if v, ok := items[k]; !ok || string(v.Value) != "value-"+k {
+			t.Errorf("unexpected item of %s: %v", k, v)
+		}
+	}
+	c.mu.Lock()
+	if len(c.asyncRequest) != 0 {
+		t.Errorf("the requests of the misses should be removed: %d", len(c.asyncRequest))
+	}
+	c.mu.Unlock()
+
+	// The connection is still usable after GetMulti
+	if _, err := c.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_AppendTouch(t *testing.T) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Append([]byte("key"), []byte("value"), 0); err != ErrItemNotStored {
+		t.Fatalf("expected ErrItemNotStored but got %v", err)
+	}
+	if err := c.Set([]byte("key"), []byte("b"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Append([]byte("key"), []byte("c"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Prepend([]byte("key"), []byte("a"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Touch([]byte("key"), 1); err != nil {
+		t.Fatal(err)
+	}
+	item, err := c.GAT([]byte("key"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(item.Value) != "abc" {
+		t.Errorf("unexpected value: %q", item.Value)
+	}
+	if err := c.Touch([]byte("missing"), 1); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound but got %v", err)
+	}
+}
+
 func BenchmarkClient_GetAsync(b *testing.B) {
 	b.ReportAllocs()
 
@@ -44,3 +284,48 @@ func BenchmarkClient_IncrAsync(b *testing.B) {
 		}
 	}
 }
+
+func TestClient_Stats(t *testing.T) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	c, err := Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Set([]byte("key"), []byte("value"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := c.Stats("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) == 0 || stats[0].Name != "pid" {
+		t.Fatalf("unexpected stats: %v", stats)
+	}
+	found := false
+	for _, v := range stats {
+		if v.Name == "curr_items" {
+			found = v.Value == "1"
+		}
+	}
+	if !found {
+		t.Errorf("curr_items is not 1: %v", stats)
+	}
+
+	if _, err := c.Stats("unknown"); err != ErrUnknownCommand {
+		t.Errorf("expected ErrUnknownCommand but got %v", err)
+	}
+	// The stream is removed after the terminator.
+	c.mu.Lock()
+	if len(c.asyncRequest) != 0 || len(c.streams) != 0 {
+		t.Errorf("the requests of the stats remain: %d %d", len(c.asyncRequest), len(c.streams))
+	}
+	c.mu.Unlock()
+	if err := c.Noop(); err != nil {
+		t.Fatal(err)
+	}
+}
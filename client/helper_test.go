@@ -77,6 +77,7 @@ func NewTestClient() *Client {
 		mu:           &sync.Mutex{},
 		sequence:     0,
 		asyncRequest: make(map[uint32]chan *Item),
+		streams:      make(map[uint32]struct{}),
 		writeBufferPool: &sync.Pool{
 			New: func() interface{} {
 				return &bytes.Buffer{}
@@ -0,0 +1,155 @@
+// Package cluster provides the client which routes the requests to the memcached cluster without the router.
+//
+// Client builds the same ring as the router from router.Config,
+// so the service which embeds Client and the router agree on the owner of each key during the migration.
+package cluster
+
+import (
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/router"
+	"github.com/pkg/errors"
+)
+
+type Client struct {
+	Cluster *router.Cluster
+
+	servers []*router.Memcached
+}
+
+// New connects to all servers in conf and returns the client.
+func New(conf *router.Config) (*Client, error) {
+	servers := conf.ToRouter()
+	gutter := conf.ToGutter()
+	all := append(append([]*router.Memcached{}, servers...), gutter...)
+	for i, v := range all {
+		if err := v.Connect(); err != nil {
+			for _, s := range all[:i] {
+				s.Client.Close()
+			}
+			return nil, errors.Wrapf(err, "failed to connect to %s", v.Name)
+		}
+	}
+
+	c, err := conf.NewCluster(servers)
+	if err == nil {
+		c.Gutter, err = conf.NewGutter(gutter)
+	}
+	if err != nil {
+		for _, s := range all {
+			s.Client.Close()
+		}
+		return nil, err
+	}
+
+	return &Client{Cluster: c, servers: all}, nil
+}
+
+// NewWithServers returns the client of servers which are already connected.
+func NewWithServers(servers []*router.Memcached) (*Client, error) {
+	ring, err := router.NewRing(servers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{Cluster: &router.Cluster{Ring: ring}, servers: servers}, nil
+}
+
+// Close closes the connections to all servers.
+func (c *Client) Close() error {
+	var firstErr error
+	for _, v := range c.servers {
+		if err := v.Client.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+func (c *Client) GetAsync(key []byte) (<-chan *client.Item, error) {
+	return c.Cluster.Get(key)
+}
+
+func (c *Client) Get(key []byte) (*client.Item, error) {
+	res, err := c.GetAsync(key)
+	if err != nil {
+		return nil, err
+	}
+
+	v := <-res
+	if v.Err != nil {
+		return nil, v.Err
+	}
+	return v, nil
+}
+
+// GetMulti gets keys from the servers in parallel. Each server receives one batch.
+func (c *Client) GetMulti(keys [][]byte) (map[string]*client.Item, error) {
+	return c.Cluster.GetMulti(keys)
+}
+
+func (c *Client) SetAsync(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return c.Cluster.Set(key, value, cas, flag, expiration)
+}
+
+func (c *Client) Set(key, value []byte, cas uint64, flag []byte, expiration int) error {
+	return wait(c.SetAsync(key, value, cas, flag, expiration))
+}
+
+func (c *Client) AddAsync(key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return c.Cluster.Add(key, value, flag, expiration)
+}
+
+func (c *Client) Add(key, value, flag []byte, expiration int) error {
+	return wait(c.AddAsync(key, value, flag, expiration))
+}
+
+func (c *Client) ReplaceAsync(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return c.Cluster.Replace(key, value, cas, flag, expiration)
+}
+
+func (c *Client) Replace(key, value []byte, cas uint64, flag []byte, expiration int) error {
+	return wait(c.ReplaceAsync(key, value, cas, flag, expiration))
+}
+
+func (c *Client) DelAsync(key []byte) (<-chan *client.Item, error) {
+	return c.Cluster.Del(key)
+}
+
+func (c *Client) Del(key []byte) error {
+	return wait(c.DelAsync(key))
+}
+
+func (c *Client) IncrAsync(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+	return c.Cluster.Incr(key, delta, initial, expiration)
+}
+
+func (c *Client) Incr(key []byte, delta, initial int64, expiration int) (uint64, error) {
+	res, err := c.IncrAsync(key, delta, initial, expiration)
+	if err != nil {
+		return 0, err
+	}
+
+	return (<-res).Counter()
+}
+
+func (c *Client) DecrAsync(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+	return c.Cluster.Decr(key, delta, initial, expiration)
+}
+
+func (c *Client) Decr(key []byte, delta, initial int64, expiration int) (uint64, error) {
+	res, err := c.DecrAsync(key, delta, initial, expiration)
+	if err != nil {
+		return 0, err
+	}
+
+	return (<-res).Counter()
+}
+
+func wait(res <-chan *client.Item, err error) error {
+	if err != nil {
+		return err
+	}
+
+	return (<-res).Err
+}
@@ -0,0 +1,121 @@
+package cluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+	"github.com/f110/memcached-operator/router"
+)
+
+func newTestConfig(t *testing.T, names ...string) (*router.Config, map[string]*memcachedtest.Server) {
+	conf := &router.Config{}
+	servers := make(map[string]*memcachedtest.Server)
+	for _, name := range names {
+		s, err := memcachedtest.NewServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		host, port := s.Host()
+		conf.Servers = append(conf.Servers, router.ConfigServer{Name: name, Host: host, Port: port})
+		servers[name] = s
+	}
+
+	return conf, servers
+}
+
+func TestClient(t *testing.T) {
+	conf, servers := newTestConfig(t, "a", "b", "c")
+	c, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	keys := make([][]byte, 100)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		if err := c.Set(keys[i], keys[i], 0, make([]byte, 4), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, s := range servers {
+		if s.Len() == 0 {
+			t.Errorf("%s has no key", name)
+		}
+	}
+
+	for _, key := range keys {
+		v, err := c.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v.Value) != string(key) {
+			t.Fatalf("unexpected value: %s", v.Value)
+		}
+	}
+	if _, err := c.Get([]byte("unknown")); err != client.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound but got %v", err)
+	}
+
+	items, err := c.GetMulti(append(keys, []byte("unknown")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(keys) {
+		t.Fatalf("expected %d items but got %d", len(keys), len(items))
+	}
+	for name, s := range servers {
+		if s.Requests(client.OpcodeNoop) != 1 {
+			t.Errorf("%s should receive one batch: %d", name, s.Requests(client.OpcodeNoop))
+		}
+	}
+
+	n, err := c.Incr([]byte("counter"), 2, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expected the initial value but got %d", n)
+	}
+}
+
+func TestClient_Adding(t *testing.T) {
+	conf, servers := newTestConfig(t, "a", "b", "c")
+	conf.Servers[2].Status = "add"
+	conf.Servers[2].Phase = "wo"
+	c, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		if err := c.Set(key, key, 0, make([]byte, 4), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The writes to the adding server are not waited for
+	for i := 0; i < 100 && servers["c"].Len() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if servers["c"].Len() == 0 {
+		t.Fatal("the adding server should receive the writes")
+	}
+	if servers["a"].Len()+servers["b"].Len() != 100 {
+		t.Fatalf("the existing servers should have all keys: %d", servers["a"].Len()+servers["b"].Len())
+	}
+
+	// The reads are served by the existing servers
+	servers["c"].Pause()
+	defer servers["c"].Resume()
+	for i := 0; i < 100; i++ {
+		if _, err := c.Get([]byte(fmt.Sprintf("key-%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/f110/memcached-operator/router"
+	"github.com/pkg/errors"
+)
+
+const usage = `Usage: ringctl <command> [arguments]
+
+Commands:
+  diff [-keys file] <before.yaml> <after.yaml>
+        report the movement of the keyspace between two configs
+  locate [-c file] [-ejected names] <key>...
+        report the servers which serve the key
+`
+
+func RingCtl(args []string, out io.Writer) error {
+	if len(args) < 2 {
+		fmt.Fprint(out, usage)
+		return errors.New("command is required")
+	}
+
+	switch args[1] {
+	case "diff":
+		return diff(args[2:], out)
+	case "locate":
+		return locate(args[2:], out)
+	default:
+		fmt.Fprint(out, usage)
+		return errors.Errorf("unknown command: %s", args[1])
+	}
+}
+
+func diff(args []string, out io.Writer) error {
+	keyFile := ""
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.StringVar(&keyFile, "keys", keyFile, "file of the sample keys (one key per line)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		return errors.New("diff requires two config files")
+	}
+
+	before, err := loadRing(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	after, err := loadRing(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	m := router.CompareRings(before, after)
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	if m.Exact {
+		fmt.Fprintf(w, "%.2f%% of the keyspace moves\n", m.Moved*100)
+	} else {
+		fmt.Fprintf(w, "%.2f%% of the keyspace moves (estimated from the sample keys)\n", m.Moved*100)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "FROM\tTO\tSHARE")
+	for _, p := range m.Pairs {
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\n", p.From, p.To, p.Share*100)
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "SERVER\tWEIGHT BEFORE\tWEIGHT AFTER\tSHARE BEFORE\tSHARE AFTER")
+	for _, v := range mergeStats(m.Before, m.After) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.name, weight(v.before), weight(v.after), share(v.before), share(v.after))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if keyFile == "" {
+		return nil
+	}
+	return diffKeys(keyFile, before, after, out)
+}
+
+// diffKeys reports the sample keys which move to another server.
+func diffKeys(path string, before, after *router.Ring, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "KEY\tFROM\tTO")
+	total, moved := 0, 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		key := s.Bytes()
+		if len(key) == 0 {
+			continue
+		}
+		total++
+
+		b, a := before.Pick(key), after.Pick(key)
+		if b == nil || a == nil || b.Name == a.Name {
+			continue
+		}
+		moved++
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, b.Name, a.Name)
+	}
+	if err := s.Err(); err != nil {
+		return errors.WithStack(err)
+	}
+	if total > 0 {
+		fmt.Fprintf(w, "\n%d of %d keys (%.2f%%) move\n", moved, total, float64(moved)/float64(total)*100)
+	}
+
+	return w.Flush()
+}
+
+func locate(args []string, out io.Writer) error {
+	confFile := "/etc/router/router.yaml"
+	ejected := ""
+	fs := flag.NewFlagSet("locate", flag.ContinueOnError)
+	fs.StringVar(&confFile, "c", confFile, "conf file path")
+	fs.StringVar(&ejected, "ejected", "", "comma separated names of the servers which are ejected")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("locate requires the key")
+	}
+
+	c, err := loadCluster(confFile)
+	if err != nil {
+		return err
+	}
+	if ejected != "" {
+		if err := c.Ring.SetEjected(strings.Split(ejected, ",")); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for i, key := range fs.Args() {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		l := c.Locate([]byte(key))
+		if l == nil {
+			return errors.New("the ring has no server")
+		}
+		fmt.Fprintf(w, "key:\t%s\n", key)
+		fmt.Fprintf(w, "owner:\t%s (status=%s phase=%s)\n", l.Owner.Name, l.Owner.Status, l.Owner.Phase)
+		fmt.Fprintf(w, "primary:\t%s (%s)\n", l.Primary.Name, l.Primary.Mode)
+		if l.Secondary != nil {
+			fmt.Fprintf(w, "secondary:\t%s (%s)\n", l.Secondary.Name, l.Secondary.Mode)
+		} else {
+			fmt.Fprintln(w, "secondary:\t-")
+		}
+		if l.Gutter != nil {
+			fmt.Fprintf(w, "gutter:\t%s\n", l.Gutter.Name)
+		} else {
+			fmt.Fprintln(w, "gutter:\t-")
+		}
+		fmt.Fprintf(w, "reads:\t%s\n", names(l.Reads))
+		fmt.Fprintf(w, "writes:\t%s\n", names(l.Writes))
+		fmt.Fprintf(w, "deletes:\t%s\n", names(l.Deletes))
+	}
+
+	return w.Flush()
+}
+
+// loadCluster builds the cluster of the config including the replication and the gutter.
+// The servers are not connected.
+func loadCluster(path string) (*router.Cluster, error) {
+	conf, err := router.LoadConfig(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c, err := conf.NewCluster(conf.ToRouter())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build the cluster of %s", path)
+	}
+	c.Gutter, err = conf.NewGutter(conf.ToGutter())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build the gutter of %s", path)
+	}
+
+	return c, nil
+}
+
+func names(servers []*router.Memcached) string {
+	s := make([]string, len(servers))
+	for i, v := range servers {
+		s[i] = v.Name
+	}
+	return strings.Join(s, ", ")
+}
+
+func loadRing(path string) (*router.Ring, error) {
+	conf, err := router.LoadConfig(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ring, err := conf.NewRing(conf.ToRouter())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build the ring of %s", path)
+	}
+
+	return ring, nil
+}
+
+type serverStats struct {
+	name          string
+	before, after *router.ServerStat
+}
+
+// mergeStats joins the stats by the name of the server in the order of before and then after.
+func mergeStats(before, after []router.ServerStat) []*serverStats {
+	var result []*serverStats
+	byName := make(map[string]*serverStats)
+	for i, v := range before {
+		s := &serverStats{name: v.Name, before: &before[i]}
+		byName[v.Name] = s
+		result = append(result, s)
+	}
+	for i, v := range after {
+		s, ok := byName[v.Name]
+		if !ok {
+			s = &serverStats{name: v.Name}
+			result = append(result, s)
+		}
+		s.after = &after[i]
+	}
+
+	return result
+}
+
+func weight(s *router.ServerStat) string {
+	if s == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d", s.Weight)
+}
+
+func share(s *router.ServerStat) string {
+	if s == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f%%", s.Share*100)
+}
+
+func main() {
+	if err := RingCtl(os.Args, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testServers = `servers:
+  - name: server0
+    host: 127.0.0.1
+    port: 11211
+  - name: server1
+    host: 127.0.0.1
+    port: 11212
+  - name: server2
+    host: 127.0.0.1
+    port: 11213
+`
+
+func TestLocate(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Config string
+		Args   []string
+		Expect string
+	}{
+		{
+			Name:   "Normal",
+			Config: testServers,
+			Args:   []string{"foo"},
+			Expect: `key:        foo
+owner:      server2 (status=normal phase=read-write)
+primary:    server2 (read-write)
+secondary:  -
+gutter:     -
+reads:      server2
+writes:     server2
+deletes:    server2
+`,
+		},
+		{
+			Name:   "Replication",
+			Config: testServers + "replication:\n  factor: 2\n",
+			Args:   []string{"foo"},
+			Expect: `key:        foo
+owner:      server2 (status=normal phase=read-write)
+primary:    server2 (read-write)
+secondary:  -
+gutter:     -
+reads:      server2, server1
+writes:     server2, server1
+deletes:    server2, server1
+`,
+		},
+		{
+			Name: "Migration",
+			Config: testServers + `  - name: server3
+    host: 127.0.0.1
+    port: 11214
+    status: add
+    phase: wo
+`,
+			Args: []string{"foo", "bar"},
+			Expect: `key:        foo
+owner:      server3 (status=adding phase=write-only)
+primary:    server2 (read-write)
+secondary:  server3 (write-only)
+gutter:     -
+reads:      server2
+writes:     server2, server3
+deletes:    server2, server3
+
+key:        bar
+owner:      server1 (status=normal phase=read-write)
+primary:    server1 (read-write)
+secondary:  -
+gutter:     -
+reads:      server1
+writes:     server1
+deletes:    server1
+`,
+		},
+		{
+			Name: "Gutter",
+			Config: testServers + `gutter:
+  servers:
+    - name: gutter0
+      host: 127.0.0.1
+      port: 11311
+`,
+			Args: []string{"foo"},
+			Expect: `key:        foo
+owner:      server2 (status=normal phase=read-write)
+primary:    server2 (read-write)
+secondary:  -
+gutter:     -
+reads:      server2
+writes:     server2
+deletes:    server2, gutter0
+`,
+		},
+		{
+			Name: "EjectedOwner",
+			Config: testServers + `gutter:
+  servers:
+    - name: gutter0
+      host: 127.0.0.1
+      port: 11311
+`,
+			Args: []string{"-ejected", "server2", "foo"},
+			Expect: `key:        foo
+owner:      server2 (status=normal phase=read-write)
+primary:    server2 (read-write)
+secondary:  -
+gutter:     gutter0
+reads:      gutter0
+writes:     gutter0
+deletes:    gutter0
+`,
+		},
+		{
+			Name:   "EjectedOwnerWithoutGutter",
+			Config: testServers,
+			Args:   []string{"-ejected", "server2", "foo"},
+			Expect: `key:        foo
+owner:      server2 (status=normal phase=read-write)
+primary:    server2 (read-write)
+secondary:  -
+gutter:     -
+reads:      server1
+writes:     server1
+deletes:    server1
+`,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "router.yaml")
+			if err := os.WriteFile(path, []byte(tc.Config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			out := new(bytes.Buffer)
+			args := append([]string{"ringctl", "locate", "-c", path}, tc.Args...)
+			if err := RingCtl(args, out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tc.Expect {
+				t.Errorf("unexpected output:\n%s\nexpected:\n%s", out.String(), tc.Expect)
+			}
+		})
+	}
+}
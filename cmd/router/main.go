@@ -1,14 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/f110/memcached-operator/logger"
 	"github.com/f110/memcached-operator/router"
-	"github.com/go-yaml/yaml"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
@@ -21,32 +24,51 @@ func Router(args []string) error {
 	logger.Log = l.Sugar()
 
 	confFile := "/etc/router/router.yaml"
+	addr := ":11211"
+	interval := 5 * time.Second
+	adminAddr := ""
 	fs := flag.NewFlagSet("router", flag.ContinueOnError)
 	fs.StringVar(&confFile, "c", confFile, "conf file path")
+	fs.StringVar(&addr, "l", addr, "listen address (e.g. :11211 or unix:///var/run/router.sock)")
+	fs.DurationVar(&interval, "reload-interval", interval, "interval of checking the conf file")
+	fs.StringVar(&adminAddr, "admin", adminAddr, "listen address of the admin API (e.g. :9090). The admin API is disabled if empty")
 	if err := fs.Parse(args[1:]); err != nil {
 		return err
 	}
 
-	conf, err := loadConfig(confFile)
-	if err != nil {
+	r := &router.Router{Addr: addr}
+	reloader := router.NewReloader(confFile, r)
+	reloader.Interval = interval
+	health := router.NewHealthChecker(router.HealthConfig{})
+	reloader.Health = health
+	if err := reloader.Reload(); err != nil {
 		return errors.WithStack(err)
 	}
 
-	r := router.NewRouter(":11211", conf.ToRouter())
-	return r.ListenAndServe()
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx)
+	go health.Run(ctx)
 
-func loadConfig(path string) (*router.Config, error) {
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-	var conf router.Config
-	if err := yaml.Unmarshal(b, &conf); err != nil {
-		return nil, err
+	if adminAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(adminAddr, router.NewAdminHandler(health)); err != nil {
+				logger.Log.Infow("failed to serve the admin API", "addr", adminAddr, "err", err)
+			}
+		}()
 	}
 
-	return &conf, nil
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloader.Reload(); err != nil {
+				logger.Log.Infow("failed to reload the config", "path", confFile, "err", err)
+			}
+		}
+	}()
+
+	return r.ListenAndServe()
 }
 
 func main() {
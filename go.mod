@@ -1,12 +1,17 @@
 module github.com/f110/memcached-operator
 
+go 1.27.1
+
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/go-yaml/yaml v2.1.0+incompatible // indirect
+	github.com/go-yaml/yaml v2.1.0+incompatible
 	github.com/pkg/errors v0.8.0
+	go.uber.org/zap v1.9.1
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.2.2 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1
 )
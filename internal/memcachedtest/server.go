@@ -0,0 +1,513 @@
+// Package memcachedtest provides an in-memory memcached server which speaks the binary protocol for testing.
+package memcachedtest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	magicRequest  = 0x80
+	magicResponse = 0x81
+
+	opcodeGet       = 0x00
+	opcodeSet       = 0x01
+	opcodeAdd       = 0x02
+	opcodeReplace   = 0x03
+	opcodeDel       = 0x04
+	opcodeIncr      = 0x05
+	opcodeDecr      = 0x06
+	opcodeQuit      = 0x07
+	opcodeFlush     = 0x08
+	opcodeGetQ      = 0x09
+	opcodeNoop      = 0x0a
+	opcodeVersion   = 0x0b
+	opcodeGetK      = 0x0c
+	opcodeGetKQ     = 0x0d
+	opcodeAppend    = 0x0e
+	opcodePrepend   = 0x0f
+	opcodeStat      = 0x10
+	opcodeSetQ      = 0x11
+	opcodeAddQ      = 0x12
+	opcodeReplaceQ  = 0x13
+	opcodeDelQ      = 0x14
+	opcodeIncrQ     = 0x15
+	opcodeDecrQ     = 0x16
+	opcodeQuitQ     = 0x17
+	opcodeFlushQ    = 0x18
+	opcodeAppendQ   = 0x19
+	opcodePrependQ  = 0x1a
+	opcodeTouch     = 0x1c
+	opcodeGAT       = 0x1d
+	opcodeGATQ      = 0x1e
+	opcodeGATK      = 0x23
+	opcodeGATKQ     = 0x24
+	statusNoError   = 0x0000
+	statusNotFound  = 0x0001
+	statusExists    = 0x0002
+	statusInvalid   = 0x0004
+	statusNotStored = 0x0005
+	statusNonNumber = 0x0006
+	statusUnknown   = 0x0081
+
+	// relativeExpirationLimit is the boundary between the relative expiration and the unix time.
+	// It is client.MaxRelativeExpiration on the server side. This package can't import client because the tests of client use it.
+	relativeExpirationLimit = 60 * 60 * 24 * 30
+)
+
+type item struct {
+	value    []byte
+	flags    []byte
+	cas      uint64
+	expireAt time.Time
+}
+
+type request struct {
+	opcode byte
+	opaque uint32
+	cas    uint64
+	extra  []byte
+	key    []byte
+	value  []byte
+}
+
+// Server is the memcached server for testing.
+type Server struct {
+	// Addr is the address of the server. e.g. "127.0.0.1:11211"
+	Addr string
+	// Now returns the current time. The tests can replace it for expiring the items.
+	Now func() time.Time
+
+	listener net.Listener
+	mu       sync.Mutex
+	items    map[string]*item
+	cas      uint64
+	conns    map[net.Conn]struct{}
+	paused   bool
+	pauseCh  chan struct{}
+	requests map[byte]int
+}
+
+// NewServer starts the server on the loopback interface.
+func NewServer() (*Server, error) {
+	return Listen("tcp", "127.0.0.1:0")
+}
+
+// Listen starts the server on the address.
+func Listen(network, address string) (*Server, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Addr:     l.Addr().String(),
+		Now:      time.Now,
+		listener: l,
+		items:    make(map[string]*item),
+		conns:    make(map[net.Conn]struct{}),
+		pauseCh:  make(chan struct{}),
+		requests: make(map[byte]int),
+	}
+	if network == "unix" {
+		s.Addr = "unix://" + l.Addr().String()
+	}
+	go s.serve()
+
+	return s, nil
+}
+
+// Host returns the host and the port of the tcp server.
+func (s *Server) Host() (string, int) {
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return "", 0
+	}
+	p, _ := strconv.Atoi(port)
+
+	return host, p
+}
+
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	return err
+}
+
+// Pause stops responding to the requests until Resume is called.
+func (s *Server) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = true
+}
+
+func (s *Server) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		s.paused = false
+		close(s.pauseCh)
+		s.pauseCh = make(chan struct{})
+	}
+}
+
+// Value returns the value of key without touching the item.
+func (s *Server) Value(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	it := s.lookup(key)
+	if it == nil {
+		return nil, false
+	}
+	return it.value, true
+}
+
+// Requests returns the number of the requests which the server received with opcode.
+func (s *Server) Requests(opcode byte) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[opcode]
+}
+
+// Len returns the number of the live items.
+func (s *Server) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for k := range s.items {
+		if s.lookup(k) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	header := make([]byte, 24)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		if header[0] != magicRequest {
+			return
+		}
+		keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+		extraLength := int(header[4])
+		bodyLength := int(binary.BigEndian.Uint32(header[8:12]))
+		if keyLength+extraLength > bodyLength {
+			return
+		}
+		body := make([]byte, bodyLength)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		req := &request{
+			opcode: header[1],
+			opaque: binary.BigEndian.Uint32(header[12:16]),
+			cas:    binary.BigEndian.Uint64(header[16:24]),
+			extra:  body[:extraLength],
+			key:    body[extraLength : extraLength+keyLength],
+			value:  body[extraLength+keyLength:],
+		}
+
+		s.mu.Lock()
+		for s.paused {
+			c := s.pauseCh
+			s.mu.Unlock()
+			<-c
+			s.mu.Lock()
+		}
+		s.requests[req.opcode]++
+		quit := s.handle(w, req)
+		s.mu.Unlock()
+
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handle processes the request. s.mu must be held.
+func (s *Server) handle(w io.Writer, req *request) (quit bool) {
+	switch req.opcode {
+	case opcodeGet, opcodeGetQ, opcodeGetK, opcodeGetKQ, opcodeGAT, opcodeGATQ, opcodeGATK, opcodeGATKQ:
+		quiet := req.opcode == opcodeGetQ || req.opcode == opcodeGetKQ || req.opcode == opcodeGATQ || req.opcode == opcodeGATKQ
+		withKey := req.opcode == opcodeGetK || req.opcode == opcodeGetKQ || req.opcode == opcodeGATK || req.opcode == opcodeGATKQ
+		touch := req.opcode >= opcodeGAT
+		if touch && len(req.extra) != 4 {
+			s.respond(w, req, statusInvalid, 0, nil, nil, nil)
+			return
+		}
+
+		it := s.lookup(string(req.key))
+		if it == nil {
+			if !quiet {
+				var key []byte
+				if withKey {
+					key = req.key
+				}
+				s.respond(w, req, statusNotFound, 0, nil, key, []byte("Not found"))
+			}
+			return
+		}
+		if touch {
+			it.expireAt = s.expireAt(binary.BigEndian.Uint32(req.extra))
+		}
+		var key []byte
+		if withKey {
+			key = req.key
+		}
+		s.respond(w, req, statusNoError, it.cas, it.flags, key, it.value)
+	case opcodeSet, opcodeSetQ, opcodeAdd, opcodeAddQ, opcodeReplace, opcodeReplaceQ:
+		if len(req.extra) != 8 {
+			s.respond(w, req, statusInvalid, 0, nil, nil, nil)
+			return
+		}
+		quiet := req.opcode == opcodeSetQ || req.opcode == opcodeAddQ || req.opcode == opcodeReplaceQ
+		it := s.lookup(string(req.key))
+		switch {
+		case (req.opcode == opcodeAdd || req.opcode == opcodeAddQ) && it != nil:
+			s.respond(w, req, statusExists, 0, nil, nil, []byte("Data exists for key."))
+			return
+		case (req.opcode == opcodeReplace || req.opcode == opcodeReplaceQ) && it == nil:
+			s.respond(w, req, statusNotFound, 0, nil, nil, []byte("Not found"))
+			return
+		case req.cas != 0 && it == nil:
+			s.respond(w, req, statusNotFound, 0, nil, nil, []byte("Not found"))
+			return
+		case req.cas != 0 && it.cas != req.cas:
+			s.respond(w, req, statusExists, 0, nil, nil, []byte("Data exists for key."))
+			return
+		}
+
+		s.cas++
+		n := &item{
+			value:    append([]byte{}, req.value...),
+			flags:    append([]byte{}, req.extra[:4]...),
+			cas:      s.cas,
+			expireAt: s.expireAt(binary.BigEndian.Uint32(req.extra[4:8])),
+		}
+		s.items[string(req.key)] = n
+		if !quiet {
+			s.respond(w, req, statusNoError, n.cas, nil, nil, nil)
+		}
+	case opcodeAppend, opcodeAppendQ, opcodePrepend, opcodePrependQ:
+		quiet := req.opcode == opcodeAppendQ || req.opcode == opcodePrependQ
+		it := s.lookup(string(req.key))
+		if it == nil {
+			s.respond(w, req, statusNotStored, 0, nil, nil, []byte("Not stored."))
+			return
+		}
+		if req.cas != 0 && it.cas != req.cas {
+			s.respond(w, req, statusExists, 0, nil, nil, []byte("Data exists for key."))
+			return
+		}
+		if req.opcode == opcodeAppend || req.opcode == opcodeAppendQ {
+			it.value = append(append([]byte{}, it.value...), req.value...)
+		} else {
+			it.value = append(append([]byte{}, req.value...), it.value...)
+		}
+		s.cas++
+		it.cas = s.cas
+		if !quiet {
+			s.respond(w, req, statusNoError, it.cas, nil, nil, nil)
+		}
+	case opcodeDel, opcodeDelQ:
+		it := s.lookup(string(req.key))
+		if it == nil {
+			s.respond(w, req, statusNotFound, 0, nil, nil, []byte("Not found"))
+			return
+		}
+		if req.cas != 0 && it.cas != req.cas {
+			s.respond(w, req, statusExists, 0, nil, nil, []byte("Data exists for key."))
+			return
+		}
+		delete(s.items, string(req.key))
+		if req.opcode == opcodeDel {
+			s.respond(w, req, statusNoError, 0, nil, nil, nil)
+		}
+	case opcodeIncr, opcodeIncrQ, opcodeDecr, opcodeDecrQ:
+		if len(req.extra) != 20 {
+			s.respond(w, req, statusInvalid, 0, nil, nil, nil)
+			return
+		}
+		quiet := req.opcode == opcodeIncrQ || req.opcode == opcodeDecrQ
+		delta := binary.BigEndian.Uint64(req.extra[0:8])
+		initial := binary.BigEndian.Uint64(req.extra[8:16])
+		expiration := binary.BigEndian.Uint32(req.extra[16:20])
+
+		var v uint64
+		it := s.lookup(string(req.key))
+		if it == nil {
+			if expiration == 0xffffffff {
+				s.respond(w, req, statusNotFound, 0, nil, nil, []byte("Not found"))
+				return
+			}
+			v = initial
+			it = &item{flags: make([]byte, 4), expireAt: s.expireAt(expiration)}
+			s.items[string(req.key)] = it
+		} else {
+			if req.cas != 0 && it.cas != req.cas {
+				s.respond(w, req, statusExists, 0, nil, nil, []byte("Data exists for key."))
+				return
+			}
+			n, err := strconv.ParseUint(string(it.value), 10, 64)
+			if err != nil {
+				s.respond(w, req, statusNonNumber, 0, nil, nil, []byte("Non-numeric server-side value for incr or decr"))
+				return
+			}
+			if req.opcode == opcodeIncr || req.opcode == opcodeIncrQ {
+				v = n + delta
+			} else if delta > n {
+				v = 0
+			} else {
+				v = n - delta
+			}
+		}
+		s.cas++
+		it.cas = s.cas
+		it.value = []byte(strconv.FormatUint(v, 10))
+		if !quiet {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, v)
+			s.respond(w, req, statusNoError, it.cas, nil, nil, b)
+		}
+	case opcodeTouch:
+		if len(req.extra) != 4 {
+			s.respond(w, req, statusInvalid, 0, nil, nil, nil)
+			return
+		}
+		it := s.lookup(string(req.key))
+		if it == nil {
+			s.respond(w, req, statusNotFound, 0, nil, nil, []byte("Not found"))
+			return
+		}
+		it.expireAt = s.expireAt(binary.BigEndian.Uint32(req.extra))
+		s.respond(w, req, statusNoError, it.cas, nil, nil, nil)
+	case opcodeNoop:
+		s.respond(w, req, statusNoError, 0, nil, nil, nil)
+	case opcodeVersion:
+		s.respond(w, req, statusNoError, 0, nil, nil, []byte("1.5.12"))
+	case opcodeFlush, opcodeFlushQ:
+		s.items = make(map[string]*item)
+		if req.opcode == opcodeFlush {
+			s.respond(w, req, statusNoError, 0, nil, nil, nil)
+		}
+	case opcodeStat:
+		if len(req.key) > 0 {
+			s.respond(w, req, statusUnknown, 0, nil, nil, []byte("Unknown command"))
+			break
+		}
+		size := 0
+		for k, v := range s.items {
+			size += len(k) + len(v.value)
+		}
+		stats := [][2]string{
+			{"pid", "1"},
+			{"version", "1.5.12"},
+			{"curr_items", strconv.Itoa(len(s.items))},
+			{"bytes", strconv.Itoa(size)},
+			{"get_hits", strconv.Itoa(s.requests[opcodeGet])},
+			{"evictions", "0"},
+			{"rusage_user", "0.500000"},
+		}
+		for _, v := range stats {
+			s.respond(w, req, statusNoError, 0, nil, []byte(v[0]), []byte(v[1]))
+		}
+		s.respond(w, req, statusNoError, 0, nil, nil, nil)
+	case opcodeQuit, opcodeQuitQ:
+		if req.opcode == opcodeQuit {
+			s.respond(w, req, statusNoError, 0, nil, nil, nil)
+		}
+		return true
+	default:
+		s.respond(w, req, statusUnknown, 0, nil, nil, []byte("Unknown command"))
+	}
+
+	return false
+}
+
+// lookup returns the live item. s.mu must be held.
+func (s *Server) lookup(key string) *item {
+	it, ok := s.items[key]
+	if !ok {
+		return nil
+	}
+	if !it.expireAt.IsZero() && !s.Now().Before(it.expireAt) {
+		delete(s.items, key)
+		return nil
+	}
+
+	return it
+}
+
+func (s *Server) expireAt(expiration uint32) time.Time {
+	switch {
+	case expiration == 0:
+		return time.Time{}
+	case expiration <= relativeExpirationLimit:
+		return s.Now().Add(time.Duration(expiration) * time.Second)
+	default:
+		return time.Unix(int64(expiration), 0)
+	}
+}
+
+func (s *Server) respond(w io.Writer, req *request, status uint16, cas uint64, extra, key, value []byte) {
+	buf := make([]byte, 24+len(extra)+len(key)+len(value))
+	buf[0] = magicResponse
+	buf[1] = req.opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = byte(len(extra))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extra)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], req.opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	copy(buf[24:], extra)
+	copy(buf[24+len(extra):], key)
+	copy(buf[24+len(extra)+len(key):], value)
+
+	w.Write(buf)
+}
@@ -0,0 +1,215 @@
+// Package lock provides an advisory lock on top of memcached.
+//
+// The lock is acquired by adding the key with a random owner token as the value.
+// Add fails if the key already exists, so only one owner can create the key at a time.
+// The lock is released by deleting the key with the CAS value which is read together with the token,
+// so an owner can't release the lock which has been expired and acquired by another owner.
+//
+// The lock is NOT safe for protecting correctness. It only reduces the duplicated work.
+//   - memcached may evict the key before the TTL when it is short of memory, or lose it by restarting.
+//     Then another owner can acquire the lock while the first owner still believes that it holds it.
+//   - The owner can be paused (e.g. GC, network partition) longer than the TTL.
+//     The lock expires and another owner acquires it, and the first owner doesn't notice it until it calls Unlock or Extend.
+//   - There is no fencing token. The resource protected by the lock can't reject the requests from the stale owner.
+//   - The key may move to another server while the ring of the router is changing.
+//     The new server doesn't have the key, so the lock can be acquired twice during the migration.
+package lock
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	mathrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+var (
+	ErrNotAcquired = errors.New("lock: lock is held by another owner")
+	ErrNotHeld     = errors.New("lock: lock is not held")
+)
+
+const (
+	defaultRetryInterval    = 50 * time.Millisecond
+	defaultMaxRetryInterval = time.Second
+)
+
+var (
+	random   = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	randomMu sync.Mutex
+)
+
+type Lock struct {
+	Key []byte
+	TTL time.Duration
+	// RetryInterval is the initial interval of retrying in Lock.
+	// The interval is doubled up to MaxRetryInterval after each attempt and is jittered.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+
+	client *client.Client
+	mu     sync.Mutex
+	token  []byte
+}
+
+// New returns the lock of key. The lock expires after ttl unless it is extended.
+// ttl is rounded up to seconds because memcached can't handle sub-second expiration.
+func New(c *client.Client, key string, ttl time.Duration) *Lock {
+	return &Lock{
+		Key:              []byte(key),
+		TTL:              ttl,
+		RetryInterval:    defaultRetryInterval,
+		MaxRetryInterval: defaultMaxRetryInterval,
+		client:           c,
+	}
+}
+
+// Token returns the owner token of the current acquisition.
+// Token returns nil if the lock has not been acquired.
+func (l *Lock) Token() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.token
+}
+
+// TryLock acquires the lock without waiting.
+// TryLock returns ErrNotAcquired if the lock is held by another owner.
+func (l *Lock) TryLock() error {
+	token, err := newToken()
+	if err != nil {
+		return err
+	}
+
+	err = l.client.Add(l.Key, token, make([]byte, 4), client.Expiration(l.TTL))
+	switch err {
+	case nil:
+	case client.ErrKeyAlreadyExists, client.ErrItemNotStored:
+		return ErrNotAcquired
+	default:
+		return err
+	}
+
+	l.mu.Lock()
+	l.token = token
+	l.mu.Unlock()
+	return nil
+}
+
+// Lock acquires the lock. Lock blocks until the lock is acquired or ctx is done.
+func (l *Lock) Lock(ctx context.Context) error {
+	interval := l.RetryInterval
+	for {
+		err := l.TryLock()
+		if err != ErrNotAcquired {
+			return err
+		}
+
+		t := time.NewTimer(jitter(interval))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+
+		interval *= 2
+		if l.MaxRetryInterval > 0 && interval > l.MaxRetryInterval {
+			interval = l.MaxRetryInterval
+		}
+	}
+}
+
+// Unlock releases the lock.
+// Unlock returns ErrNotHeld if the lock has been expired or acquired by another owner.
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cas, err := l.owned()
+	if err != nil {
+		return err
+	}
+	l.token = nil
+
+	switch err := l.client.DelCAS(l.Key, cas); err {
+	case nil:
+		return nil
+	case client.ErrKeyNotFound, client.ErrKeyAlreadyExists:
+		return ErrNotHeld
+	default:
+		return err
+	}
+}
+
+// Extend resets the TTL of the lock to ttl.
+// Extend returns ErrNotHeld if the lock has been expired or acquired by another owner.
+func (l *Lock) Extend(ttl time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cas, err := l.owned()
+	if err != nil {
+		return err
+	}
+
+	// Touch can't check the owner. Rewrite the token with CAS instead.
+	switch err := l.client.Set(l.Key, l.token, cas, make([]byte, 4), client.Expiration(ttl)); err {
+	case nil:
+		return nil
+	case client.ErrKeyNotFound, client.ErrKeyAlreadyExists:
+		l.token = nil
+		return ErrNotHeld
+	default:
+		return err
+	}
+}
+
+// owned returns the CAS value of the lock if the lock is held by l. l.mu must be held.
+func (l *Lock) owned() (uint64, error) {
+	if l.token == nil {
+		return 0, ErrNotHeld
+	}
+
+	item, err := l.client.Get(l.Key)
+	switch err {
+	case nil:
+	case client.ErrKeyNotFound:
+		l.token = nil
+		return 0, ErrNotHeld
+	default:
+		return 0, err
+	}
+	if !bytes.Equal(item.Value, l.token) {
+		l.token = nil
+		return 0, ErrNotHeld
+	}
+
+	return item.CAS, nil
+}
+
+func newToken() ([]byte, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	token := make([]byte, hex.EncodedLen(len(b)))
+	hex.Encode(token, b)
+	return token, nil
+}
+
+// jitter returns the random duration in [d/2, d].
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	randomMu.Lock()
+	defer randomMu.Unlock()
+
+	return d/2 + time.Duration(random.Int63n(int64(d/2)+1))
+}
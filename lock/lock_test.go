@@ -0,0 +1,132 @@
+package lock
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func newTestClient(t *testing.T) (*client.Client, *memcachedtest.Server) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, s
+}
+
+func TestLock_TryLock(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	first := New(c, "lock", time.Minute)
+	if err := first.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	second := New(c, "lock", time.Minute)
+	if err := second.TryLock(); err != ErrNotAcquired {
+		t.Fatalf("expected ErrNotAcquired but got %v", err)
+	}
+	if err := second.Unlock(); err != ErrNotHeld {
+		t.Fatalf("expected ErrNotHeld but got %v", err)
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if first.Token() != nil {
+		t.Error("the token should be cleared")
+	}
+	if err := second.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLock_Expired(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+	now := time.Now()
+	s.Now = func() time.Time { return now }
+
+	first := New(c, "lock", 10*time.Second)
+	if err := first.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(10 * time.Second)
+
+	second := New(c, "lock", 10*time.Second)
+	if err := second.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first owner must not release the lock of the second owner.
+	if err := first.Unlock(); err != ErrNotHeld {
+		t.Fatalf("expected ErrNotHeld but got %v", err)
+	}
+	if err := first.Extend(time.Minute); err != ErrNotHeld {
+		t.Fatalf("expected ErrNotHeld but got %v", err)
+	}
+	if v, ok := s.Value("lock"); !ok || string(v) != string(second.Token()) {
+		t.Fatalf("the lock of the second owner is lost: %s", v)
+	}
+}
+
+func TestLock_Extend(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+	now := time.Now()
+	s.Now = func() time.Time { return now }
+
+	l := New(c, "lock", 10*time.Second)
+	if err := l.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(5 * time.Second)
+	if err := l.Extend(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(30 * time.Second)
+
+	if err := New(c, "lock", time.Minute).TryLock(); err != ErrNotAcquired {
+		t.Fatalf("the lock should be extended: %v", err)
+	}
+	if err := l.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLock_Lock(t *testing.T) {
+	c, s := newTestClient(t)
+	defer s.Close()
+
+	first := New(c, "lock", time.Minute)
+	if err := first.TryLock(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	second := New(c, "lock", time.Minute)
+	second.RetryInterval = 5 * time.Millisecond
+	if err := second.Lock(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded but got %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		first.Unlock()
+	}()
+	if err := second.Lock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if second.Token() == nil {
+		t.Error("expected the token")
+	}
+}
@@ -2,4 +2,4 @@ package logger
 
 import "go.uber.org/zap"
 
-var Log *zap.SugaredLogger
+var Log = zap.NewNop().Sugar()
@@ -0,0 +1,233 @@
+// Package namespace provides the invalidation of a group of keys on top of memcached.
+//
+// Each namespace has the generation counter key. The data keys are prefixed with the namespace and the current generation.
+// InvalidateNamespace increments the generation, so the old data keys are never read again and are evicted by memcached eventually.
+//
+// The generation is cached in the process for CacheTTL.
+// The other processes may read the old generation for up to CacheTTL after InvalidateNamespace.
+// If the generation key is evicted, it is created again from the current time.
+// It is larger than any previous generation, so the eviction invalidates the namespace rather than resurrecting the old data.
+package namespace
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+const (
+	defaultPrefix   = "ns:"
+	defaultCacheTTL = time.Second
+)
+
+// Client is the interface of the memcached client which Namespace uses.
+// *client.Client satisfies this interface.
+type Client interface {
+	GetMulti(keys [][]byte) (map[string]*client.Item, error)
+	GetAsync(key []byte) (<-chan *client.Item, error)
+	SetAsync(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error)
+	DelAsync(key []byte) (<-chan *client.Item, error)
+	IncrAsync(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error)
+}
+
+type generation struct {
+	value    uint64
+	expireAt time.Time
+}
+
+type Namespace struct {
+	Client Client
+	// Prefix is the prefix of the generation keys.
+	Prefix string
+	// CacheTTL is the duration which the generation is cached in the process.
+	CacheTTL time.Duration
+
+	mu          sync.Mutex
+	generations map[string]generation
+	now         func() time.Time
+}
+
+func New(c Client) *Namespace {
+	return &Namespace{
+		Client:      c,
+		Prefix:      defaultPrefix,
+		CacheTTL:    defaultCacheTTL,
+		generations: make(map[string]generation),
+		now:         time.Now,
+	}
+}
+
+// Key returns the data key of key in the namespace ns.
+func (n *Namespace) Key(ns string, key []byte) ([]byte, error) {
+	gens, err := n.Generations(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	return dataKey(ns, gens[ns], key), nil
+}
+
+// Generations returns the current generation of each namespace.
+// The generations which are not cached are looked up in one round trip.
+func (n *Namespace) Generations(namespaces ...string) (map[string]uint64, error) {
+	now := n.now()
+	result := make(map[string]uint64, len(namespaces))
+	var missing [][]byte
+	seen := make(map[string]struct{}, len(namespaces))
+
+	n.mu.Lock()
+	for _, ns := range namespaces {
+		if _, ok := seen[ns]; ok {
+			continue
+		}
+		seen[ns] = struct{}{}
+
+		if g, ok := n.generations[ns]; ok && now.Before(g.expireAt) {
+			result[ns] = g.value
+			continue
+		}
+		missing = append(missing, n.generationKey(ns))
+	}
+	n.mu.Unlock()
+	if len(missing) == 0 {
+		return result, nil
+	}
+
+	items, err := n.Client.GetMulti(missing)
+	if err != nil {
+		return nil, err
+	}
+	fetched := make(map[string]uint64, len(missing))
+	for _, key := range missing {
+		ns := string(key[len(n.Prefix):])
+		if v, ok := items[string(key)]; ok {
+			if g, err := strconv.ParseUint(string(v.Value), 10, 64); err == nil {
+				fetched[ns] = g
+				continue
+			}
+		}
+
+		// The generation doesn't exist. Create it without overwriting the one which is created concurrently.
+		g, err := n.incr(ns, 0)
+		if err != nil {
+			return nil, err
+		}
+		fetched[ns] = g
+	}
+
+	n.mu.Lock()
+	for ns, g := range fetched {
+		n.generations[ns] = generation{value: g, expireAt: now.Add(n.CacheTTL)}
+		result[ns] = g
+	}
+	n.mu.Unlock()
+
+	return result, nil
+}
+
+// InvalidateNamespace invalidates all keys in the namespace ns.
+func (n *Namespace) InvalidateNamespace(ns string) error {
+	g, err := n.incr(ns, 1)
+	if err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	n.generations[ns] = generation{value: g, expireAt: n.now().Add(n.CacheTTL)}
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *Namespace) Get(ns string, key []byte) (*client.Item, error) {
+	k, err := n.Key(ns, key)
+	if err != nil {
+		return nil, err
+	}
+	res, err := n.Client.GetAsync(k)
+	if err != nil {
+		return nil, err
+	}
+
+	v := <-res
+	if v.Err != nil {
+		return nil, v.Err
+	}
+	return v, nil
+}
+
+// GetMulti gets the items of keys in the namespace ns. The returned map is keyed by the key without the namespace.
+func (n *Namespace) GetMulti(ns string, keys [][]byte) (map[string]*client.Item, error) {
+	gens, err := n.Generations(ns)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		dataKeys[i] = dataKey(ns, gens[ns], key)
+	}
+	items, err := n.Client.GetMulti(dataKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*client.Item, len(items))
+	for i, key := range keys {
+		if v, ok := items[string(dataKeys[i])]; ok {
+			result[string(key)] = v
+		}
+	}
+	return result, nil
+}
+
+func (n *Namespace) Set(ns string, key, value []byte, flag []byte, expiration int) error {
+	k, err := n.Key(ns, key)
+	if err != nil {
+		return err
+	}
+	res, err := n.Client.SetAsync(k, value, 0, flag, expiration)
+	if err != nil {
+		return err
+	}
+
+	return (<-res).Err
+}
+
+func (n *Namespace) Del(ns string, key []byte) error {
+	k, err := n.Key(ns, key)
+	if err != nil {
+		return err
+	}
+	res, err := n.Client.DelAsync(k)
+	if err != nil {
+		return err
+	}
+
+	return (<-res).Err
+}
+
+// incr increments the generation of ns by delta.
+// If the generation doesn't exist, it is created from the current time.
+func (n *Namespace) incr(ns string, delta int64) (uint64, error) {
+	res, err := n.Client.IncrAsync(n.generationKey(ns), delta, n.now().UnixNano(), 0)
+	if err != nil {
+		return 0, err
+	}
+
+	return (<-res).Counter()
+}
+
+func (n *Namespace) generationKey(ns string) []byte {
+	return []byte(n.Prefix + ns)
+}
+
+func dataKey(ns string, gen uint64, key []byte) []byte {
+	b := make([]byte, 0, len(ns)+len(key)+22)
+	b = append(b, ns...)
+	b = append(b, ':')
+	b = strconv.AppendUint(b, gen, 10)
+	b = append(b, ':')
+	return append(b, key...)
+}
@@ -0,0 +1,147 @@
+package namespace
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func newTestClient(t *testing.T) (*client.Client, *memcachedtest.Server) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	c, err := client.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, s
+}
+
+func TestNamespace_InvalidateNamespace(t *testing.T) {
+	c, _ := newTestClient(t)
+	n := New(c)
+
+	if err := n.Set("user:123", []byte("profile"), []byte("foo"), make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Set("user:456", []byte("profile"), []byte("bar"), make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	v, err := n.Get("user:123", []byte("profile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Value) != "foo" {
+		t.Fatalf("unexpected value: %s", v.Value)
+	}
+
+	if err := n.InvalidateNamespace("user:123"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := n.Get("user:123", []byte("profile")); err != client.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound but got %v", err)
+	}
+	if _, err := n.Get("user:456", []byte("profile")); err != nil {
+		t.Fatalf("the other namespace should not be invalidated: %v", err)
+	}
+}
+
+func TestNamespace_CacheTTL(t *testing.T) {
+	c, _ := newTestClient(t)
+	now := time.Unix(1500000000, 0)
+	writer := New(c)
+	writer.now = func() time.Time { return now }
+	reader := New(c)
+	reader.now = func() time.Time { return now }
+
+	if err := writer.Set("user:123", []byte("profile"), []byte("foo"), make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.Get("user:123", []byte("profile")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writer.InvalidateNamespace("user:123"); err != nil {
+		t.Fatal(err)
+	}
+	// The reader still has the old generation
+	if _, err := reader.Get("user:123", []byte("profile")); err != nil {
+		t.Fatalf("expected the cached generation is used: %v", err)
+	}
+
+	now = now.Add(reader.CacheTTL)
+	if _, err := reader.Get("user:123", []byte("profile")); err != client.ErrKeyNotFound {
+		t.Fatalf("expected ErrKeyNotFound but got %v", err)
+	}
+}
+
+func TestNamespace_Generations(t *testing.T) {
+	c, s := newTestClient(t)
+	n := New(c)
+
+	gens, err := n.Generations("a", "b", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 {
+		t.Fatalf("expected 2 generations but got %d", len(gens))
+	}
+	if s.Requests(client.OpcodeGetKQ) != 2 {
+		t.Errorf("expected the generations are looked up once: %d", s.Requests(client.OpcodeGetKQ))
+	}
+
+	if _, err := n.Generations("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Requests(client.OpcodeGetKQ) != 2 {
+		t.Errorf("expected the cached generations are used: %d", s.Requests(client.OpcodeGetKQ))
+	}
+}
+
+func TestNamespace_GetMulti(t *testing.T) {
+	c, _ := newTestClient(t)
+	n := New(c)
+
+	for _, k := range []string{"a", "b"} {
+		if err := n.Set("ns", []byte(k), []byte("value-"+k), make([]byte, 4), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	items, err := n.GetMulti("ns", [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items["a"].Value) != "value-a" || string(items["b"].Value) != "value-b" {
+		t.Fatalf("unexpected items: %v", items)
+	}
+}
+
+func TestNamespace_EvictedGeneration(t *testing.T) {
+	c, _ := newTestClient(t)
+	now := time.Unix(1500000000, 0)
+	n := New(c)
+	n.now = func() time.Time { return now }
+
+	before, err := n.Generations("ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Del([]byte(n.Prefix + "ns")); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(n.CacheTTL)
+	after, err := n.Generations("ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after["ns"] <= before["ns"] {
+		t.Errorf("the new generation must be larger than the previous one: %d <= %d", after["ns"], before["ns"])
+	}
+}
@@ -0,0 +1,159 @@
+// Package ratelimit provides rate limiters on the counters of memcached.
+//
+// The counter of each window is a separate key "<prefix>:<key>:<window index>".
+// The counter is created by incr with the initial value, so the limiter doesn't need the extra add.
+// The counter is expired after two windows because the sliding window limiter reads the previous window.
+//
+// The limiters work through the router during the migration of the servers.
+// The router copies the counter to the new server while the new server is write-only.
+// Keep the write-only phase at least one window long,
+// otherwise the counter of the current window restarts from zero on the new server.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+var (
+	ErrInvalidWindow = errors.New("ratelimit: window must be at least one second")
+)
+
+// Counter is the interface of the memcached client which the limiters use.
+// *client.Client satisfies this interface.
+type Counter interface {
+	IncrAsync(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error)
+}
+
+// FixedWindow allows Limit requests in each window. The window starts at the multiple of Window.
+// The denied requests are counted too.
+type FixedWindow struct {
+	Client Counter
+	Prefix string
+	Limit  int64
+	Window time.Duration
+
+	now func() time.Time
+}
+
+func NewFixedWindow(c Counter, prefix string, limit int64, window time.Duration) (*FixedWindow, error) {
+	if window < time.Second {
+		return nil, ErrInvalidWindow
+	}
+
+	return &FixedWindow{Client: c, Prefix: prefix, Limit: limit, Window: window, now: time.Now}, nil
+}
+
+// Allow counts the request of key and reports whether the request is allowed.
+// remaining is the number of the requests which are still allowed in the current window.
+// resetAt is the time when the current window ends.
+func (l *FixedWindow) Allow(ctx context.Context, key string) (allowed bool, remaining int64, resetAt time.Time, err error) {
+	now := l.now()
+	index := now.UnixNano() / int64(l.Window)
+	resetAt = time.Unix(0, (index+1)*int64(l.Window))
+
+	res, err := l.Client.IncrAsync(bucketKey(l.Prefix, key, index), 1, 1, expiration(l.Window, now))
+	if err != nil {
+		return false, 0, resetAt, err
+	}
+	count, err := wait(ctx, res)
+	if err != nil {
+		return false, 0, resetAt, err
+	}
+
+	remaining = l.Limit - int64(count)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return int64(count) <= l.Limit, remaining, resetAt, nil
+}
+
+// SlidingWindow approximates the number of the requests in the last Window from two buckets.
+// The count of the previous window is weighted by the part of the previous window which overlaps the sliding window.
+// The denied requests are counted too.
+type SlidingWindow struct {
+	Client Counter
+	Prefix string
+	Limit  int64
+	Window time.Duration
+
+	now func() time.Time
+}
+
+func NewSlidingWindow(c Counter, prefix string, limit int64, window time.Duration) (*SlidingWindow, error) {
+	if window < time.Second {
+		return nil, ErrInvalidWindow
+	}
+
+	return &SlidingWindow{Client: c, Prefix: prefix, Limit: limit, Window: window, now: time.Now}, nil
+}
+
+// Allow counts the request of key and reports whether the request is allowed.
+// remaining is the number of the requests which are still allowed at this moment.
+// resetAt is the time when the current bucket ends. After resetAt, the estimated count starts to decrease.
+func (l *SlidingWindow) Allow(ctx context.Context, key string) (allowed bool, remaining int64, resetAt time.Time, err error) {
+	now := l.now()
+	index := now.UnixNano() / int64(l.Window)
+	start := index * int64(l.Window)
+	resetAt = time.Unix(0, start+int64(l.Window))
+
+	cur, err := l.Client.IncrAsync(bucketKey(l.Prefix, key, index), 1, 1, expiration(l.Window, now))
+	if err != nil {
+		return false, 0, resetAt, err
+	}
+	// Read the previous bucket by adding zero. The bucket is not created if it doesn't exist.
+	prev, err := l.Client.IncrAsync(bucketKey(l.Prefix, key, index-1), 0, 0, client.ExpirationNoCreate)
+	if err != nil {
+		return false, 0, resetAt, err
+	}
+
+	current, err := wait(ctx, cur)
+	if err != nil {
+		return false, 0, resetAt, err
+	}
+	previous, err := wait(ctx, prev)
+	switch err {
+	case nil:
+	case client.ErrKeyNotFound:
+		previous = 0
+	default:
+		return false, 0, resetAt, err
+	}
+
+	weight := 1 - float64(now.UnixNano()-start)/float64(l.Window)
+	count := float64(previous)*weight + float64(current)
+
+	remaining = int64(math.Floor(float64(l.Limit) - count))
+	if remaining < 0 {
+		remaining = 0
+	}
+	return count <= float64(l.Limit), remaining, resetAt, nil
+}
+
+func wait(ctx context.Context, res <-chan *client.Item) (uint64, error) {
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case v := <-res:
+		return v.Counter()
+	}
+}
+
+func bucketKey(prefix, key string, index int64) []byte {
+	b := make([]byte, 0, len(prefix)+len(key)+22)
+	b = append(b, prefix...)
+	b = append(b, ':')
+	b = append(b, key...)
+	b = append(b, ':')
+	return strconv.AppendInt(b, index, 10)
+}
+
+// expiration returns the expiration of the bucket. The bucket lives for two windows.
+func expiration(window time.Duration, now time.Time) int {
+	return client.ExpirationAt(2*window, now)
+}
@@ -0,0 +1,156 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func newTestClient(t *testing.T) (*client.Client, *memcachedtest.Server, *time.Time) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := client.Dial(s.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	s.Now = func() time.Time { return now }
+
+	return c, s, &now
+}
+
+func TestFixedWindow_Allow(t *testing.T) {
+	c, s, now := newTestClient(t)
+	defer s.Close()
+
+	l, err := NewFixedWindow(c, "rl", 3, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return *now }
+
+	for i := 0; i < 3; i++ {
+		allowed, remaining, resetAt, err := l.Allow(context.Background(), "user1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+		if remaining != int64(2-i) {
+			t.Errorf("expected remaining %d but got %d", 2-i, remaining)
+		}
+		if !resetAt.Equal(time.Unix(1500000010, 0)) {
+			t.Errorf("unexpected reset time: %v", resetAt)
+		}
+	}
+	allowed, remaining, _, err := l.Allow(context.Background(), "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed || remaining != 0 {
+		t.Fatalf("expected denied but allowed=%v remaining=%d", allowed, remaining)
+	}
+
+	// The other key has the own counter
+	if allowed, _, _, _ := l.Allow(context.Background(), "user2"); !allowed {
+		t.Fatal("the other key should be allowed")
+	}
+
+	*now = now.Add(10 * time.Second)
+	if allowed, _, _, _ := l.Allow(context.Background(), "user1"); !allowed {
+		t.Fatal("the request in the next window should be allowed")
+	}
+}
+
+func TestFixedWindow_LongWindow(t *testing.T) {
+	c, s, now := newTestClient(t)
+	defer s.Close()
+
+	// The expiration of two windows is longer than 30 days, so it must be the unix time.
+	l, err := NewFixedWindow(c, "rl", 1, 20*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return *now }
+
+	if allowed, _, _, err := l.Allow(context.Background(), "user1"); err != nil || !allowed {
+		t.Fatalf("the first request should be allowed: %v", err)
+	}
+	*now = now.Add(time.Hour)
+	if allowed, _, _, err := l.Allow(context.Background(), "user1"); err != nil || allowed {
+		t.Fatalf("the second request should be denied: %v", err)
+	}
+}
+
+func TestSlidingWindow_Allow(t *testing.T) {
+	c, s, now := newTestClient(t)
+	defer s.Close()
+
+	l, err := NewSlidingWindow(c, "rl", 10, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return *now }
+
+	for i := 0; i < 10; i++ {
+		if allowed, _, _, err := l.Allow(context.Background(), "user1"); err != nil || !allowed {
+			t.Fatalf("request %d should be allowed: %v", i, err)
+		}
+	}
+
+	// 30% of the sliding window overlaps the previous window. The estimated count is 10*0.7+1.
+	*now = now.Add(13 * time.Second)
+	allowed, remaining, resetAt, err := l.Allow(context.Background(), "user1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed || remaining != 2 {
+		t.Fatalf("expected allowed with remaining 2 but allowed=%v remaining=%d", allowed, remaining)
+	}
+	if !resetAt.Equal(time.Unix(1500000020, 0)) {
+		t.Errorf("unexpected reset time: %v", resetAt)
+	}
+	for i := 0; i < 2; i++ {
+		if allowed, _, _, _ := l.Allow(context.Background(), "user1"); !allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if allowed, _, _, _ := l.Allow(context.Background(), "user1"); allowed {
+		t.Fatal("expected denied")
+	}
+
+	// The previous bucket must not be created by reading it
+	if _, ok := s.Value(string(bucketKey("rl", "user2", 150000000))); ok {
+		t.Fatal("unexpected bucket")
+	}
+	if allowed, _, _, _ := l.Allow(context.Background(), "user2"); !allowed {
+		t.Fatal("the other key should be allowed")
+	}
+	if _, ok := s.Value(string(bucketKey("rl", "user2", 150000000))); ok {
+		t.Fatal("the previous bucket should not be created")
+	}
+}
+
+func TestAllow_NonNumeric(t *testing.T) {
+	c, s, now := newTestClient(t)
+	defer s.Close()
+
+	l, err := NewFixedWindow(c, "rl", 3, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.now = func() time.Time { return *now }
+	if err := c.Set(bucketKey("rl", "user1", 150000000), []byte("foo"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, err := l.Allow(context.Background(), "user1"); err != client.ErrNonNumericValue {
+		t.Fatalf("expected ErrNonNumericValue but got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package router
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+
+	"github.com/f110/memcached-operator/logger"
+)
+
+// NewAdminHandler returns the handler of the admin API.
+//
+//	GET /health      the health of each server which is checked by h
+//	GET /debug/vars  the metrics
+func NewAdminHandler(h *HealthChecker) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		servers := []ServerHealth{}
+		if h != nil {
+			servers = h.Status()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Servers []ServerHealth `json:"servers"`
+		}{Servers: servers}); err != nil {
+			logger.Log.Info(err)
+		}
+	})
+
+	return mux
+}
@@ -0,0 +1,306 @@
+package router
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/logger"
+)
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerOpen
+	BreakerHalfOpen
+)
+
+type BreakerState int
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// ReadAction is the behavior of reads while the breaker is open.
+const (
+	ReadFail ReadAction = iota
+	ReadMiss
+)
+
+type ReadAction int
+
+// WriteAction is the behavior of writes while the breaker is open.
+const (
+	WriteFail WriteAction = iota
+	WriteSkip
+)
+
+type WriteAction int
+
+type BreakerConfig struct {
+	// ConsecutiveFailures is the number of consecutive failures which trips the breaker.
+	// Zero disables this condition.
+	ConsecutiveFailures int
+	// ErrorRate is the ratio of failures in Window which trips the breaker.
+	// Zero disables this condition.
+	ErrorRate float64
+	// MinRequests is the minimum number of requests in Window before ErrorRate is evaluated.
+	MinRequests int
+	Window      time.Duration
+	// OpenTimeout is the duration the breaker stays open before it allows probe requests.
+	OpenTimeout time.Duration
+	// HalfOpenProbes is the number of successful probes which closes the breaker.
+	HalfOpenProbes int
+	// Timeout is the duration after which an outstanding request is treated as a failure.
+	// Zero disables the timeout.
+	Timeout time.Duration
+	Read    ReadAction
+	Write   WriteAction
+}
+
+// Breaker is a circuit breaker for a single backend server.
+// The zero value is not usable. Use NewBreaker instead.
+type Breaker struct {
+	Name   string
+	Config BreakerConfig
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	probes      int
+	successes   int
+
+	now func() time.Time
+}
+
+func NewBreaker(name string, conf BreakerConfig) *Breaker {
+	if conf.HalfOpenProbes < 1 {
+		conf.HalfOpenProbes = 1
+	}
+	return &Breaker{Name: name, Config: conf, now: time.Now}
+}
+
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// Allow reports whether the request can be sent to the server.
+// The caller must call Done with the result of the request if Allow returns true.
+func (b *Breaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.Config.OpenTimeout {
+			return false
+		}
+		b.transit(BreakerHalfOpen)
+		b.probes++
+		return true
+	case BreakerHalfOpen:
+		if b.probes >= b.Config.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+		return true
+	}
+
+	return true
+}
+
+// rejecting reports whether Allow rejects the request now. It doesn't change the state.
+func (b *Breaker) rejecting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		return b.now().Sub(b.openedAt) < b.Config.OpenTimeout
+	case BreakerHalfOpen:
+		return b.probes >= b.Config.HalfOpenProbes
+	}
+
+	return false
+}
+
+// Done records the result of the request which is allowed by Allow.
+func (b *Breaker) Done(success bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		b.probes--
+		if !success {
+			b.transit(BreakerOpen)
+			return
+		}
+		b.successes++
+		if b.successes >= b.Config.HalfOpenProbes {
+			b.transit(BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		// The result of the request which is sent before the breaker opened
+		return
+	}
+
+	now := b.now()
+	if b.Config.Window > 0 && now.Sub(b.windowStart) >= b.Config.Window {
+		b.windowStart = now
+		b.requests = 0
+		b.failures = 0
+	}
+	b.requests++
+	if success {
+		b.consecutive = 0
+		return
+	}
+	b.failures++
+	b.consecutive++
+
+	if b.Config.ConsecutiveFailures > 0 && b.consecutive >= b.Config.ConsecutiveFailures {
+		b.transit(BreakerOpen)
+		return
+	}
+	if b.Config.ErrorRate > 0 && b.requests >= b.Config.MinRequests &&
+		float64(b.failures)/float64(b.requests) >= b.Config.ErrorRate {
+		b.transit(BreakerOpen)
+	}
+}
+
+// transit changes the state of the breaker. b.mu must be held.
+func (b *Breaker) transit(to BreakerState) {
+	from := b.state
+	if from == to {
+		return
+	}
+	b.state = to
+
+	switch to {
+	case BreakerOpen:
+		b.openedAt = b.now()
+		b.probes = 0
+		b.successes = 0
+	case BreakerHalfOpen:
+		b.probes = 0
+		b.successes = 0
+	case BreakerClosed:
+		b.consecutive = 0
+		b.windowStart = b.now()
+		b.requests = 0
+		b.failures = 0
+	}
+
+	logger.Log.Infow("circuit breaker state changed", "server", b.Name, "from", from.String(), "to", to.String())
+	breakerTransitions.Add(b.Name+"_"+to.String(), 1)
+	b.setGauge()
+}
+
+// publish sets the gauge to the current state.
+// The gauge is shared by the breakers of the same name, so the breaker publishes it when it starts serving the requests.
+// The breaker which is built but doesn't serve (e.g. by the failed reload) doesn't overwrite the gauge.
+func (b *Breaker) publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.setGauge()
+}
+
+// setGauge sets the gauge to the current state. b.mu must be held.
+func (b *Breaker) setGauge() {
+	v, ok := breakerState.Get(b.Name).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		breakerState.Set(b.Name, v)
+	}
+	v.Set(int64(b.state))
+}
+
+const (
+	opRead opKind = iota
+	opWrite
+	// opCounter is incr and decr. They can't be skipped because the response has to contain the value.
+	opCounter
+)
+
+type opKind int
+
+// rejected returns the response to the request which is not allowed by the breaker.
+func (b *Breaker) rejected(kind opKind) *client.Item {
+	breakerRejected.Add(b.Name, 1)
+
+	if kind == opWrite && b.Config.Write == WriteSkip {
+		return &client.Item{Status: client.StatusNoError}
+	}
+	if kind == opRead && b.Config.Read == ReadMiss {
+		return &client.Item{Status: client.StatusKeyNotFound, Err: client.ErrKeyNotFound}
+	}
+
+	return &client.Item{Status: client.StatusTemporaryFailure, Err: client.ErrTemporaryFailure}
+}
+
+// call sends the request through the breaker.
+// kind is used for choosing the response if the breaker is open.
+func (b *Breaker) call(kind opKind, f func() (<-chan *client.Item, error)) (<-chan *client.Item, error) {
+	if !b.Allow() {
+		c := make(chan *client.Item, 1)
+		c <- b.rejected(kind)
+		return c, nil
+	}
+
+	res, err := f()
+	if err != nil {
+		b.Done(false)
+		return nil, err
+	}
+
+	c := make(chan *client.Item, 1)
+	go func() {
+		var timeout <-chan time.Time
+		if b.Config.Timeout > 0 {
+			t := time.NewTimer(b.Config.Timeout)
+			defer t.Stop()
+			timeout = t.C
+		}
+
+		select {
+		case v := <-res:
+			b.Done(!isServerFailure(v))
+			c <- v
+		case <-timeout:
+			b.Done(false)
+			c <- &client.Item{Status: client.StatusTemporaryFailure, Err: client.ErrTemporaryFailure}
+		}
+	}()
+
+	return c, nil
+}
+
+// isServerFailure reports whether the response indicates that the server is unhealthy.
+// The errors caused by the request itself (e.g. key not found) are not failures.
+func isServerFailure(v *client.Item) bool {
+	switch v.Status {
+	case client.StatusOutOfMemory, client.StatusInternalError, client.StatusBusy, client.StatusTemporaryFailure:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,174 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestBreaker(conf BreakerConfig) (*Breaker, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1500000000, 0)}
+	b := NewBreaker("test", conf)
+	b.now = clock.Now
+	b.windowStart = clock.Now()
+
+	return b, clock
+}
+
+func TestBreaker_ConsecutiveFailures(t *testing.T) {
+	b, clock := newTestBreaker(BreakerConfig{ConsecutiveFailures: 3, OpenTimeout: 5 * time.Second})
+
+	for i := 0; i < 2; i++ {
+		if !b.Allow() {
+			t.Fatal("expected the request is allowed")
+		}
+		b.Done(false)
+	}
+	b.Allow()
+	b.Done(true)
+	if b.State() != BreakerClosed {
+		t.Fatalf("success should reset the consecutive failures: %s", b.State())
+	}
+
+	for i := 0; i < 3; i++ {
+		b.Allow()
+		b.Done(false)
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open but %s", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("expected the request is rejected")
+	}
+
+	clock.Advance(5 * time.Second)
+	if !b.Allow() {
+		t.Fatal("expected the probe is allowed")
+	}
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open but %s", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("expected only one probe is allowed")
+	}
+	b.Done(true)
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected closed but %s", b.State())
+	}
+}
+
+func TestBreaker_HalfOpenFailure(t *testing.T) {
+	b, clock := newTestBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Second, HalfOpenProbes: 2})
+
+	b.Allow()
+	b.Done(false)
+	clock.Advance(time.Second)
+
+	if !b.Allow() || !b.Allow() {
+		t.Fatal("expected two probes are allowed")
+	}
+	b.Done(true)
+	if b.State() != BreakerHalfOpen {
+		t.Fatalf("expected half-open but %s", b.State())
+	}
+	b.Done(false)
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open but %s", b.State())
+	}
+	if b.Allow() {
+		t.Fatal("expected the request is rejected")
+	}
+}
+
+func TestBreaker_ErrorRate(t *testing.T) {
+	b, clock := newTestBreaker(BreakerConfig{ErrorRate: 0.5, MinRequests: 4, Window: 10 * time.Second})
+
+	b.Allow()
+	b.Done(false)
+	b.Allow()
+	b.Done(false)
+	if b.State() != BreakerClosed {
+		t.Fatalf("should not be evaluated before MinRequests: %s", b.State())
+	}
+
+	// The new window
+	clock.Advance(10 * time.Second)
+	results := []bool{true, false, true, true, false}
+	for _, v := range results {
+		b.Allow()
+		b.Done(v)
+	}
+	if b.State() != BreakerClosed {
+		t.Fatalf("expected closed but %s", b.State())
+	}
+	b.Allow()
+	b.Done(false)
+	if b.State() != BreakerOpen {
+		t.Fatalf("expected open but %s", b.State())
+	}
+}
+
+func TestBreaker_Rejected(t *testing.T) {
+	cases := []struct {
+		Read   ReadAction
+		Write  WriteAction
+		Kind   opKind
+		Status uint16
+	}{
+		{Kind: opRead, Status: client.StatusTemporaryFailure},
+		{Kind: opWrite, Status: client.StatusTemporaryFailure},
+		{Read: ReadMiss, Kind: opRead, Status: client.StatusKeyNotFound},
+		{Read: ReadMiss, Kind: opWrite, Status: client.StatusTemporaryFailure},
+		{Write: WriteSkip, Kind: opWrite, Status: client.StatusNoError},
+		{Write: WriteSkip, Kind: opRead, Status: client.StatusTemporaryFailure},
+		{Write: WriteSkip, Kind: opCounter, Status: client.StatusTemporaryFailure},
+	}
+
+	for _, c := range cases {
+		b, _ := newTestBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Minute, Read: c.Read, Write: c.Write})
+		b.Allow()
+		b.Done(false)
+
+		res, err := b.call(c.Kind, func() (<-chan *client.Item, error) {
+			t.Fatal("the request should not be sent")
+			return nil, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := <-res; v.Status != c.Status {
+			t.Errorf("expected status %d but got %d", c.Status, v.Status)
+		}
+	}
+}
+
+func TestBreaker_Timeout(t *testing.T) {
+	b, _ := newTestBreaker(BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Minute, Timeout: 10 * time.Millisecond})
+
+	res, err := b.call(opRead, func() (<-chan *client.Item, error) {
+		return make(chan *client.Item), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := <-res
+	if v.Err != client.ErrTemporaryFailure {
+		t.Errorf("expected temporary failure but got %v", v.Err)
+	}
+	if b.State() != BreakerOpen {
+		t.Errorf("the timeout should be counted as the failure: %s", b.State())
+	}
+}
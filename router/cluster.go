@@ -1,9 +1,71 @@
 package router
 
-import "github.com/f110/memcached-operator/client"
+import (
+	"errors"
+	"sync"
 
+	"github.com/f110/memcached-operator/client"
+)
+
+var ErrUnknownWriteAck = errors.New("router: unknown write ack")
+
+const (
+	// WriteAckAll succeeds if all replicas accepted the write.
+	WriteAckAll WriteAck = iota
+	// WriteAckAny succeeds if any replica accepted the write.
+	WriteAckAny
+	// WriteAckPrimary returns the response of the owner without waiting for the replicas.
+	WriteAckPrimary
+)
+
+// WriteAck is the acknowledgement of the writes to the replicas.
+type WriteAck int
+
+func ParseWriteAck(s string) (WriteAck, error) {
+	switch s {
+	case "", "all":
+		return WriteAckAll, nil
+	case "any":
+		return WriteAckAny, nil
+	case "primary":
+		return WriteAckPrimary, nil
+	default:
+		return 0, ErrUnknownWriteAck
+	}
+}
+
+func (w WriteAck) String() string {
+	switch w {
+	case WriteAckAll:
+		return "all"
+	case WriteAckAny:
+		return "any"
+	case WriteAckPrimary:
+		return "primary"
+	default:
+		return "unknown"
+	}
+}
+
+// Cluster routes the requests to the servers of Ring.
+//
+// If Replicas is larger than one, the writes go to the owner and the next distinct servers of the ring,
+// and the reads fall back to the replicas in order when the owner misses or fails.
+// During the read-write phase of the migration, the reads fall back to the old owner before the replicas.
+// The replicas are not consistent. A failed write or eviction leaves the stale value on some replicas,
+// and the counters of the replicas are incremented independently.
+//
+// If Gutter is set, the requests of the keys whose owner is down go to Gutter instead of the ring.
 type Cluster struct {
 	Ring *Ring
+	// Replicas is the number of the servers which have each key including the owner. Zero or one disables the replication.
+	Replicas int
+	// WriteAck is the acknowledgement of the writes when Replicas is larger than one.
+	WriteAck WriteAck
+	// Repair writes the value back to the authoritative server when the read hits on the fallback server. nil disables it.
+	Repair *ReadRepair
+	// Gutter serves the keys whose owner is down. nil disables it.
+	Gutter *Gutter
 }
 
 func NewCluster(servers []*Memcached) *Cluster {
@@ -16,29 +78,462 @@ func NewCluster(servers []*Memcached) *Cluster {
 }
 
 func (c *Cluster) Get(key []byte) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Get(key)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Get(key)
+	}
+	if c.Replicas <= 1 {
+		if s := c.Ring.Pick(key); s.oldOwner() == nil {
+			return s.Get(key)
+		}
+	}
+
+	servers, hasOldOwner := c.readServers(key)
+	res, err := servers[0].get(key)
+	if len(servers) == 1 {
+		return res, err
+	}
+
+	result := make(chan *client.Item, 1)
+	go func() {
+		// The first failure is returned if all servers fail. The miss of the owner takes precedence.
+		var failure *client.Item
+		ownerMissed := false
+		if err == nil {
+			v := <-res
+			if v.Err == nil {
+				result <- v
+				return
+			}
+			failure = v
+			ownerMissed = v.Err == client.ErrKeyNotFound
+		}
+		for i, s := range servers[1:] {
+			r, err := s.get(key)
+			if err != nil {
+				continue
+			}
+			v := <-r
+			if v.Err == nil {
+				result <- v
+				c.fallbackHit(servers[0], i == 0 && hasOldOwner, ownerMissed, key, v)
+				return
+			}
+			if failure == nil {
+				failure = v
+			}
+		}
+		if failure == nil {
+			failure = &client.Item{Key: key, Status: client.StatusInternalError, Err: err}
+		}
+		result <- failure
+	}()
+
+	return result, nil
+}
+
+// routes returns the routing entries of the owner and the replicas of key.
+func (c *Cluster) routes(key []byte) []*Memcached {
+	if c.Replicas <= 1 {
+		return []*Memcached{c.Ring.Pick(key)}
+	}
+
+	return c.Ring.PickN(key, c.Replicas)
+}
+
+// readServers returns the servers which are read in order until the key is found. The first server is authoritative.
+// During the read-write phase of the migration, the old owner follows it. The replicas follow them.
+func (c *Cluster) readServers(key []byte) (servers []*Memcached, hasOldOwner bool) {
+	routes := c.routes(key)
+
+	servers = make([]*Memcached, 0, len(routes)+1)
+	servers = append(servers, routes[0].ReadServer())
+	if old := routes[0].oldOwner(); old != nil {
+		servers = append(servers, old)
+		hasOldOwner = true
+	}
+	for _, v := range routes[1:] {
+		servers = append(servers, v.ReadServer())
+	}
+
+	return servers, hasOldOwner
+}
+
+// fallbackHit counts the hit on the fallback server and repairs the authoritative server if it missed the key.
+func (c *Cluster) fallbackHit(authoritative *Memcached, oldOwner, ownerMissed bool, key []byte, v *client.Item) {
+	if oldOwner {
+		readFallbacks.Add("old_owner", 1)
+	} else {
+		readFallbacks.Add("replica", 1)
+	}
+
+	if c.Repair != nil && ownerMissed {
+		c.Repair.repair(authoritative, key, v)
+	}
+}
+
+// GetMulti gets keys from each server in parallel.
+// The keys are grouped by the server which serves the reads, so each server receives one batch.
+// The returned map doesn't have the keys which are not found.
+// If some servers fail, GetMulti returns the items from the other servers with the first error.
+//
+// The keys which are not found are read from the old owner of the migration and the replicas in the same way as Get.
+// The error is the first error of the last server which is read.
+func (c *Cluster) GetMulti(keys [][]byte) (map[string]*client.Item, error) {
+	items := make(map[string]*client.Item, len(keys))
+	var gutterErr error
+	if c.Gutter != nil {
+		gutter := make(map[string]*Memcached)
+		owned := make([][]byte, 0, len(keys))
+		for _, key := range keys {
+			if g := c.gutterRoute(key); g != nil {
+				gutter[string(key)] = g.ReadServer()
+			} else {
+				owned = append(owned, key)
+			}
+		}
+		if len(gutter) > 0 {
+			targets := make([][]byte, 0, len(gutter))
+			for _, key := range keys {
+				if _, ok := gutter[string(key)]; ok {
+					targets = append(targets, key)
+				}
+			}
+			_, gutterErr = getMulti(items, targets, func(key []byte) *Memcached {
+				return gutter[string(key)]
+			})
+		}
+		keys = owned
+	}
+
+	servers := make(map[string][]*Memcached, len(keys))
+	oldOwners := make(map[string]bool)
+	depth := 0
+	for _, key := range keys {
+		s, hasOldOwner := c.readServers(key)
+		servers[string(key)] = s
+		oldOwners[string(key)] = hasOldOwner
+		if len(s) > depth {
+			depth = len(s)
+		}
+	}
+
+	// missed is the keys which the authoritative server doesn't have.
+	var missed map[string]struct{}
+	var err error
+	for i := 0; i < depth; i++ {
+		var targets [][]byte
+		for _, key := range keys {
+			if _, ok := items[string(key)]; !ok && len(servers[string(key)]) > i {
+				targets = append(targets, key)
+			}
+		}
+		if len(targets) == 0 {
+			break
+		}
+
+		var failed map[string]struct{}
+		failed, err = getMulti(items, targets, func(key []byte) *Memcached {
+			return servers[string(key)][i]
+		})
+		if i == 0 {
+			missed = make(map[string]struct{})
+			for _, key := range targets {
+				if _, ok := failed[string(key)]; !ok {
+					if _, ok := items[string(key)]; !ok {
+						missed[string(key)] = struct{}{}
+					}
+				}
+			}
+			continue
+		}
+
+		for _, key := range targets {
+			v, ok := items[string(key)]
+			if !ok {
+				continue
+			}
+			_, ownerMissed := missed[string(key)]
+			c.fallbackHit(servers[string(key)][0], i == 1 && oldOwners[string(key)], ownerMissed, key, v)
+		}
+	}
+
+	if err == nil {
+		err = gutterErr
+	}
+	return items, err
+}
+
+// getMulti gets keys from the servers which are picked by pick and stores the items which are found.
+// failed is the keys of the servers which failed.
+func getMulti(items map[string]*client.Item, keys [][]byte, pick func(key []byte) *Memcached) (failed map[string]struct{}, firstErr error) {
+	batches := make(map[*client.Client][][]byte)
+	servers := make(map[*client.Client]*Memcached)
+	for _, key := range keys {
+		s := pick(key)
+		batches[s.Client] = append(batches[s.Client], key)
+		servers[s.Client] = s
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed = make(map[string]struct{})
+	for k, batch := range batches {
+		wg.Add(1)
+		go func(s *Memcached, batch [][]byte) {
+			defer wg.Done()
+
+			res, err := s.getMulti(batch)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				for _, key := range batch {
+					failed[string(key)] = struct{}{}
+				}
+				return
+			}
+			for key, v := range res {
+				items[key] = v
+			}
+		}(servers[k], batch)
+	}
+	wg.Wait()
+
+	return failed, firstErr
 }
 
 func (c *Cluster) Set(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Set(key, value, cas, flag, expiration)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Set(key, value, cas, flag, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, cas, func(s *Memcached, cas uint64) (<-chan *client.Item, error) {
+		return s.Set(key, value, cas, flag, expiration)
+	})
 }
 
 func (c *Cluster) Add(key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Add(key, value, flag, expiration)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Add(key, value, flag, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, 0, func(s *Memcached, _ uint64) (<-chan *client.Item, error) {
+		return s.Add(key, value, flag, expiration)
+	})
 }
 
 func (c *Cluster) Replace(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Replace(key, value, cas, flag, expiration)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Replace(key, value, cas, flag, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, cas, func(s *Memcached, cas uint64) (<-chan *client.Item, error) {
+		return s.Replace(key, value, cas, flag, expiration)
+	})
 }
 
+// Del deletes key from the owner and the replicas.
+// If Gutter is set, key is deleted from the gutter too and the response is returned after both finished.
 func (c *Cluster) Del(key []byte) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Del(key)
+	return c.DelCAS(key, 0)
+}
+
+// DelCAS deletes key as Del if the CAS value of the item of the owner is cas. The replicas and the gutter are deleted without CAS.
+func (c *Cluster) DelCAS(key []byte, cas uint64) (<-chan *client.Item, error) {
+	if c.Gutter == nil {
+		return c.del(key, cas)
+	}
+	if g := c.gutterRoute(key); g != nil {
+		return g.DelCAS(key, cas)
+	}
+
+	gutter, gutterErr := c.Gutter.Ring.Pick(key).Del(key)
+	res, err := c.del(key, cas)
+	if err != nil || gutterErr != nil {
+		return res, err
+	}
+
+	result := make(chan *client.Item, 1)
+	go func() {
+		v := <-res
+		<-gutter
+		result <- v
+	}()
+	return result, nil
+}
+
+func (c *Cluster) del(key []byte, cas uint64) (<-chan *client.Item, error) {
+	return c.write(key, cas, func(s *Memcached, cas uint64) (<-chan *client.Item, error) {
+		return s.DelCAS(key, cas)
+	})
+}
+
+// Append appends value to the item of key. The replicas are appended independently.
+func (c *Cluster) Append(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	if g := c.gutterRoute(key); g != nil {
+		return g.Append(key, value, cas)
+	}
+	return c.write(key, cas, func(s *Memcached, cas uint64) (<-chan *client.Item, error) {
+		return s.Append(key, value, cas)
+	})
+}
+
+// Prepend prepends value to the item of key. The replicas are prepended independently.
+func (c *Cluster) Prepend(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	if g := c.gutterRoute(key); g != nil {
+		return g.Prepend(key, value, cas)
+	}
+	return c.write(key, cas, func(s *Memcached, cas uint64) (<-chan *client.Item, error) {
+		return s.Prepend(key, value, cas)
+	})
+}
+
+// Touch changes the expiration of the item of key on the owner and the replicas.
+func (c *Cluster) Touch(key []byte, expiration int) (<-chan *client.Item, error) {
+	if g := c.gutterRoute(key); g != nil {
+		return g.Touch(key, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, 0, func(s *Memcached, _ uint64) (<-chan *client.Item, error) {
+		return s.Touch(key, expiration)
+	})
+}
+
+// GAT gets the item of key from the owner and changes its expiration. The replicas are touched.
+// Unlike Get, GAT doesn't fall back to the old owner or the replicas.
+func (c *Cluster) GAT(key []byte, expiration int) (<-chan *client.Item, error) {
+	if g := c.gutterRoute(key); g != nil {
+		return g.GAT(key, c.Gutter.expiration(expiration))
+	}
+	if c.Replicas <= 1 {
+		return c.Ring.Pick(key).GAT(key, expiration)
+	}
+
+	servers := c.Ring.PickN(key, c.Replicas)
+	res, err := servers[0].GAT(key, expiration)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range servers[1:] {
+		s.Touch(key, expiration)
+	}
+	return res, nil
 }
 
 func (c *Cluster) Incr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Incr(key, delta, initial, expiration)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Incr(key, delta, initial, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, 0, func(s *Memcached, _ uint64) (<-chan *client.Item, error) {
+		return s.Incr(key, delta, initial, expiration)
+	})
 }
 
 func (c *Cluster) Decr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
-	return c.Ring.Pick(key).Decr(key, delta, initial, expiration)
+	if g := c.gutterRoute(key); g != nil {
+		return g.Decr(key, delta, initial, c.Gutter.expiration(expiration))
+	}
+	return c.write(key, 0, func(s *Memcached, _ uint64) (<-chan *client.Item, error) {
+		return s.Decr(key, delta, initial, expiration)
+	})
+}
+
+// write sends the write to the owner and the replicas of key, and returns the response of WriteAck.
+// The CAS value belongs to the owner, so the write with CAS goes to the replicas without CAS after the owner accepted it.
+func (c *Cluster) write(key []byte, cas uint64, f func(s *Memcached, cas uint64) (<-chan *client.Item, error)) (<-chan *client.Item, error) {
+	servers := c.routes(key)
+	if len(servers) == 1 {
+		return f(servers[0], cas)
+	}
+
+	results := make([]<-chan *client.Item, len(servers))
+	errs := make([]error, len(servers))
+	if cas != 0 {
+		res, err := f(servers[0], cas)
+		if err != nil {
+			return nil, err
+		}
+		v := <-res
+		primary := make(chan *client.Item, 1)
+		primary <- v
+		if v.Err != nil {
+			return primary, nil
+		}
+		results[0] = primary
+	} else {
+		results[0], errs[0] = f(servers[0], 0)
+	}
+	for i, s := range servers[1:] {
+		results[i+1], errs[i+1] = f(s, 0)
+	}
+
+	if c.WriteAck == WriteAckPrimary || len(servers) == 1 {
+		return results[0], errs[0]
+	}
+	return c.ack(results, errs), nil
+}
+
+// ack waits the responses of the replicas. The first element of results is the response of the owner.
+// WriteAckAll returns the response of the owner if all replicas succeeded, otherwise the first failure.
+// WriteAckAny returns the response of the owner if it succeeded, because the CAS and the value of the counter
+// of a replica are different from the owner's. The success of a replica is returned only if the owner failed.
+// If all servers failed, WriteAckAny returns the failure of the owner.
+func (c *Cluster) ack(results []<-chan *client.Item, errs []error) <-chan *client.Item {
+	type response struct {
+		index int
+		item  *client.Item
+	}
+	responses := make(chan response, len(results))
+	for i := range results {
+		if errs[i] != nil {
+			responses <- response{index: i, item: &client.Item{Status: client.StatusInternalError, Err: errs[i]}}
+			continue
+		}
+		go func(i int) {
+			responses <- response{index: i, item: <-results[i]}
+		}(i)
+	}
+
+	result := make(chan *client.Item, 1)
+	go func() {
+		items := make([]*client.Item, len(results))
+		for range results {
+			r := <-responses
+			items[r.index] = r.item
+			if c.WriteAck == WriteAckAny {
+				if v := anySuccess(items); v != nil {
+					result <- v
+					return
+				}
+			}
+		}
+
+		if c.WriteAck == WriteAckAll {
+			for _, v := range items {
+				if v.Err != nil {
+					result <- v
+					return
+				}
+			}
+		}
+		result <- items[0]
+	}()
+
+	return result
+}
+
+// anySuccess returns the response of the owner if it succeeded, or the first success of the replicas if the owner failed.
+// It returns nil until the response of the owner is received.
+func anySuccess(items []*client.Item) *client.Item {
+	if items[0] == nil {
+		return nil
+	}
+	if items[0].Err == nil {
+		return items[0]
+	}
+	for _, v := range items[1:] {
+		if v != nil && v.Err == nil {
+			return v
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,286 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func TestRing_PickN(t *testing.T) {
+	keys := newTestKeys(1000)
+
+	for _, mode := range pickerModes {
+		r, err := NewRingWithHash(newTestServers(5), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range keys {
+			servers := r.PickN(key, 3)
+			if len(servers) != 3 {
+				t.Fatalf("%s: expected 3 servers but got %d", mode, len(servers))
+			}
+			if servers[0].Name != r.Pick(key).Name {
+				t.Fatalf("%s: the first server is not the owner", mode)
+			}
+			seen := make(map[string]bool)
+			for _, v := range servers {
+				if seen[v.Name] {
+					t.Fatalf("%s: %s is picked twice", mode, v.Name)
+				}
+				seen[v.Name] = true
+				if v.Mode != ModeReadWrite {
+					t.Fatalf("%s: %s can't serve the reads", mode, v.Name)
+				}
+			}
+		}
+
+		if l := len(r.PickN([]byte("key"), 10)); l != 5 {
+			t.Errorf("%s: expected all 5 servers but got %d", mode, l)
+		}
+	}
+}
+
+type testCluster struct {
+	*Cluster
+	servers map[string]*memcachedtest.Server
+}
+
+func newTestCluster(t *testing.T, n, replicas int, ack WriteAck) *testCluster {
+	var servers []*Memcached
+	backends := make(map[string]*memcachedtest.Server)
+	for i := 0; i < n; i++ {
+		m, s := newTestMemcachedServer(t, fmt.Sprintf("server%d", i))
+		servers = append(servers, m)
+		backends[m.Name] = s
+	}
+	ring, err := NewRing(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCluster{Cluster: &Cluster{Ring: ring, Replicas: replicas, WriteAck: ack}, servers: backends}
+}
+
+func (c *testCluster) set(t *testing.T, key, value string) {
+	t.Helper()
+
+	res, err := c.Set([]byte(key), []byte(value), 0, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-res; v.Err != nil {
+		t.Fatal(v.Err)
+	}
+}
+
+func (c *testCluster) get(t *testing.T, key string) *client.Item {
+	t.Helper()
+
+	res, err := c.Get([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return <-res
+}
+
+func TestCluster_Replication(t *testing.T) {
+	c := newTestCluster(t, 4, 2, WriteAckAll)
+
+	c.set(t, "key", "value")
+	replicas := c.Ring.PickN([]byte("key"), 2)
+	for name, s := range c.servers {
+		_, ok := s.Value("key")
+		if e := name == replicas[0].Name || name == replicas[1].Name; ok != e {
+			t.Errorf("%s: expected to have the key %v", name, e)
+		}
+	}
+
+	// The owner misses.
+	if err := replicas[0].Client.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.get(t, "key"); v.Err != nil || string(v.Value) != "value" {
+		t.Errorf("expected the value of the replica: %v", v.Err)
+	}
+
+	// The owner fails.
+	c.set(t, "key", "value2")
+	replicas[0].Client.Close()
+	if v := c.get(t, "key"); v.Err != nil || string(v.Value) != "value2" {
+		t.Errorf("expected the value of the replica: %v", v.Err)
+	}
+
+	if v := c.get(t, "unknown"); v.Err != client.ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound but got %v", v.Err)
+	}
+}
+
+func TestCluster_ReplicationCAS(t *testing.T) {
+	c := newTestCluster(t, 3, 3, WriteAckAll)
+
+	c.set(t, "key", "value")
+	v := c.get(t, "key")
+	if v.Err != nil {
+		t.Fatal(v.Err)
+	}
+
+	// The CAS value of the owner is accepted although the replicas have the different CAS values.
+	res, err := c.Set([]byte("key"), []byte("value2"), v.CAS, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-res; v.Err != nil {
+		t.Fatal(v.Err)
+	}
+	for name, s := range c.servers {
+		if b, _ := s.Value("key"); string(b) != "value2" {
+			t.Errorf("%s has %q", name, b)
+		}
+	}
+
+	res, err = c.Set([]byte("key"), []byte("value3"), v.CAS, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-res; v.Err != client.ErrKeyAlreadyExists {
+		t.Errorf("expected ErrKeyAlreadyExists but got %v", v.Err)
+	}
+}
+
+func TestCluster_WriteAck(t *testing.T) {
+	cases := []struct {
+		Ack WriteAck
+		// Err is the error when the replica fails.
+		Err bool
+	}{
+		{Ack: WriteAckAll, Err: true},
+		{Ack: WriteAckAny},
+		{Ack: WriteAckPrimary},
+	}
+
+	for _, tc := range cases {
+		c := newTestCluster(t, 3, 2, tc.Ack)
+		replicas := c.Ring.PickN([]byte("key"), 2)
+		replicas[1].Client.Close()
+
+		res, err := c.Set([]byte("key"), []byte("value"), 0, make([]byte, 4), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := <-res; (v.Err != nil) != tc.Err {
+			t.Errorf("%s: unexpected error: %v", tc.Ack, v.Err)
+		}
+	}
+
+	// Any succeeds if the owner fails.
+	c := newTestCluster(t, 3, 2, WriteAckAny)
+	c.Ring.PickN([]byte("key"), 2)[0].Client.Close()
+	res, err := c.Set([]byte("key"), []byte("value"), 0, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-res; v.Err != nil {
+		t.Errorf("any: unexpected error: %v", v.Err)
+	}
+}
+
+func TestCluster_WriteAckAnyOwnerResponse(t *testing.T) {
+	c := newTestCluster(t, 3, 2, WriteAckAny)
+	key := []byte("counter")
+	servers := c.Ring.PickN(key, 2)
+	owner := c.servers[servers[0].Name]
+	// The counter of the replica is different from the owner's.
+	if err := servers[0].Client.Set(key, []byte("1"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := servers[1].Client.Set(key, []byte("1000"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica responds before the owner.
+	owner.Pause()
+	res, err := c.Incr(key, 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	owner.Resume()
+	v, err := (<-res).Counter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 {
+		t.Errorf("expected the counter of the owner but got %d", v)
+	}
+
+	owner.Pause()
+	res, err = c.Set(key, []byte("value"), 0, make([]byte, 4), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	owner.Resume()
+	item := <-res
+	stored, err := servers[0].Client.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.CAS != stored.CAS {
+		t.Errorf("expected the CAS of the owner %d but got %d", stored.CAS, item.CAS)
+	}
+}
+
+func TestCluster_GetMultiReplication(t *testing.T) {
+	c := newTestCluster(t, 4, 2, WriteAckAll)
+
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key%d", i)
+		c.set(t, key, "value")
+		keys = append(keys, []byte(key))
+
+		// Half of the owners lose the key.
+		if i%2 == 0 {
+			if err := c.Ring.Pick([]byte(key)).Client.Del([]byte(key)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	items, err := c.GetMulti(append(keys, []byte("unknown")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != len(keys) {
+		t.Errorf("expected %d items but got %d", len(keys), len(items))
+	}
+}
+
+func TestParseWriteAck(t *testing.T) {
+	cases := []struct {
+		Value string
+		Ack   WriteAck
+		Err   error
+	}{
+		{Value: "", Ack: WriteAckAll},
+		{Value: "all", Ack: WriteAckAll},
+		{Value: "any", Ack: WriteAckAny},
+		{Value: "primary", Ack: WriteAckPrimary},
+		{Value: "quorum", Err: ErrUnknownWriteAck},
+	}
+
+	for _, c := range cases {
+		a, err := ParseWriteAck(c.Value)
+		if err != c.Err {
+			t.Errorf("%s: expected %v but got %v", c.Value, c.Err, err)
+			continue
+		}
+		if a != c.Ack {
+			t.Errorf("%s: expected %s but got %s", c.Value, c.Ack, a)
+		}
+	}
+}
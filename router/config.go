@@ -1,20 +1,148 @@
 package router
 
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/go-yaml/yaml"
+)
+
 type Config struct {
 	Servers []ConfigServer `yaml:"servers"`
+	// Hash is the placement of the keys. "crc32" (default), "ketama", "jump", "rendezvous" or "maglev"
+	Hash string `yaml:"hash"`
+	// VNodes is the number of the points per weight on the continuum. The default is 100 for "crc32".
+	// "ketama" places the points by the formula of libketama unless VNodes is set.
+	VNodes      int                `yaml:"vnodes"`
+	Breaker     *ConfigBreaker     `yaml:"breaker"`
+	Replication *ConfigReplication `yaml:"replication"`
+	Repair      *ConfigRepair      `yaml:"repair"`
+	HealthCheck *ConfigHealthCheck `yaml:"health_check"`
+	Gutter      *ConfigGutter      `yaml:"gutter"`
 }
 
 type ConfigServer struct {
 	Name   string `yaml:"name"`
 	Host   string `yaml:"host"`
 	Port   int    `yaml:"port"`
+	Socket string `yaml:"socket"`
+	// Weight is the relative share of the keyspace. The default is 1.
+	Weight int    `yaml:"weight"`
 	Status string `yaml:"status"`
 	Phase  string `yaml:"phase"`
 }
 
+// ConfigBreaker is the configuration of the circuit breaker for each server.
+// The breaker is disabled if the section is omitted.
+type ConfigBreaker struct {
+	ConsecutiveFailures int           `yaml:"consecutive_failures"`
+	ErrorRate           float64       `yaml:"error_rate"`
+	MinRequests         int           `yaml:"min_requests"`
+	Window              time.Duration `yaml:"window"`
+	OpenTimeout         time.Duration `yaml:"open_timeout"`
+	HalfOpenProbes      int           `yaml:"half_open_probes"`
+	Timeout             time.Duration `yaml:"timeout"`
+	// Read is the behavior of reads while the breaker is open. "fail" (default) or "miss"
+	Read string `yaml:"read"`
+	// Write is the behavior of writes while the breaker is open. "fail" (default) or "skip"
+	Write string `yaml:"write"`
+}
+
+// ConfigReplication is the configuration of the replication. The replication is disabled if the section is omitted.
+type ConfigReplication struct {
+	// Factor is the number of the servers which have each key including the owner.
+	Factor int `yaml:"factor"`
+	// WriteAck is the acknowledgement of the writes. "all" (default), "any" or "primary"
+	WriteAck string `yaml:"write_ack"`
+}
+
+// ConfigRepair is the configuration of the read repair. The read repair is disabled if the section is omitted.
+type ConfigRepair struct {
+	// TTL is the expiration of the repaired value. It is required.
+	TTL time.Duration `yaml:"ttl"`
+	// Rate is the number of the repairs per second. Zero disables the limit.
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// ConfigHealthCheck is the configuration of the health checker. The health check is disabled if the section is omitted.
+type ConfigHealthCheck struct {
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// FailureThreshold is the number of consecutive failures which ejects the server.
+	FailureThreshold int `yaml:"failure_threshold"`
+	// SuccessThreshold is the number of consecutive successes which makes the ejected server rejoin.
+	SuccessThreshold int `yaml:"success_threshold"`
+}
+
+// ConfigGutter is the configuration of the gutter pool. The gutter is disabled if the section is omitted.
+type ConfigGutter struct {
+	Servers []ConfigServer `yaml:"servers"`
+	// Hash is the placement of the keys in the gutter. The values are the same as Config.Hash.
+	Hash string `yaml:"hash"`
+	// TTL is the maximum expiration of the values in the gutter. The default is 10s.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// LoadConfig reads the config from the YAML file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var conf Config
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return nil, err
+	}
+
+	return &conf, nil
+}
+
+func (c *ConfigBreaker) ToBreakerConfig() BreakerConfig {
+	conf := BreakerConfig{
+		ConsecutiveFailures: c.ConsecutiveFailures,
+		ErrorRate:           c.ErrorRate,
+		MinRequests:         c.MinRequests,
+		Window:              c.Window,
+		OpenTimeout:         c.OpenTimeout,
+		HalfOpenProbes:      c.HalfOpenProbes,
+		Timeout:             c.Timeout,
+	}
+	if c.Read == "miss" {
+		conf.Read = ReadMiss
+	}
+	if c.Write == "skip" {
+		conf.Write = WriteSkip
+	}
+
+	return conf
+}
+
+func (c *ConfigHealthCheck) ToHealthConfig() HealthConfig {
+	return HealthConfig{
+		Interval:         c.Interval,
+		Timeout:          c.Timeout,
+		FailureThreshold: c.FailureThreshold,
+		SuccessThreshold: c.SuccessThreshold,
+	}
+}
+
 func (c *Config) ToRouter() []*Memcached {
-	servers := make([]*Memcached, len(c.Servers))
-	for i, v := range c.Servers {
+	return c.toServers(c.Servers)
+}
+
+// ToGutter returns the servers of the gutter pool. It returns nil if the gutter is disabled.
+func (c *Config) ToGutter() []*Memcached {
+	if c.Gutter == nil {
+		return nil
+	}
+
+	return c.toServers(c.Gutter.Servers)
+}
+
+func (c *Config) toServers(conf []ConfigServer) []*Memcached {
+	servers := make([]*Memcached, len(conf))
+	for i, v := range conf {
 		status := StatusNormal
 		switch v.Status {
 		case "add":
@@ -33,9 +161,76 @@ func (c *Config) ToRouter() []*Memcached {
 			Name:   v.Name,
 			Host:   v.Host,
 			Port:   v.Port,
+			Socket: v.Socket,
+			Weight: v.Weight,
 			Status: status,
 			Phase:  phase,
 		}
+		if c.Breaker != nil {
+			servers[i].Breaker = NewBreaker(v.Name, c.Breaker.ToBreakerConfig())
+		}
+	}
+	return servers
+}
+
+func (c *Config) ToRingConfig() (RingConfig, error) {
+	mode, err := ParseHashMode(c.Hash)
+	if err != nil {
+		return RingConfig{}, err
+	}
+
+	return RingConfig{Hash: mode, VNodes: c.VNodes}, nil
+}
+
+// NewRing builds the ring of servers with the placement of the config.
+func (c *Config) NewRing(servers []*Memcached) (*Ring, error) {
+	conf, err := c.ToRingConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRingWithConfig(servers, conf)
+}
+
+// NewCluster builds the cluster of servers with the config.
+func (c *Config) NewCluster(servers []*Memcached) (*Cluster, error) {
+	ring, err := c.NewRing(servers)
+	if err != nil {
+		return nil, err
+	}
+	cluster := &Cluster{Ring: ring}
+
+	if c.Replication != nil {
+		ack, err := ParseWriteAck(c.Replication.WriteAck)
+		if err != nil {
+			return nil, err
+		}
+		cluster.Replicas = c.Replication.Factor
+		cluster.WriteAck = ack
+	}
+	if c.Repair != nil {
+		if c.Repair.TTL <= 0 {
+			return nil, ErrRepairTTLRequired
+		}
+		cluster.Repair = NewReadRepair(c.Repair.TTL, c.Repair.Rate, c.Repair.Burst)
 	}
-	return nil
+
+	return cluster, nil
+}
+
+// NewGutter builds the gutter of servers which are returned by ToGutter. It returns nil if the gutter is disabled.
+func (c *Config) NewGutter(servers []*Memcached) (*Gutter, error) {
+	if c.Gutter == nil {
+		return nil, nil
+	}
+	mode, err := ParseHashMode(c.Gutter.Hash)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := NewRingWithHash(servers, mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewGutter(ring, c.Gutter.TTL), nil
 }
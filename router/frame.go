@@ -0,0 +1,108 @@
+package router
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// DefaultMaxBodySize is the maximum length of the body of the request.
+// It is larger than the default item size limit of memcached (1MB) by the room of the key and the extras.
+const DefaultMaxBodySize = 1<<20 + 1024
+
+const headerSize = 24
+
+// request is a request frame of the binary protocol.
+type request struct {
+	Opcode byte
+	Opaque uint32
+	CAS    uint64
+	Extra  []byte
+	Key    []byte
+	Value  []byte
+}
+
+// frameError is the request frame which can't be processed.
+// If fatal is false, the body has been discarded and the next frame can be read.
+type frameError struct {
+	opcode byte
+	opaque uint32
+	status uint16
+	fatal  bool
+	reason string
+}
+
+func (e *frameError) Error() string {
+	return fmt.Sprintf("router: invalid request frame: %s", e.reason)
+}
+
+// frameReader reads the request frames from the stream.
+// The frame may be split into multiple reads and multiple frames may arrive in a single read.
+type frameReader struct {
+	r           *bufio.Reader
+	maxBodySize int
+	header      [headerSize]byte
+}
+
+func newFrameReader(r io.Reader, maxBodySize int) *frameReader {
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	return &frameReader{r: bufio.NewReader(r), maxBodySize: maxBodySize}
+}
+
+// next reads the next frame. It returns *frameError if the frame is malformed, or the error of the stream.
+func (f *frameReader) next() (*request, error) {
+	h := f.header[:]
+	if _, err := io.ReadFull(f.r, h); err != nil {
+		return nil, err
+	}
+
+	opcode := h[1]
+	keyLength := int(binary.BigEndian.Uint16(h[2:4]))
+	extraLength := int(h[4])
+	totalBody := int(binary.BigEndian.Uint32(h[8:12]))
+	opaque := binary.BigEndian.Uint32(h[12:16])
+	cas := binary.BigEndian.Uint64(h[16:24])
+	if h[0] != client.MagicRequest {
+		// The boundary of the frames is unknown
+		return nil, &frameError{opcode: opcode, opaque: opaque, status: client.StatusInvalidArguments, fatal: true, reason: "invalid magic"}
+	}
+	if totalBody > f.maxBodySize {
+		if _, err := io.CopyN(ioutil.Discard, f.r, int64(totalBody)); err != nil {
+			return nil, err
+		}
+		return nil, &frameError{opcode: opcode, opaque: opaque, status: client.StatusValueTooLarge, reason: "body too large"}
+	}
+
+	body := make([]byte, totalBody)
+	if _, err := io.ReadFull(f.r, body); err != nil {
+		return nil, err
+	}
+	if keyLength+extraLength > totalBody {
+		return nil, &frameError{opcode: opcode, opaque: opaque, status: client.StatusInvalidArguments, reason: "key and extras exceed the body"}
+	}
+
+	req := &request{Opcode: opcode, Opaque: opaque, CAS: cas}
+	if extraLength > 0 {
+		req.Extra = body[:extraLength]
+	}
+	if keyLength > 0 {
+		req.Key = body[extraLength : extraLength+keyLength]
+	}
+	if totalBody > extraLength+keyLength {
+		req.Value = body[extraLength+keyLength:]
+	}
+
+	return req, nil
+}
+
+// errorResponse encodes the response of err.
+func errorResponse(err *frameError) []byte {
+	return encodeResponse(err.opcode, err.status, err.opaque, 0, nil, nil, nil)
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"math"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+const defaultGutterTTL = 10 * time.Second
+
+// Gutter is the small pool which serves the keys whose owner is down, like the gutter pool of mcrouter.
+//
+// The owner is down while it is ejected by the health checker or its circuit breaker rejects the requests.
+// The breaker which allows the probe routes the probe to the owner.
+// The keys of the down server are not rehashed to the other servers of the ring,
+// so the load of the healthy servers doesn't increase and no value which is written while the owner is down remains on them
+// after the owner comes back.
+// The values in the gutter expire within TTL. The deletes are sent to the gutter too, even if the owner is up,
+// so the gutter doesn't serve the stale value when the owner goes down again.
+type Gutter struct {
+	Ring *Ring
+	// TTL is the maximum expiration of the values which are written to the gutter.
+	TTL time.Duration
+
+	now func() time.Time
+}
+
+func NewGutter(ring *Ring, ttl time.Duration) *Gutter {
+	if ttl <= 0 {
+		ttl = defaultGutterTTL
+	}
+
+	return &Gutter{Ring: ring, TTL: ttl, now: time.Now}
+}
+
+// expiration caps expiration by TTL. The negative expiration (e.g. client.ExpirationNoCreate) is not changed.
+func (g *Gutter) expiration(expiration int) int {
+	ttl := int(math.Ceil(g.TTL.Seconds()))
+	if ttl < 1 {
+		ttl = 1
+	}
+	if ttl > client.MaxRelativeExpiration {
+		ttl = client.MaxRelativeExpiration
+	}
+	if expiration < 0 {
+		return expiration
+	}
+
+	relative := expiration
+	if expiration > client.MaxRelativeExpiration {
+		relative = expiration - int(g.now().Unix())
+		if relative <= 0 {
+			// The value has already expired
+			return expiration
+		}
+	}
+	if expiration == 0 || relative > ttl {
+		return ttl
+	}
+
+	return expiration
+}
+
+// gutterRoute returns the routing entry of the gutter if the owner of key is down, otherwise nil.
+func (c *Cluster) gutterRoute(key []byte) *Memcached {
+	if c.Gutter == nil {
+		return nil
+	}
+	owner := c.Ring.Picker.Pick(key)
+	if owner == nil || !c.Ring.isEjected(owner.Name) && (owner.Breaker == nil || !owner.Breaker.rejecting()) {
+		return nil
+	}
+
+	return c.Gutter.Ring.Pick(key)
+}
@@ -0,0 +1,138 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+func newTestGutterCluster(t *testing.T) (*testCluster, *Memcached) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	g, s := newTestMemcachedServer(t, "gutter0")
+	ring, err := NewRing([]*Memcached{g})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Gutter = NewGutter(ring, 10*time.Second)
+	c.servers[g.Name] = s
+
+	return c, g
+}
+
+// ownedKey returns the key which is owned by name.
+func ownedKey(t *testing.T, r *Ring, name string) string {
+	for _, key := range newTestKeys(1000) {
+		if r.Pick(key).Name == name {
+			return string(key)
+		}
+	}
+	t.Fatalf("%s doesn't own any key", name)
+	return ""
+}
+
+func TestCluster_Gutter(t *testing.T) {
+	c, _ := newTestGutterCluster(t)
+	key := ownedKey(t, c.Ring, "server1")
+	other := ownedKey(t, c.Ring, "server2")
+	if err := c.Ring.SetEjected([]string{"server1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c.set(t, key, "gutter")
+	c.set(t, other, "value")
+	for name, s := range c.servers {
+		_, ok := s.Value(key)
+		if ok != (name == "gutter0") {
+			t.Errorf("%s: unexpected value of the key of the ejected server", name)
+		}
+	}
+	if v := c.get(t, key); v.Err != nil || string(v.Value) != "gutter" {
+		t.Fatalf("unexpected response: %v %q", v.Err, v.Value)
+	}
+	items, err := c.GetMulti([][]byte{[]byte(key), []byte(other)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items[key].Value) != "gutter" || string(items[other].Value) != "value" {
+		t.Fatalf("unexpected items: %v", items)
+	}
+
+	// The value in the gutter is capped by TTL.
+	now := time.Now()
+	c.servers["gutter0"].Now = func() time.Time { return now.Add(11 * time.Second) }
+	if _, ok := c.servers["gutter0"].Value(key); ok {
+		t.Error("the value in the gutter doesn't expire")
+	}
+	c.servers["gutter0"].Now = time.Now
+
+	// The delete goes to the gutter even after the owner comes back.
+	if err := c.Ring.SetEjected(nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.get(t, key); v.Err != client.ErrKeyNotFound {
+		t.Fatalf("expected the owner misses but got %v", v.Err)
+	}
+	c.set(t, key, "owner")
+	res, err := c.Del([]byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := <-res; v.Err != nil {
+		t.Fatal(v.Err)
+	}
+	for name, s := range c.servers {
+		if _, ok := s.Value(key); ok {
+			t.Errorf("%s has the deleted key", name)
+		}
+	}
+}
+
+func TestCluster_GutterBreaker(t *testing.T) {
+	c, _ := newTestGutterCluster(t)
+	key := ownedKey(t, c.Ring, "server0")
+	b := NewBreaker("server0", BreakerConfig{ConsecutiveFailures: 1, OpenTimeout: time.Minute})
+	for _, v := range c.Ring.Servers {
+		if v.Name == "server0" {
+			v.Breaker = b
+		}
+	}
+	// The routing entries of the ring are the copies of the servers.
+	c.Ring.Pick([]byte(key)).Breaker = b
+
+	b.Done(false)
+	c.set(t, key, "gutter")
+	if _, ok := c.servers["gutter0"].Value(key); !ok {
+		t.Error("the key of the server whose breaker is open is not written to the gutter")
+	}
+
+	// The probe goes to the owner after OpenTimeout.
+	b.now = func() time.Time { return time.Now().Add(time.Minute) }
+	if v := c.get(t, key); v.Err != client.ErrKeyNotFound {
+		t.Errorf("expected the probe misses on the owner but got %v", v.Err)
+	}
+}
+
+func TestGutter_Expiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	g := NewGutter(nil, 10*time.Second)
+	g.now = func() time.Time { return now }
+
+	cases := []struct {
+		Expiration int
+		Expect     int
+	}{
+		{Expiration: 0, Expect: 10},
+		{Expiration: 5, Expect: 5},
+		{Expiration: 60, Expect: 10},
+		{Expiration: client.ExpirationNoCreate, Expect: client.ExpirationNoCreate},
+		{Expiration: int(now.Unix()) + 5, Expect: int(now.Unix()) + 5},
+		{Expiration: int(now.Unix()) + 3600, Expect: 10},
+		{Expiration: int(now.Unix()) - 1, Expect: int(now.Unix()) - 1},
+	}
+	for _, c := range cases {
+		if got := g.expiration(c.Expiration); got != c.Expect {
+			t.Errorf("expiration(%d): expected %d but got %d", c.Expiration, c.Expect, got)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package router
+
+import (
+	"encoding/binary"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/logger"
+)
+
+// protocolVersion is the version which is returned to Version. The router speaks the binary protocol of memcached 1.6.
+const protocolVersion = "1.6.0"
+
+// requestLayout is the body of the request of each opcode.
+type requestLayout struct {
+	// extra is the length of the extras.
+	extra int
+	// key is true if the key is required. Otherwise the key must be empty.
+	key bool
+	// optionalKey allows both of the key and the empty key.
+	optionalKey bool
+	// value is true if the value is allowed.
+	value bool
+	// quiet omits the response on success. Get omits the response on miss instead.
+	quiet bool
+	// withKey returns the key with the item.
+	withKey bool
+	// get returns the item.
+	get bool
+}
+
+var requestLayouts = map[byte]requestLayout{
+	client.OpcodeGet:      {get: true, key: true},
+	client.OpcodeGetQ:     {get: true, key: true, quiet: true},
+	client.OpcodeGetK:     {get: true, key: true, withKey: true},
+	client.OpcodeGetKQ:    {get: true, key: true, quiet: true, withKey: true},
+	client.OpcodeGAT:      {get: true, extra: 4, key: true},
+	client.OpcodeGATQ:     {get: true, extra: 4, key: true, quiet: true},
+	client.OpcodeGATK:     {get: true, extra: 4, key: true, withKey: true},
+	client.OpcodeGATKQ:    {get: true, extra: 4, key: true, quiet: true, withKey: true},
+	client.OpcodeSet:      {extra: 8, key: true, value: true},
+	client.OpcodeSetQ:     {extra: 8, key: true, value: true, quiet: true},
+	client.OpcodeAdd:      {extra: 8, key: true, value: true},
+	client.OpcodeAddQ:     {extra: 8, key: true, value: true, quiet: true},
+	client.OpcodeReplace:  {extra: 8, key: true, value: true},
+	client.OpcodeReplaceQ: {extra: 8, key: true, value: true, quiet: true},
+	client.OpcodeAppend:   {key: true, value: true},
+	client.OpcodeAppendQ:  {key: true, value: true, quiet: true},
+	client.OpcodePrepend:  {key: true, value: true},
+	client.OpcodePrependQ: {key: true, value: true, quiet: true},
+	client.OpcodeDel:      {key: true},
+	client.OpcodeDelQ:     {key: true, quiet: true},
+	client.OpcodeIncr:     {extra: 20, key: true},
+	client.OpcodeIncrQ:    {extra: 20, key: true, quiet: true},
+	client.OpcodeDecr:     {extra: 20, key: true},
+	client.OpcodeDecrQ:    {extra: 20, key: true, quiet: true},
+	client.OpcodeTouch:    {extra: 4, key: true},
+	client.OpcodeStat:     {optionalKey: true},
+	client.OpcodeNoop:     {},
+	client.OpcodeVersion:  {},
+	client.OpcodeQuit:     {},
+	client.OpcodeQuitQ:    {quiet: true},
+}
+
+// validate returns StatusUnknownCommand if the router doesn't support the opcode,
+// and StatusInvalidArguments if the body doesn't match the opcode.
+func validate(req *request) uint16 {
+	l, ok := requestLayouts[req.Opcode]
+	if !ok {
+		return client.StatusUnknownCommand
+	}
+	if len(req.Extra) != l.extra || !l.optionalKey && l.key != (len(req.Key) > 0) || !l.value && len(req.Value) > 0 {
+		return client.StatusInvalidArguments
+	}
+
+	return client.StatusNoError
+}
+
+// handle sends req to the cluster and returns the pending response.
+// The request is sent before handle returns, so the backend receives the requests of a connection in order.
+func (s *Router) handle(req *request) *pending {
+	if status := validate(req); status != client.StatusNoError {
+		return &pending{raw: encodeResponse(req.Opcode, status, req.Opaque, 0, nil, nil, nil)}
+	}
+
+	switch req.Opcode {
+	case client.OpcodeNoop:
+		return &pending{raw: encodeResponse(req.Opcode, client.StatusNoError, req.Opaque, 0, nil, nil, nil)}
+	case client.OpcodeVersion:
+		return &pending{raw: encodeResponse(req.Opcode, client.StatusNoError, req.Opaque, 0, nil, nil, []byte(protocolVersion))}
+	case client.OpcodeQuit:
+		return &pending{raw: encodeResponse(req.Opcode, client.StatusNoError, req.Opaque, 0, nil, nil, nil), quit: true}
+	case client.OpcodeQuitQ:
+		return &pending{quit: true}
+	case client.OpcodeStat:
+		return s.handleStat(req)
+	}
+
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		return call(c, req)
+	}, func(res *client.Item) []byte {
+		return response(req, res)
+	})
+}
+
+// handleStat returns a response per statistic and the terminator which has no key.
+// The statistics are aggregated in background because the servers are waited up to statsTimeout.
+func (s *Router) handleStat(req *request) *pending {
+	group := string(req.Key)
+	if !isStatsGroup(group) {
+		return &pending{raw: encodeResponse(req.Opcode, client.StatusKeyNotFound, req.Opaque, 0, nil, nil, nil)}
+	}
+
+	return s.background(func(c *Cluster) []byte {
+		var b []byte
+		for _, v := range s.stats(c, group) {
+			b = append(b, encodeResponse(req.Opcode, client.StatusNoError, req.Opaque, 0, nil, []byte(v.Name), []byte(v.Value))...)
+		}
+		return append(b, encodeResponse(req.Opcode, client.StatusNoError, req.Opaque, 0, nil, nil, nil)...)
+	})
+}
+
+// send sends the request by f to the current cluster and returns the pending response which is encoded by encode.
+func (s *Router) send(f func(c *Cluster) (<-chan *client.Item, error), encode func(res *client.Item) []byte) *pending {
+	snap := s.acquire()
+	result := make(chan *client.Item, 1)
+	v, err := f(snap.cluster)
+	if err != nil {
+		snap.release()
+		logger.Log.Info(err)
+		result <- &client.Item{Status: client.StatusInternalError, Err: err}
+		return &pending{result: result, encode: encode}
+	}
+	go func() {
+		defer snap.release()
+		result <- <-v
+	}()
+
+	return &pending{result: result, encode: encode}
+}
+
+// handleGetMulti gets the keys of batch by Cluster.GetMulti, which sends a batch to each backend in parallel.
+// The response has the hits in the order of batch. The keys of the failed backends are treated as the misses.
+func (s *Router) handleGetMulti(batch []*request) *pending {
+	keys := make([][]byte, len(batch))
+	for i, req := range batch {
+		keys[i] = req.Key
+	}
+
+	return s.background(func(c *Cluster) []byte {
+		items, err := c.GetMulti(keys)
+		if err != nil {
+			logger.Log.Infow("failed to get the keys", "keys", len(keys), "err", err)
+		}
+		var b []byte
+		for _, req := range batch {
+			if v, ok := items[string(req.Key)]; ok {
+				b = append(b, response(req, v)...)
+			}
+		}
+		return b
+	})
+}
+
+// background calls f with the cluster in background and returns the response which f encodes, as send does.
+// The next requests are read while f waits for the backends.
+func (s *Router) background(f func(c *Cluster) []byte) *pending {
+	snap := s.acquire()
+	result := make(chan *client.Item, 1)
+	go func() {
+		defer snap.release()
+		// The response is passed as Raw
+		result <- &client.Item{Raw: f(snap.cluster)}
+	}()
+
+	return &pending{result: result, encode: rawResponse}
+}
+
+// rawResponse returns the response which is encoded by background.
+func rawResponse(res *client.Item) []byte {
+	return res.Raw
+}
+
+// call sends req to the cluster. req must be validated.
+func call(c *Cluster, req *request) (<-chan *client.Item, error) {
+	switch req.Opcode {
+	case client.OpcodeGet, client.OpcodeGetQ, client.OpcodeGetK, client.OpcodeGetKQ:
+		return c.Get(req.Key)
+	case client.OpcodeGAT, client.OpcodeGATQ, client.OpcodeGATK, client.OpcodeGATKQ:
+		return c.GAT(req.Key, int(binary.BigEndian.Uint32(req.Extra)))
+	case client.OpcodeSet, client.OpcodeSetQ:
+		return c.Set(req.Key, req.Value, req.CAS, req.Extra[:4], int(binary.BigEndian.Uint32(req.Extra[4:8])))
+	case client.OpcodeAdd, client.OpcodeAddQ:
+		return c.Add(req.Key, req.Value, req.Extra[:4], int(binary.BigEndian.Uint32(req.Extra[4:8])))
+	case client.OpcodeReplace, client.OpcodeReplaceQ:
+		return c.Replace(req.Key, req.Value, req.CAS, req.Extra[:4], int(binary.BigEndian.Uint32(req.Extra[4:8])))
+	case client.OpcodeAppend, client.OpcodeAppendQ:
+		return c.Append(req.Key, req.Value, req.CAS)
+	case client.OpcodePrepend, client.OpcodePrependQ:
+		return c.Prepend(req.Key, req.Value, req.CAS)
+	case client.OpcodeDel, client.OpcodeDelQ:
+		return c.DelCAS(req.Key, req.CAS)
+	case client.OpcodeIncr, client.OpcodeIncrQ, client.OpcodeDecr, client.OpcodeDecrQ:
+		delta := int64(binary.BigEndian.Uint64(req.Extra[0:8]))
+		initial := int64(binary.BigEndian.Uint64(req.Extra[8:16]))
+		expiration := int(binary.BigEndian.Uint32(req.Extra[16:20]))
+		if expiration == 0xffffffff {
+			expiration = client.ExpirationNoCreate
+		}
+		if req.Opcode == client.OpcodeIncr || req.Opcode == client.OpcodeIncrQ {
+			return c.Incr(req.Key, delta, initial, expiration)
+		}
+		return c.Decr(req.Key, delta, initial, expiration)
+	case client.OpcodeTouch:
+		return c.Touch(req.Key, int(binary.BigEndian.Uint32(req.Extra)))
+	}
+
+	panic("unreachable")
+}
+
+// response rebuilds the response of the backend for req. It returns nil if the response is omitted by the quiet opcode.
+// The response has the opaque of req because the backend responds with the opaque of the router.
+func response(req *request, res *client.Item) []byte {
+	l := requestLayouts[req.Opcode]
+	if l.quiet {
+		if l.get && res.Status == client.StatusKeyNotFound || !l.get && res.Status == client.StatusNoError {
+			return nil
+		}
+	}
+
+	var extra, key []byte
+	if l.get && res.Status == client.StatusNoError {
+		extra = res.Extra
+	}
+	if l.withKey {
+		key = req.Key
+	}
+	return encodeResponse(req.Opcode, res.Status, req.Opaque, res.CAS, extra, key, res.Value)
+}
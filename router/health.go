@@ -0,0 +1,265 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/logger"
+)
+
+const (
+	defaultHealthInterval         = time.Second
+	defaultHealthTimeout          = 500 * time.Millisecond
+	defaultHealthFailureThreshold = 3
+	defaultHealthSuccessThreshold = 3
+)
+
+var (
+	errHealthCheckTimeout = errors.New("router: health check timed out")
+	errNotConnected       = errors.New("router: not connected")
+)
+
+type HealthConfig struct {
+	// Interval is the interval of the health checks.
+	Interval time.Duration
+	// Timeout is the duration after which the ping is treated as a failure.
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures which ejects the server.
+	FailureThreshold int
+	// SuccessThreshold is the number of consecutive successes which makes the ejected server rejoin.
+	SuccessThreshold int
+}
+
+// ServerHealth is the health of a server.
+type ServerHealth struct {
+	Name    string `json:"name"`
+	Ejected bool   `json:"ejected"`
+	// Failures and Successes are the number of the consecutive failures and successes.
+	Failures  int       `json:"failures"`
+	Successes int       `json:"successes"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// HealthChecker pings each server of the ring by Noop and ejects the unhealthy servers from the ring.
+// The connection of the server is redialed before the ping if it failed.
+//
+// The server is ejected after FailureThreshold consecutive failures and rejoins after SuccessThreshold consecutive successes.
+// The counter is reset by the opposite result, so the server which flaps doesn't move between the states on every check.
+// The keys of the ejected server are routed to the next healthy server. (See Ring.SetEjected)
+type HealthChecker struct {
+	mu     sync.Mutex
+	conf   HealthConfig
+	ring   *Ring
+	states map[string]*ServerHealth
+
+	now func() time.Time
+}
+
+func NewHealthChecker(conf HealthConfig) *HealthChecker {
+	h := &HealthChecker{states: make(map[string]*ServerHealth), now: time.Now}
+	h.SetConfig(conf)
+
+	return h
+}
+
+// SetConfig replaces the config. The zero fields are the default.
+func (h *HealthChecker) SetConfig(conf HealthConfig) {
+	if conf.Interval <= 0 {
+		conf.Interval = defaultHealthInterval
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = defaultHealthTimeout
+	}
+	if conf.FailureThreshold < 1 {
+		conf.FailureThreshold = defaultHealthFailureThreshold
+	}
+	if conf.SuccessThreshold < 1 {
+		conf.SuccessThreshold = defaultHealthSuccessThreshold
+	}
+
+	h.mu.Lock()
+	h.conf = conf
+	h.mu.Unlock()
+}
+
+// SetRing replaces the ring which is checked. nil stops checking.
+// The health of the servers which have the same name as the previous ring is kept, and they are ejected from the new ring too.
+func (h *HealthChecker) SetRing(r *Ring) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r == nil {
+		for name := range h.states {
+			healthEjected.Delete(name)
+		}
+		h.states = make(map[string]*ServerHealth)
+		h.ring = nil
+		return nil
+	}
+
+	states := make(map[string]*ServerHealth, len(r.Servers))
+	for _, v := range r.Servers {
+		if s, ok := h.states[v.Name]; ok {
+			states[v.Name] = s
+		} else {
+			states[v.Name] = &ServerHealth{Name: v.Name, Since: h.now()}
+			healthEjected.Set(v.Name, new(expvar.Int))
+		}
+	}
+	for name := range h.states {
+		if _, ok := states[name]; !ok {
+			healthEjected.Delete(name)
+		}
+	}
+	h.states = states
+	h.ring = r
+
+	return r.SetEjected(h.ejected())
+}
+
+// Run checks the servers every Interval until ctx is done.
+func (h *HealthChecker) Run(ctx context.Context) {
+	for {
+		h.mu.Lock()
+		interval := h.conf.Interval
+		h.mu.Unlock()
+
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+
+		h.Check()
+	}
+}
+
+// Check pings all servers once and updates the ejected servers of the ring.
+func (h *HealthChecker) Check() {
+	h.mu.Lock()
+	ring, timeout := h.ring, h.conf.Timeout
+	h.mu.Unlock()
+	if ring == nil {
+		return
+	}
+
+	errs := make([]error, len(ring.Servers))
+	var wg sync.WaitGroup
+	for i, v := range ring.Servers {
+		wg.Add(1)
+		go func(i int, s *Memcached) {
+			defer wg.Done()
+			errs[i] = ping(s, timeout)
+		}(i, v)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.ring != ring {
+		// SetRing replaced the ring while checking
+		return
+	}
+
+	changed := false
+	for i, v := range ring.Servers {
+		if h.update(h.states[v.Name], errs[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := ring.SetEjected(h.ejected()); err != nil {
+		logger.Log.Infow("failed to eject the servers", "err", err)
+	}
+}
+
+// update applies the result of the ping to s and reports whether s is ejected or rejoined. h.mu must be held.
+func (h *HealthChecker) update(s *ServerHealth, err error) bool {
+	if err != nil {
+		healthCheckFailures.Add(s.Name, 1)
+		s.Failures++
+		s.Successes = 0
+		s.LastError = err.Error()
+		if s.Ejected || s.Failures < h.conf.FailureThreshold {
+			return false
+		}
+
+		s.Ejected = true
+		s.Since = h.now()
+		healthEjections.Add(s.Name, 1)
+		healthEjected.Get(s.Name).(*expvar.Int).Set(1)
+		logger.Log.Infow("server ejected", "server", s.Name, "failures", s.Failures, "err", err)
+		return true
+	}
+
+	s.Successes++
+	s.Failures = 0
+	if !s.Ejected || s.Successes < h.conf.SuccessThreshold {
+		return false
+	}
+
+	s.Ejected = false
+	s.Since = h.now()
+	s.LastError = ""
+	healthEjected.Get(s.Name).(*expvar.Int).Set(0)
+	logger.Log.Infow("server rejoined", "server", s.Name, "successes", s.Successes)
+	return true
+}
+
+// ejected returns the names of the ejected servers. h.mu must be held.
+func (h *HealthChecker) ejected() []string {
+	var names []string
+	for name, v := range h.states {
+		if v.Ejected {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Status returns the health of each server ordered by the name.
+func (h *HealthChecker) Status() []ServerHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := make([]ServerHealth, 0, len(h.states))
+	for _, v := range h.states {
+		status = append(status, *v)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+
+	return status
+}
+
+func ping(s *Memcached, timeout time.Duration) error {
+	if s.Client == nil {
+		return errNotConnected
+	}
+	// The connection which failed is dialed again, so the server which restarted can rejoin.
+	if err := s.Client.Redial(timeout); err != nil {
+		return err
+	}
+	c, err := s.Client.NoopAsync()
+	if err != nil {
+		return err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case v := <-c:
+		return v.Err
+	case <-t.C:
+		return errHealthCheckTimeout
+	}
+}
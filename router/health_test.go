@@ -0,0 +1,220 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func TestRing_SetEjected(t *testing.T) {
+	keys := newTestKeys(1000)
+
+	for _, mode := range pickerModes {
+		servers := newTestServers(5)
+		r, err := NewRingWithHash(servers, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		healthy, err := NewRingWithHash(append(append([]*Memcached{}, servers[:2]...), servers[3:]...), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := make([]string, len(keys))
+		for i, key := range keys {
+			before[i] = r.Pick(key).Name
+		}
+
+		if err := r.SetEjected([]string{servers[2].Name}); err != nil {
+			t.Fatal(err)
+		}
+		if e := r.Ejected(); !reflect.DeepEqual(e, []string{servers[2].Name}) {
+			t.Fatalf("%s: unexpected ejected servers: %v", mode, e)
+		}
+		for i, key := range keys {
+			got := r.Pick(key).Name
+			if before[i] != servers[2].Name {
+				if got != before[i] {
+					t.Fatalf("%s: the key of %s moved to %s", mode, before[i], got)
+				}
+				continue
+			}
+			if expect := healthy.Pick(key).Name; got != expect {
+				t.Fatalf("%s: expected %s but got %s", mode, expect, got)
+			}
+			for _, v := range r.PickN(key, 3) {
+				if v.Name == servers[2].Name {
+					t.Fatalf("%s: the ejected server is picked", mode)
+				}
+			}
+		}
+
+		// The keys are routed to the original owners when no server is healthy.
+		names := make([]string, len(servers))
+		for i, v := range servers {
+			names[i] = v.Name
+		}
+		if err := r.SetEjected(names); err != nil {
+			t.Fatal(err)
+		}
+		for i, key := range keys {
+			if got := r.Pick(key).Name; got != before[i] {
+				t.Fatalf("%s: expected %s but got %s", mode, before[i], got)
+			}
+		}
+	}
+}
+
+func TestRing_SetEjectedWithPicker(t *testing.T) {
+	servers := newTestServers(3)
+	r, err := NewRingWithPicker(servers, NewJump(servers))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.SetEjected([]string{servers[0].Name}); err != ErrEjectionNotSupported {
+		t.Errorf("expected ErrEjectionNotSupported but got %v", err)
+	}
+}
+
+func TestHealthChecker(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	h := NewHealthChecker(HealthConfig{Timeout: 50 * time.Millisecond, FailureThreshold: 2, SuccessThreshold: 2})
+	if err := h.SetRing(c.Ring); err != nil {
+		t.Fatal(err)
+	}
+
+	ejected := func(expect ...string) {
+		t.Helper()
+
+		if e := c.Ring.Ejected(); len(e) != len(expect) || (len(e) > 0 && !reflect.DeepEqual(e, expect)) {
+			t.Fatalf("expected %v are ejected but got %v", expect, e)
+		}
+	}
+
+	h.Check()
+	ejected()
+
+	// A single failure doesn't eject the server.
+	c.servers["server1"].Pause()
+	h.Check()
+	ejected()
+	c.servers["server1"].Resume()
+	h.Check()
+	c.servers["server1"].Pause()
+	h.Check()
+	ejected()
+
+	h.Check()
+	ejected("server1")
+	for _, key := range newTestKeys(100) {
+		if c.Ring.Pick(key).Name == "server1" {
+			t.Fatal("the ejected server is picked")
+		}
+	}
+	status := h.Status()
+	if !status[1].Ejected || status[1].LastError == "" {
+		t.Errorf("unexpected status: %+v", status[1])
+	}
+
+	// The ejected server rejoins after 2 successes.
+	c.servers["server1"].Resume()
+	h.Check()
+	ejected("server1")
+	h.Check()
+	ejected()
+
+	// The health is kept across the rings.
+	c.servers["server2"].Pause()
+	h.Check()
+	h.Check()
+	ejected("server2")
+	ring, err := NewRing(c.Ring.Servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.SetRing(ring); err != nil {
+		t.Fatal(err)
+	}
+	if e := ring.Ejected(); !reflect.DeepEqual(e, []string{"server2"}) {
+		t.Errorf("expected server2 is ejected from the new ring but got %v", e)
+	}
+	c.servers["server2"].Resume()
+}
+
+func TestHealthChecker_Restart(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	h := NewHealthChecker(HealthConfig{Timeout: 50 * time.Millisecond, FailureThreshold: 1, SuccessThreshold: 1})
+	if err := h.SetRing(c.Ring); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := c.servers["server1"].Addr
+	c.servers["server1"].Close()
+	h.Check()
+	if e := c.Ring.Ejected(); !reflect.DeepEqual(e, []string{"server1"}) {
+		t.Fatalf("expected server1 is ejected but got %v", e)
+	}
+
+	// The server restarts on the same address.
+	s, err := memcachedtest.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	h.Check()
+	if e := c.Ring.Ejected(); len(e) != 0 {
+		t.Fatalf("expected server1 rejoins but got %v", e)
+	}
+
+	// The requests are routed to the new connection.
+	for _, key := range newTestKeys(100) {
+		if c.Ring.Pick(key).Name == "server1" {
+			c.set(t, string(key), "value")
+			if _, ok := s.Value(string(key)); !ok {
+				t.Fatalf("%s is not written to the restarted server", key)
+			}
+			break
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	h := NewHealthChecker(HealthConfig{FailureThreshold: 1})
+	if err := h.SetRing(c.Ring); err != nil {
+		t.Fatal(err)
+	}
+	c.servers["server0"].Pause()
+	h.Check()
+	c.servers["server0"].Resume()
+
+	w := httptest.NewRecorder()
+	NewAdminHandler(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", w.Code)
+	}
+	var res struct {
+		Servers []ServerHealth `json:"servers"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Servers) != 2 || !res.Servers[0].Ejected || res.Servers[1].Ejected {
+		t.Errorf("unexpected health: %+v", res.Servers)
+	}
+
+	w = httptest.NewRecorder()
+	NewAdminHandler(h).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	var vars map[string]json.RawMessage
+	if err := json.NewDecoder(w.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := vars["router_health_ejected"]; !ok {
+		t.Error("router_health_ejected is not exported")
+	}
+}
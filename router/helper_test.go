@@ -0,0 +1,27 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func newTestMemcached(t *testing.T, name string) *Memcached {
+	m, _ := newTestMemcachedServer(t, name)
+	return m
+}
+
+func newTestMemcachedServer(t *testing.T, name string) (*Memcached, *memcachedtest.Server) {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	host, port := s.Host()
+	m := NewMemcached(name, host, port, StatusNormal, PhaseReadWrite)
+	if m == nil {
+		t.Fatal("failed to connect")
+	}
+
+	return m, s
+}
@@ -0,0 +1,99 @@
+package router
+
+// Jump is the jump consistent hash. The key is owned by the bucket and each server has the buckets as many as its weight.
+// The buckets are ordered by Servers.
+// Jump has no table, so it is fast and has no memory overhead, but the servers can't be removed from the middle of the list.
+//
+// The successor of the migrating server is the bucket of the key among the buckets of the other servers in the same order.
+// Only the keys of the migrating server move if its buckets are the last buckets.
+// Add the new server to the end of the list and delete the last server,
+// otherwise the keys of the servers after the migrating server move too and are not migrated.
+type Jump struct {
+	Servers []*Memcached
+
+	// buckets is the index of the server of each bucket.
+	buckets []int
+	// without is the buckets without the migrating server.
+	without map[int][]int
+	routes  *routes
+}
+
+func NewJump(servers []*Memcached) *Jump {
+	var buckets []int
+	for i, v := range servers {
+		for w := 0; w < v.weight(); w++ {
+			buckets = append(buckets, i)
+		}
+	}
+
+	without := make(map[int][]int)
+	for i, v := range servers {
+		if v.Status == StatusNormal || len(servers) == 1 {
+			continue
+		}
+		b := make([]int, 0, len(buckets)-v.weight())
+		for _, s := range buckets {
+			if s != i {
+				b = append(b, s)
+			}
+		}
+		without[i] = b
+	}
+
+	return &Jump{Servers: servers, buckets: buckets, without: without, routes: newRoutes(servers)}
+}
+
+func (j *Jump) Pick(key []byte) *Memcached {
+	if len(j.buckets) == 0 {
+		return nil
+	}
+
+	h := hash64(key)
+	owner := j.buckets[jumpHash(h, len(j.buckets))]
+	return j.routes.get(j.Servers, owner, func() int {
+		b, ok := j.without[owner]
+		if !ok {
+			return -1
+		}
+		return b[jumpHash(h, len(b))]
+	})
+}
+
+// PickN returns the routing entry of the owner and the servers which follow the owner in Servers.
+// The servers are distinct and the number is at most n. The replicas always serve the reads and writes.
+func (j *Jump) PickN(key []byte, n int) []*Memcached {
+	if len(j.buckets) == 0 || n < 1 {
+		return nil
+	}
+
+	owner := j.buckets[jumpHash(hash64(key), len(j.buckets))]
+	result := []*Memcached{j.Pick(key)}
+	for k := 1; k < len(j.Servers) && len(result) < n; k++ {
+		result = append(result, j.routes.normal[(owner+k)%len(j.Servers)])
+	}
+
+	return result
+}
+
+// Share returns the ratio of the buckets of each server. Jump distributes the keys to the buckets uniformly.
+func (j *Jump) Share() map[string]float64 {
+	share := make(map[string]float64)
+	for _, i := range j.buckets {
+		share[j.Servers[i].Name] += 1 / float64(len(j.buckets))
+	}
+
+	return share
+}
+
+// jumpHash returns the bucket of key in [0, buckets).
+// See "A Fast, Minimal Memory, Consistent Hash Algorithm" by John Lamping and Eric Veach.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
@@ -0,0 +1,64 @@
+package router
+
+// Location is the servers which serve a key.
+type Location struct {
+	// Owner is the routing entry of the owner of the key in the ring. It may be ejected.
+	Owner *Memcached
+	// Primary and Secondary are the servers of the routing entry of the key during the migration.
+	// Secondary is nil if the routing entry is not migrating. See Memcached.PrimarySecondary.
+	Primary   *Memcached
+	Secondary *Memcached
+	// Gutter is the routing entry of the gutter which serves the key while the owner is down. It is nil if the owner is up.
+	Gutter *Memcached
+	// Reads are the servers which are read in order until the key is found.
+	Reads []*Memcached
+	// Writes are the servers which receive the writes.
+	Writes []*Memcached
+	// Deletes are the servers which receive the deletes.
+	Deletes []*Memcached
+}
+
+// Locate returns the servers which serve key by the same routing as the requests.
+// It returns nil if the ring has no server.
+func (c *Cluster) Locate(key []byte) *Location {
+	routes := c.routes(key)
+	if len(routes) == 0 || routes[0] == nil {
+		return nil
+	}
+
+	l := &Location{Owner: c.Ring.Picker.Pick(key)}
+	l.Primary, l.Secondary = l.Owner.PrimarySecondary()
+	var gutterDeletes []*Memcached
+	if g := c.gutterRoute(key); g != nil {
+		l.Gutter = g
+		l.Reads = []*Memcached{g.ReadServer()}
+		routes = []*Memcached{g}
+	} else {
+		l.Reads, _ = c.readServers(key)
+		if c.Gutter != nil {
+			// The deletes go to the gutter even if the owner is up
+			gutterDeletes = deleteServers(c.Gutter.Ring.Pick(key))
+		}
+	}
+	for _, v := range routes {
+		primary, copied := v.writeServers()
+		l.Writes = append(l.Writes, primary)
+		if copied != nil {
+			l.Writes = append(l.Writes, copied)
+		}
+		l.Deletes = append(l.Deletes, deleteServers(v)...)
+	}
+	l.Deletes = append(l.Deletes, gutterDeletes...)
+
+	return l
+}
+
+// deleteServers returns the servers which receive the deletes of m.
+func deleteServers(m *Memcached) []*Memcached {
+	primary, secondary := m.PrimarySecondary()
+	if secondary != nil {
+		return []*Memcached{primary, secondary}
+	}
+
+	return []*Memcached{primary}
+}
@@ -0,0 +1,150 @@
+package router
+
+import (
+	"errors"
+	"math/big"
+)
+
+// DefaultMaglevTableSize is the size of the lookup table. The table should be much larger than the number of the servers.
+const DefaultMaglevTableSize = 65537
+
+var ErrInvalidTableSize = errors.New("router: table size must be prime")
+
+// Maglev is the lookup table of Maglev. Each server fills the table by its own permutation of the slots in turn.
+// The server takes the slots as many as its weight in each turn, so the number of the slots is proportional to the weight. The key is owned by the server of the slot of the hash.
+// Pick is O(1) but the table is rebuilt when the servers are changed.
+//
+// The successor of the migrating server is the owner of the slot in the table which is built without the migrating server.
+// Maglev doesn't guarantee the minimal disruption. A few slots of the other servers change too
+// and the keys of them are not migrated.
+type Maglev struct {
+	Servers []*Memcached
+
+	// owners is the index of the server of each slot.
+	owners []int
+	// table is the routing entry of each slot.
+	table  []*Memcached
+	routes *routes
+}
+
+// NewMaglev builds the lookup table of servers. size must be prime.
+func NewMaglev(servers []*Memcached, size int) (*Maglev, error) {
+	if size < 2 || !big.NewInt(int64(size)).ProbablyPrime(0) {
+		return nil, ErrInvalidTableSize
+	}
+	m := &Maglev{Servers: servers}
+	if len(servers) == 0 {
+		return m, nil
+	}
+
+	all := make([]int, len(servers))
+	for i := range servers {
+		all[i] = i
+	}
+	owners := maglevTable(servers, all, size)
+	m.owners = owners
+
+	// successors[i] is the table without the i-th server if it is migrating.
+	successors := make(map[int][]int)
+	for i, v := range servers {
+		if v.Status == StatusNormal || len(servers) == 1 {
+			continue
+		}
+		others := make([]int, 0, len(servers)-1)
+		for _, j := range all {
+			if j != i {
+				others = append(others, j)
+			}
+		}
+		successors[i] = maglevTable(servers, others, size)
+	}
+
+	r := newRoutes(servers)
+	m.routes = r
+	m.table = make([]*Memcached, size)
+	for slot, owner := range owners {
+		m.table[slot] = r.get(servers, owner, func() int {
+			if s, ok := successors[owner]; ok {
+				return s[slot]
+			}
+			return -1
+		})
+	}
+
+	return m, nil
+}
+
+func (m *Maglev) Pick(key []byte) *Memcached {
+	if len(m.table) == 0 {
+		return nil
+	}
+
+	return m.table[hash64(key)%uint64(len(m.table))]
+}
+
+// PickN returns the routing entry of the owner and the owners of the following slots.
+// The servers are distinct and the number is at most n. The replicas always serve the reads and writes.
+func (m *Maglev) PickN(key []byte, n int) []*Memcached {
+	if len(m.table) == 0 || n < 1 {
+		return nil
+	}
+
+	slot := hash64(key) % uint64(len(m.table))
+	result := []*Memcached{m.table[slot]}
+	seen := map[int]struct{}{m.owners[slot]: {}}
+	for i := uint64(1); i < uint64(len(m.owners)) && len(result) < n && len(seen) < len(m.Servers); i++ {
+		owner := m.owners[(slot+i)%uint64(len(m.owners))]
+		if _, ok := seen[owner]; ok {
+			continue
+		}
+		seen[owner] = struct{}{}
+		result = append(result, m.routes.normal[owner])
+	}
+
+	return result
+}
+
+// Share returns the ratio of the slots of each server.
+func (m *Maglev) Share() map[string]float64 {
+	share := make(map[string]float64)
+	for _, i := range m.owners {
+		share[m.Servers[i].Name] += 1 / float64(len(m.owners))
+	}
+
+	return share
+}
+
+// maglevTable fills the table of size by the permutations of servers[i] for each i in indexes.
+// The permutation of the server depends only on its name, so the tables which differ by one server are similar.
+func maglevTable(servers []*Memcached, indexes []int, size int) []int {
+	offsets := make([]uint64, len(indexes))
+	skips := make([]uint64, len(indexes))
+	for n, i := range indexes {
+		h := hash64([]byte(servers[i].Name))
+		offsets[n] = h % uint64(size)
+		skips[n] = mix64(h)%uint64(size-1) + 1
+	}
+
+	table := make([]int, size)
+	for i := range table {
+		table[i] = -1
+	}
+	next := make([]uint64, len(indexes))
+	filled := 0
+	for filled < size {
+		for n, i := range indexes {
+			for w := 0; w < servers[i].weight() && filled < size; w++ {
+				c := (offsets[n] + next[n]*skips[n]) % uint64(size)
+				for table[c] >= 0 {
+					next[n]++
+					c = (offsets[n] + next[n]*skips[n]) % uint64(size)
+				}
+				table[c] = i
+				next[n]++
+				filled++
+			}
+		}
+	}
+
+	return table
+}
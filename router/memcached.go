@@ -1,6 +1,9 @@
 package router
 
 import (
+	"net"
+	"strconv"
+
 	"github.com/f110/memcached-operator/client"
 )
 
@@ -12,6 +15,19 @@ const (
 
 type Status int
 
+func (s Status) String() string {
+	switch s {
+	case StatusNormal:
+		return "normal"
+	case StatusAdding:
+		return "adding"
+	case StatusDeleting:
+		return "deleting"
+	default:
+		return "unknown"
+	}
+}
+
 const (
 	PhaseDeleteOnly Phase = iota
 	PhaseWriteOnly
@@ -20,6 +36,19 @@ const (
 
 type Phase int
 
+func (p Phase) String() string {
+	switch p {
+	case PhaseDeleteOnly:
+		return "delete-only"
+	case PhaseWriteOnly:
+		return "write-only"
+	case PhaseReadWrite:
+		return "read-write"
+	default:
+		return "unknown"
+	}
+}
+
 const (
 	ModeDeleteOnly Mode = iota
 	ModeWriteOnly
@@ -28,109 +57,143 @@ const (
 
 type Mode int
 
+func (m Mode) String() string {
+	switch m {
+	case ModeDeleteOnly:
+		return "delete-only"
+	case ModeWriteOnly:
+		return "write-only"
+	case ModeReadWrite:
+		return "read-write"
+	default:
+		return "unknown"
+	}
+}
+
 type Memcached struct {
 	Name   string
 	Host   string
 	Port   int
+	Socket string
+	// Weight is the relative share of the keyspace. Zero or less is treated as 1.
+	Weight int
 	Status Status
 	Phase  Phase
 	Mode   Mode
 
-	Client *client.Client
+	Client  *client.Client
+	Breaker *Breaker
 
 	hash uint32
 	next *Memcached
 }
 
 func NewMemcached(name, host string, port int, status Status, phase Phase) *Memcached {
-	c, err := client.NewClient(host, port)
-	if err != nil {
-		return nil
-	}
-
-	return &Memcached{
+	m := &Memcached{
 		Name:   name,
 		Host:   host,
 		Port:   port,
 		Status: status,
 		Phase:  phase,
-		Client: c,
 	}
+	if err := m.Connect(); err != nil {
+		return nil
+	}
+
+	return m
+}
+
+// Addr returns the address of the server which can be passed to client.Dial.
+// Socket takes precedence over Host and Port.
+func (m *Memcached) Addr() string {
+	if m.Socket != "" {
+		return "unix://" + m.Socket
+	}
+
+	return net.JoinHostPort(m.Host, strconv.Itoa(m.Port))
+}
+
+func (m *Memcached) weight() int {
+	if m.Weight <= 0 {
+		return 1
+	}
+
+	return m.Weight
+}
+
+func (m *Memcached) Connect() error {
+	c, err := client.Dial(m.Addr())
+	if err != nil {
+		return err
+	}
+	m.Client = c
+
+	return nil
 }
 
 func (m *Memcached) Get(key []byte) (<-chan *client.Item, error) {
+	return m.ReadServer().get(key)
+}
+
+// GetMulti gets keys from the server which serves the reads of m.
+// The returned map doesn't have the keys which are not found.
+func (m *Memcached) GetMulti(keys [][]byte) (map[string]*client.Item, error) {
+	return m.ReadServer().getMulti(keys)
+}
+
+// ReadServer returns the server which serves the reads of m.
+func (m *Memcached) ReadServer() *Memcached {
 	if m.Mode != ModeReadWrite {
 		if m.next.Mode == ModeReadWrite {
-			return m.next.Client.GetAsync(key)
+			return m.next
 		} else {
 			panic("unreachable")
 		}
 	}
 
-	return m.Client.GetAsync(key)
+	return m
 }
 
 func (m *Memcached) Set(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
-	primary, secondary := m.PrimarySecondary()
+	primary, copied := m.writeServers()
 
-	result, err := primary.Client.SetAsync(key, value, cas, flag, expiration)
+	result, err := primary.set(key, value, cas, flag, expiration)
 	if err != nil {
 		return nil, err
 	}
 
-	if secondary != nil && secondary.Mode == ModeWriteOnly {
-		v := <-result
-		if v.Err != nil {
-			return nil, err
-		}
-		c := make(chan *client.Item, 1)
-		c <- v
-		_, err = secondary.Client.SetAsync(key, v.Value, 0, nil, expiration)
-		return c, err
+	if copied != nil {
+		return copyWrite(result, copied, key, value, flag, expiration)
 	}
 
 	return result, nil
 }
 
 func (m *Memcached) Add(key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
-	primary, secondary := m.PrimarySecondary()
+	primary, copied := m.writeServers()
 
-	result, err := primary.Client.AddAsync(key, value, flag, expiration)
+	result, err := primary.add(key, value, flag, expiration)
 	if err != nil {
 		return nil, err
 	}
 
-	if secondary != nil && secondary.Mode == ModeWriteOnly {
-		v := <-result
-		if v.Err != nil {
-			return nil, err
-		}
-		c := make(chan *client.Item, 1)
-		c <- v
-		_, err = secondary.Client.SetAsync(key, v.Value, 0, nil, expiration)
-		return c, err
+	if copied != nil {
+		return copyWrite(result, copied, key, value, flag, expiration)
 	}
 
 	return result, err
 }
 
 func (m *Memcached) Replace(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
-	primary, secondary := m.PrimarySecondary()
+	primary, copied := m.writeServers()
 
-	result, err := primary.Client.ReplaceAsync(key, value, cas, flag, expiration)
+	result, err := primary.replace(key, value, cas, flag, expiration)
 	if err != nil {
 		return nil, err
 	}
 
-	if secondary != nil && secondary.Mode == ModeWriteOnly {
-		v := <-result
-		if v.Err != nil {
-			return nil, err
-		}
-		c := make(chan *client.Item, 1)
-		c <- v
-		_, err = secondary.Client.SetAsync(key, v.Value, 0, nil, expiration)
-		return c, err
+	if copied != nil {
+		return copyWrite(result, copied, key, value, flag, expiration)
 	}
 
 	return result, err
@@ -139,13 +202,13 @@ func (m *Memcached) Replace(key, value []byte, cas uint64, flag []byte, expirati
 func (m *Memcached) Del(key []byte) (<-chan *client.Item, error) {
 	primary, secondary := m.PrimarySecondary()
 
-	res, err := primary.Client.DelAsync(key)
+	res, err := primary.del(key)
 	if err != nil {
 		return nil, err
 	}
 
 	if secondary != nil {
-		_, err = secondary.Client.DelAsync(key)
+		_, err = secondary.del(key)
 		if err != nil {
 			return res, err
 		}
@@ -154,50 +217,162 @@ func (m *Memcached) Del(key []byte) (<-chan *client.Item, error) {
 	return res, err
 }
 
-func (m *Memcached) Incr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+// DelCAS deletes key only if the CAS value of the item is cas. The secondary is deleted without CAS.
+func (m *Memcached) DelCAS(key []byte, cas uint64) (<-chan *client.Item, error) {
 	primary, secondary := m.PrimarySecondary()
 
-	res, err := primary.Client.IncrAsync(key, delta, initial, expiration)
+	res, err := primary.delCAS(key, cas)
 	if err != nil {
 		return nil, err
 	}
 
-	if secondary != nil && secondary.Mode == ModeWriteOnly {
-		v := <-res
-		if v.Err != nil {
-			return nil, v.Err
+	if secondary != nil {
+		_, err = secondary.del(key)
+		if err != nil {
+			return res, err
 		}
-		c := make(chan *client.Item, 1)
-		c <- v
-		_, err = secondary.Client.SetAsync(key, v.Value, 0, nil, expiration)
-		return c, err
+	}
+
+	return res, err
+}
+
+// Append appends value to the item.
+// The secondary may not have the item during the migration, so the item is deleted from the secondary instead.
+func (m *Memcached) Append(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	primary, secondary := m.PrimarySecondary()
+
+	res, err := primary.append(key, value, cas)
+	if err != nil {
+		return nil, err
+	}
+
+	if secondary != nil {
+		_, err = secondary.del(key)
+	}
+	return res, err
+}
+
+// Prepend prepends value to the item. The item is deleted from the secondary as Append.
+func (m *Memcached) Prepend(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	primary, secondary := m.PrimarySecondary()
+
+	res, err := primary.prepend(key, value, cas)
+	if err != nil {
+		return nil, err
+	}
+
+	if secondary != nil {
+		_, err = secondary.del(key)
+	}
+	return res, err
+}
+
+// Touch changes the expiration of the item on both of the primary and the secondary.
+func (m *Memcached) Touch(key []byte, expiration int) (<-chan *client.Item, error) {
+	primary, secondary := m.PrimarySecondary()
+
+	res, err := primary.touch(key, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	if secondary != nil {
+		_, err = secondary.touch(key, expiration)
+	}
+	return res, err
+}
+
+// GAT gets the item from the server which serves the reads of m and changes its expiration.
+// The item of the secondary is touched too.
+func (m *Memcached) GAT(key []byte, expiration int) (<-chan *client.Item, error) {
+	primary, secondary := m.PrimarySecondary()
+
+	res, err := primary.gat(key, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	if secondary != nil {
+		_, err = secondary.touch(key, expiration)
+	}
+	return res, err
+}
+
+func (m *Memcached) Incr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+	primary, copied := m.writeServers()
+
+	res, err := primary.incr(key, delta, initial, expiration)
+	if err != nil {
+		return nil, err
+	}
+
+	if copied != nil {
+		return copyCounter(res, copied, key, expiration)
 	}
 
 	return res, nil
 }
 
 func (m *Memcached) Decr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
-	primary, secondary := m.PrimarySecondary()
+	primary, copied := m.writeServers()
 
-	res, err := primary.Client.DecrAsync(key, delta, initial, expiration)
+	res, err := primary.decr(key, delta, initial, expiration)
 	if err != nil {
 		return nil, err
 	}
 
-	if secondary != nil && secondary.Mode == ModeWriteOnly {
-		v := <-res
-		if v.Err != nil {
-			return nil, v.Err
-		}
-		c := make(chan *client.Item, 1)
-		c <- v
-		_, err = secondary.Client.SetAsync(key, v.Value, 0, nil, expiration)
-		return c, err
+	if copied != nil {
+		return copyCounter(res, copied, key, expiration)
 	}
 
 	return res, nil
 }
 
+// copyWrite writes the value to the secondary if the write to the primary succeeded.
+func copyWrite(res <-chan *client.Item, secondary *Memcached, key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
+	v := <-res
+	c := make(chan *client.Item, 1)
+	c <- v
+
+	if v.Err != nil {
+		return c, nil
+	}
+	_, err := secondary.set(key, value, 0, flag, expiration)
+	return c, err
+}
+
+// copyCounter writes the result of incr or decr to the secondary.
+// The response has the binary representation of the counter, but memcached stores the counter as the decimal string.
+// The result is not copied if expiration is client.ExpirationNoCreate because the TTL of the existing item is unknown.
+func copyCounter(res <-chan *client.Item, secondary *Memcached, key []byte, expiration int) (<-chan *client.Item, error) {
+	v := <-res
+	c := make(chan *client.Item, 1)
+	c <- v
+
+	n, err := v.Counter()
+	if err != nil || expiration == client.ExpirationNoCreate {
+		return c, nil
+	}
+	_, err = secondary.set(key, []byte(strconv.FormatUint(n, 10)), 0, make([]byte, 4), expiration)
+	return c, err
+}
+
+// oldOwner returns the server which has the keys of m before the migration if the reads have moved to the new owner.
+// The keys which are not written during the write-only phase are only on the old owner.
+func (m *Memcached) oldOwner() *Memcached {
+	if m.next == nil || m.Phase != PhaseReadWrite {
+		return nil
+	}
+
+	switch m.Status {
+	case StatusAdding:
+		return m.next
+	case StatusDeleting:
+		return m
+	}
+	return nil
+}
+
 func (m *Memcached) Dup() *Memcached {
 	c := &Memcached{}
 	*c = *m
@@ -215,3 +390,111 @@ func (m *Memcached) PrimarySecondary() (primary, secondary *Memcached) {
 
 	return
 }
+
+// writeServers returns the server which receives the writes of m and the server which the writes are copied to.
+// The writes are copied to the secondary only while it is write-only.
+func (m *Memcached) writeServers() (primary, copied *Memcached) {
+	primary, secondary := m.PrimarySecondary()
+	if secondary != nil && secondary.Mode == ModeWriteOnly {
+		return primary, secondary
+	}
+
+	return primary, nil
+}
+
+// send sends the request to the server through the circuit breaker if the server has it.
+func (m *Memcached) send(kind opKind, f func() (<-chan *client.Item, error)) (<-chan *client.Item, error) {
+	if m.Breaker == nil {
+		return f()
+	}
+
+	return m.Breaker.call(kind, f)
+}
+
+func (m *Memcached) get(key []byte) (<-chan *client.Item, error) {
+	return m.send(opRead, func() (<-chan *client.Item, error) {
+		return m.Client.GetAsync(key)
+	})
+}
+
+func (m *Memcached) getMulti(keys [][]byte) (map[string]*client.Item, error) {
+	if m.Breaker == nil {
+		return m.Client.GetMulti(keys)
+	}
+
+	if !m.Breaker.Allow() {
+		if v := m.Breaker.rejected(opRead); v.Status != client.StatusKeyNotFound {
+			return nil, v.Err
+		}
+		return map[string]*client.Item{}, nil
+	}
+	items, err := m.Client.GetMulti(keys)
+	m.Breaker.Done(err == nil)
+	return items, err
+}
+
+func (m *Memcached) set(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.SetAsync(key, value, cas, flag, expiration)
+	})
+}
+
+func (m *Memcached) add(key, value, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.AddAsync(key, value, flag, expiration)
+	})
+}
+
+func (m *Memcached) replace(key, value []byte, cas uint64, flag []byte, expiration int) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.ReplaceAsync(key, value, cas, flag, expiration)
+	})
+}
+
+func (m *Memcached) del(key []byte) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.DelAsync(key)
+	})
+}
+
+func (m *Memcached) delCAS(key []byte, cas uint64) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.DelCASAsync(key, cas)
+	})
+}
+
+func (m *Memcached) append(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.AppendAsync(key, value, cas)
+	})
+}
+
+func (m *Memcached) prepend(key, value []byte, cas uint64) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.PrependAsync(key, value, cas)
+	})
+}
+
+func (m *Memcached) touch(key []byte, expiration int) (<-chan *client.Item, error) {
+	return m.send(opWrite, func() (<-chan *client.Item, error) {
+		return m.Client.TouchAsync(key, expiration)
+	})
+}
+
+func (m *Memcached) gat(key []byte, expiration int) (<-chan *client.Item, error) {
+	return m.send(opRead, func() (<-chan *client.Item, error) {
+		return m.Client.GATAsync(key, expiration)
+	})
+}
+
+func (m *Memcached) incr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+	return m.send(opCounter, func() (<-chan *client.Item, error) {
+		return m.Client.IncrAsync(key, delta, initial, expiration)
+	})
+}
+
+func (m *Memcached) decr(key []byte, delta, initial int64, expiration int) (<-chan *client.Item, error) {
+	return m.send(opCounter, func() (<-chan *client.Item, error) {
+		return m.Client.DecrAsync(key, delta, initial, expiration)
+	})
+}
@@ -0,0 +1,52 @@
+package router
+
+import "testing"
+
+func TestMemcached_Addr(t *testing.T) {
+	cases := []struct {
+		Server *Memcached
+		Addr   string
+	}{
+		{Server: &Memcached{Host: "127.0.0.1", Port: 11211}, Addr: "127.0.0.1:11211"},
+		{Server: &Memcached{Host: "::1", Port: 11211}, Addr: "[::1]:11211"},
+		{Server: &Memcached{Socket: "/var/run/memcached.sock"}, Addr: "unix:///var/run/memcached.sock"},
+		{Server: &Memcached{Host: "127.0.0.1", Port: 11211, Socket: "/var/run/memcached.sock"}, Addr: "unix:///var/run/memcached.sock"},
+	}
+
+	for _, c := range cases {
+		if a := c.Server.Addr(); a != c.Addr {
+			t.Errorf("expected %s but got %s", c.Addr, a)
+		}
+	}
+}
+
+func TestMemcached_IncrWriteOnlySecondary(t *testing.T) {
+	primary := newTestMemcached(t, "primary")
+	secondary := newTestMemcached(t, "secondary")
+	primary.Mode = ModeReadWrite
+	secondary.Mode = ModeWriteOnly
+	primary.next = secondary
+
+	for i := 1; i <= 2; i++ {
+		res, err := primary.Incr([]byte("counter"), 1, 1, 60)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := (<-res).Counter()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != uint64(i) {
+			t.Fatalf("expected %d but got %d", i, v)
+		}
+	}
+
+	// The counter of the secondary must be numeric
+	n, err := secondary.Client.Incr([]byte("counter"), 1, 0, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("expected 3 but got %d", n)
+	}
+}
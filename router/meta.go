@@ -0,0 +1,349 @@
+package router
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// maxOpaqueLength is the maximum length of the opaque token of the meta commands.
+const maxOpaqueLength = 32
+
+var (
+	metaInvalidFlag = []byte("CLIENT_ERROR invalid flag\r\n")
+	metaBadKey      = []byte("CLIENT_ERROR error decoding key\r\n")
+)
+
+// metaRequest is the key and the flags of the meta command.
+type metaRequest struct {
+	// Key is the decoded key. RawKey is the key in the command line which is returned by the k flag.
+	Key    []byte
+	RawKey []byte
+	// Flags are the flags in the order of the command line. The return flags are returned in this order.
+	Flags [][]byte
+	Quiet bool
+}
+
+// parseMeta parses the key and the flags of the meta command. allowed is the set of the flags which the command supports.
+// If the command line is invalid, it returns the error response.
+func parseMeta(key []byte, flags [][]byte, allowed string) (*metaRequest, []byte) {
+	m := &metaRequest{Key: key, RawKey: key, Flags: flags}
+	for _, f := range flags {
+		if !strings.ContainsRune(allowed, rune(f[0])) {
+			return nil, metaInvalidFlag
+		}
+		switch f[0] {
+		case 'b':
+			k, err := base64.StdEncoding.DecodeString(string(key))
+			if err != nil || len(k) == 0 {
+				return nil, metaBadKey
+			}
+			m.Key = k
+		case 'q':
+			m.Quiet = true
+		case 'O':
+			if len(f)-1 > maxOpaqueLength {
+				return nil, textBadFormat
+			}
+		}
+	}
+	if len(m.Key) > maxKeyLength {
+		return nil, textBadFormat
+	}
+
+	return m, nil
+}
+
+// flag returns the argument of the flag and whether the flag is given.
+func (m *metaRequest) flag(name byte) (string, bool) {
+	for _, f := range m.Flags {
+		if f[0] == name {
+			return string(f[1:]), true
+		}
+	}
+
+	return "", false
+}
+
+// intFlag returns the numeric argument of the flag. If the flag is not given, it returns def.
+func (m *metaRequest) intFlag(name byte, def int64) (int64, bool) {
+	v, ok := m.flag(name)
+	if !ok {
+		return def, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return n, true
+}
+
+// response encodes the response line "<code> <flags>*\r\n".
+// The flags which return the item (c, f, s and t) are returned only if res is not nil.
+// ttl is the value of the t flag.
+func (m *metaRequest) response(code string, res *client.Item, ttl int64) []byte {
+	b := []byte(code)
+	for _, f := range m.Flags {
+		switch f[0] {
+		case 'O':
+			b = append(append(b, ' '), f...)
+		case 'k':
+			b = append(append(b, " k"...), m.RawKey...)
+		case 'b':
+			b = append(b, " b"...)
+		}
+		if res == nil {
+			continue
+		}
+		switch f[0] {
+		case 'c':
+			b = strconv.AppendUint(append(b, " c"...), res.CAS, 10)
+		case 'f':
+			var flags uint32
+			if len(res.Extra) == 4 {
+				flags = binary.BigEndian.Uint32(res.Extra)
+			}
+			b = strconv.AppendUint(append(b, " f"...), uint64(flags), 10)
+		case 's':
+			b = strconv.AppendInt(append(b, " s"...), int64(len(res.Value)), 10)
+		case 't':
+			b = strconv.AppendInt(append(b, " t"...), ttl, 10)
+		}
+	}
+
+	return append(b, "\r\n"...)
+}
+
+// value encodes the response "VA <size> <flags>*\r\n<data>\r\n".
+func (m *metaRequest) value(res *client.Item, value []byte, ttl int64) []byte {
+	line := m.response("VA "+strconv.Itoa(len(value)), res, ttl)
+	b := make([]byte, 0, len(line)+len(value)+2)
+	b = append(b, line...)
+	b = append(b, value...)
+	return append(b, "\r\n"...)
+}
+
+// metaGet processes "mg <key> <flags>*".
+// The binary protocol doesn't return the remaining TTL of the item,
+// so the t flag returns the TTL which is updated by the T flag, or -1 if the T flag is not given.
+// -1 is the value of memcached for the item which never expires, so the clients treat the unknown TTL as no expiration.
+func (s *Router) metaGet(args [][]byte) *pending {
+	if len(args) == 0 {
+		return &pending{raw: textBadFormat}
+	}
+	m, errResponse := parseMeta(args[0], args[1:], "bcfkOqstvT")
+	if errResponse != nil {
+		return &pending{raw: errResponse}
+	}
+	ttl, ok := m.intFlag('T', -1)
+	if !ok {
+		return &pending{raw: textBadFormat}
+	}
+	_, touch := m.flag('T')
+	_, withValue := m.flag('v')
+
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		if touch {
+			return c.GAT(m.Key, textExpiration(ttl))
+		}
+		return c.Get(m.Key)
+	}, func(res *client.Item) []byte {
+		switch {
+		case res.Status == client.StatusKeyNotFound:
+			if m.Quiet {
+				return nil
+			}
+			return m.response("EN", nil, 0)
+		case res.Err != nil:
+			return textServerError(res)
+		case withValue:
+			return m.value(res, res.Value, ttl)
+		default:
+			return m.response("HD", res, ttl)
+		}
+	})
+}
+
+// metaSet processes "ms <key> <datalen> <flags>*" and its data block.
+func (s *Router) metaSet(r *bufio.Reader, args [][]byte) (*pending, error) {
+	if len(args) < 2 {
+		return &pending{raw: textBadFormat}, nil
+	}
+	size, err := strconv.Atoi(string(args[1]))
+	if err != nil || size < 0 {
+		return &pending{raw: textBadFormat}, nil
+	}
+	// The data block is read before the flags are validated so that it is not read as the command.
+	value, p, err := s.readDataBlock(r, size)
+	if p != nil || err != nil {
+		return p, err
+	}
+
+	m, errResponse := parseMeta(args[0], args[2:], "bcCFkOqTM")
+	if errResponse != nil {
+		return &pending{raw: errResponse}, nil
+	}
+	exp, ok1 := m.intFlag('T', 0)
+	cas, ok2 := m.intFlag('C', 0)
+	flags, ok3 := m.intFlag('F', 0)
+	if !ok1 || !ok2 || !ok3 || flags < 0 || flags > 1<<32-1 {
+		return &pending{raw: textBadFormat}, nil
+	}
+	_, compare := m.flag('C')
+	mode, _ := m.flag('M')
+	if len(mode) > 1 || mode != "" && !strings.ContainsAny(mode, "EAPRSeaprs") {
+		return &pending{raw: metaInvalidFlag}, nil
+	}
+	mode = strings.ToUpper(mode)
+
+	flag := make([]byte, 4)
+	binary.BigEndian.PutUint32(flag, uint32(flags))
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		if compare && cas == 0 && mode != "E" {
+			return compareZeroCAS(c, m.Key)
+		}
+		switch mode {
+		case "E":
+			return c.Add(m.Key, value, flag, textExpiration(exp))
+		case "A":
+			return c.Append(m.Key, value, uint64(cas))
+		case "P":
+			return c.Prepend(m.Key, value, uint64(cas))
+		case "R":
+			return c.Replace(m.Key, value, uint64(cas), flag, textExpiration(exp))
+		default:
+			return c.Set(m.Key, value, uint64(cas), flag, textExpiration(exp))
+		}
+	}, func(res *client.Item) []byte {
+		switch res.Status {
+		case client.StatusNoError:
+			if m.Quiet {
+				return nil
+			}
+			return m.response("HD", res, -1)
+		case client.StatusKeyExists:
+			if mode == "E" {
+				return m.response("NS", nil, 0)
+			}
+			return m.response("EX", nil, 0)
+		case client.StatusKeyNotFound:
+			if compare {
+				return m.response("NF", nil, 0)
+			}
+			return m.response("NS", nil, 0)
+		case client.StatusItemNotStored:
+			return m.response("NS", nil, 0)
+		case client.StatusValueTooLarge:
+			return textTooLarge
+		default:
+			return textServerError(res)
+		}
+	}), nil
+}
+
+// metaDelete processes "md <key> <flags>*".
+func (s *Router) metaDelete(args [][]byte) *pending {
+	if len(args) == 0 {
+		return &pending{raw: textBadFormat}
+	}
+	m, errResponse := parseMeta(args[0], args[1:], "bCkOq")
+	if errResponse != nil {
+		return &pending{raw: errResponse}
+	}
+	cas, ok := m.intFlag('C', 0)
+	if !ok {
+		return &pending{raw: textBadFormat}
+	}
+
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		return c.DelCAS(m.Key, uint64(cas))
+	}, func(res *client.Item) []byte {
+		switch res.Status {
+		case client.StatusNoError:
+			if m.Quiet {
+				return nil
+			}
+			return m.response("HD", nil, 0)
+		case client.StatusKeyNotFound:
+			if m.Quiet {
+				return nil
+			}
+			return m.response("NF", nil, 0)
+		case client.StatusKeyExists:
+			return m.response("EX", nil, 0)
+		default:
+			return textServerError(res)
+		}
+	})
+}
+
+// metaArithmetic processes "ma <key> <flags>*".
+// The item is created by the N flag only. The t flag returns -1 because the TTL of the item is unknown.
+func (s *Router) metaArithmetic(args [][]byte) *pending {
+	if len(args) == 0 {
+		return &pending{raw: textBadFormat}
+	}
+	m, errResponse := parseMeta(args[0], args[1:], "bcNJDMOqtvk")
+	if errResponse != nil {
+		return &pending{raw: errResponse}
+	}
+	delta, ok1 := m.intFlag('D', 1)
+	initial, ok2 := m.intFlag('J', 0)
+	vivify, ok3 := m.intFlag('N', 0)
+	if !ok1 || !ok2 || !ok3 || delta < 0 || initial < 0 {
+		return &pending{raw: textBadFormat}
+	}
+	exp := client.ExpirationNoCreate
+	if _, ok := m.flag('N'); ok {
+		exp = textExpiration(vivify)
+	}
+	incr := true
+	switch mode, _ := m.flag('M'); mode {
+	case "", "I", "i", "+":
+	case "D", "d", "-":
+		incr = false
+	default:
+		return &pending{raw: metaInvalidFlag}
+	}
+	_, withValue := m.flag('v')
+
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		if incr {
+			return c.Incr(m.Key, delta, initial, exp)
+		}
+		return c.Decr(m.Key, delta, initial, exp)
+	}, func(res *client.Item) []byte {
+		switch res.Status {
+		case client.StatusNoError:
+			n, err := res.Counter()
+			if err != nil {
+				return textServerError(res)
+			}
+			if withValue {
+				return m.value(res, strconv.AppendUint(nil, n, 10), -1)
+			}
+			if m.Quiet {
+				return nil
+			}
+			return m.response("HD", res, -1)
+		case client.StatusKeyNotFound:
+			if m.Quiet {
+				return nil
+			}
+			return m.response("NF", nil, 0)
+		case client.StatusKeyExists:
+			return m.response("EX", nil, 0)
+		case client.StatusItemNotStored:
+			return m.response("NS", nil, 0)
+		case client.StatusNonNumericValue:
+			return textNonNumeric
+		default:
+			return textServerError(res)
+		}
+	})
+}
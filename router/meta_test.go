@@ -0,0 +1,86 @@
+package router
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRouter_Meta(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	r := bufio.NewReader(conn)
+
+	key := base64.StdEncoding.EncodeToString([]byte("binary\x00key"))
+	cases := []struct {
+		Request string
+		Expect  string
+	}{
+		{Request: "ms foo 3 F5 T0 Oabc k\r\nbar\r\n", Expect: "HD Oabc kfoo\r\n"},
+		{Request: "mg foo v f s Oxyz k\r\n", Expect: "VA 3 f5 s3 Oxyz kfoo\r\nbar\r\n"},
+		{Request: "mg foo\r\n", Expect: "HD\r\n"},
+		{Request: "mg missing v O1\r\n", Expect: "EN O1\r\n"},
+		{Request: "mg foo T100 t v\r\n", Expect: "VA 3 t100\r\nbar\r\n"},
+		// The remaining TTL is unknown without T.
+		{Request: "mg foo t v\r\n", Expect: "VA 3 t-1\r\nbar\r\n"},
+		{Request: "mg foo t\r\n", Expect: "HD t-1\r\n"},
+		{Request: "ms foo 1 ME\r\nx\r\n", Expect: "NS\r\n"},
+		{Request: "ms missing 1 MR\r\nx\r\n", Expect: "NS\r\n"},
+		{Request: "ms foo 3 MA\r\nbaz\r\n", Expect: "HD\r\n"},
+		{Request: "ms foo 1 MP\r\n_\r\n", Expect: "HD\r\n"},
+		{Request: "mg foo v\r\n", Expect: "VA 7\r\n_barbaz\r\n"},
+		{Request: "ms foo 1 C1\r\nx\r\n", Expect: "EX\r\n"},
+		{Request: "ms missing 1 C1\r\nx\r\n", Expect: "NF\r\n"},
+		{Request: "ms foo 1 C0\r\nx\r\n", Expect: "EX\r\n"},
+		{Request: "ms missing 1 C0\r\nx\r\n", Expect: "NF\r\n"},
+		{Request: "ms " + key + " 5 b k\r\nvalue\r\n", Expect: "HD b k" + key + "\r\n"},
+		{Request: "mg " + key + " b v\r\n", Expect: "VA 5 b\r\nvalue\r\n"},
+		{Request: "ma counter\r\n", Expect: "NF\r\n"},
+		{Request: "ma counter N0 J10 v\r\n", Expect: "VA 2\r\n10\r\n"},
+		{Request: "ma counter D5 v\r\n", Expect: "VA 2\r\n15\r\n"},
+		{Request: "ma counter MD D20 v\r\n", Expect: "VA 1\r\n0\r\n"},
+		{Request: "ma counter t v\r\n", Expect: "VA 1 t-1\r\n1\r\n"},
+		{Request: "ma foo\r\n", Expect: "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{Request: "md foo Oa\r\n", Expect: "HD Oa\r\n"},
+		{Request: "md foo\r\n", Expect: "NF\r\n"},
+		{Request: "mn\r\n", Expect: "MN\r\n"},
+		{Request: "mg foo X\r\n", Expect: "CLIENT_ERROR invalid flag\r\n"},
+		{Request: "mg !!! b\r\n", Expect: "CLIENT_ERROR error decoding key\r\n"},
+		{Request: "ms foo bar\r\n", Expect: "CLIENT_ERROR bad command line format\r\n"},
+		// The data block of the invalid flags is not read as the command.
+		{Request: "ms foo 3 MX\r\nbar\r\n", Expect: "CLIENT_ERROR invalid flag\r\n"},
+		{Request: "mg foo O" + strings.Repeat("o", 33) + "\r\n", Expect: "CLIENT_ERROR bad command line format\r\n"},
+		// The quiet mode suppresses the responses until mn.
+		{Request: "ms foo 1 q\r\na\r\nmg missing v q\r\nmd missing q\r\nmg foo v q\r\nmn\r\n", Expect: "VA 1\r\na\r\nMN\r\n"},
+		{Request: "ms foo 1 q C1\r\nb\r\nmn\r\n", Expect: "EX\r\nMN\r\n"},
+	}
+	for _, tc := range cases {
+		if _, err := io.WriteString(conn, tc.Request); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, len(tc.Expect))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("%q: %v", tc.Request, err)
+		}
+		if string(got) != tc.Expect {
+			t.Fatalf("%q: expected %q but got %q", tc.Request, tc.Expect, got)
+		}
+	}
+
+	// The CAS which is returned by c can be used by C.
+	io.WriteString(conn, "mg foo c\r\n")
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 || fields[0] != "HD" || !strings.HasPrefix(fields[1], "c") {
+		t.Fatalf("unexpected response: %q", line)
+	}
+	io.WriteString(conn, "ms foo 1 C"+fields[1][1:]+" c\r\nz\r\n")
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "HD c") || line == "HD "+fields[1]+"\r\n" {
+		t.Fatalf("unexpected response of ms: %q", line)
+	}
+}
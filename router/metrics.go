@@ -0,0 +1,25 @@
+package router
+
+import "expvar"
+
+// The metrics are exported through expvar. They are keyed by the name of the server.
+var (
+	// breakerState is the current state of the circuit breaker. (0: closed, 1: open, 2: half-open)
+	breakerState = expvar.NewMap("router_breaker_state")
+	// breakerTransitions is the number of transitions keyed by "<server>_<new state>".
+	breakerTransitions = expvar.NewMap("router_breaker_transitions")
+	// breakerRejected is the number of requests which are rejected by the open breaker.
+	breakerRejected = expvar.NewMap("router_breaker_rejected")
+	// configReloads is the number of reloads of the config keyed by "success" or "failure".
+	configReloads = expvar.NewMap("router_config_reloads")
+	// readFallbacks is the number of the reads which hit on the fallback server keyed by "replica" or "old_owner".
+	readFallbacks = expvar.NewMap("router_read_fallbacks")
+	// readRepairs is the number of the read repairs keyed by "repaired", "conflict", "failed" or "rate_limited".
+	readRepairs = expvar.NewMap("router_read_repairs")
+	// healthEjected is 1 while the server is ejected by the health checker.
+	healthEjected = expvar.NewMap("router_health_ejected")
+	// healthEjections is the number of the ejections of the server.
+	healthEjections = expvar.NewMap("router_health_ejections")
+	// healthCheckFailures is the number of the failed health checks of the server.
+	healthCheckFailures = expvar.NewMap("router_health_check_failures")
+)
@@ -0,0 +1,132 @@
+package router
+
+import (
+	"sort"
+	"strconv"
+)
+
+// movementSamples is the number of the sample keys when the movement can't be computed from the placement.
+const movementSamples = 1 << 20
+
+// Movement is the difference of the ownership of the keyspace between two rings.
+// The owner of the key is the server which is picked by the ring. The migrating server is the owner of its keys.
+type Movement struct {
+	// Moved is the fraction of the keyspace which moves to another server.
+	Moved float64
+	// Pairs is the fraction of the keyspace which moves from Pairs[i].From to Pairs[i].To.
+	Pairs []MovementPair
+	// Before and After are the placement of the servers of each ring.
+	Before []ServerStat
+	After  []ServerStat
+	// Exact is false if the movement is estimated from the sample keys.
+	Exact bool
+}
+
+type MovementPair struct {
+	From  string
+	To    string
+	Share float64
+}
+
+// CompareRings returns the movement of the keyspace from before to after.
+// The movement is computed from the points of the continuums or the slots of the lookup tables if both rings have the same placement,
+// otherwise it is estimated from the sample keys.
+func CompareRings(before, after *Ring) *Movement {
+	pairs := make(map[[2]string]float64)
+	exact := true
+	switch b, a := before.Picker, after.Picker; {
+	case isContinuum(b, a):
+		compareContinuums(b.(*Continuum), a.(*Continuum), pairs)
+	case isSameMaglev(b, a):
+		compareMaglevs(b.(*Maglev), a.(*Maglev), pairs)
+	default:
+		exact = false
+		for i := 0; i < movementSamples; i++ {
+			key := []byte("movement-" + strconv.Itoa(i))
+			addMovement(pairs, b.Pick(key), a.Pick(key), 1/float64(movementSamples))
+		}
+	}
+
+	m := &Movement{Before: before.Stats(), After: after.Stats(), Exact: exact}
+	for k, v := range pairs {
+		m.Moved += v
+		m.Pairs = append(m.Pairs, MovementPair{From: k[0], To: k[1], Share: v})
+	}
+	sort.Slice(m.Pairs, func(i, j int) bool {
+		if m.Pairs[i].Share != m.Pairs[j].Share {
+			return m.Pairs[i].Share > m.Pairs[j].Share
+		}
+		if m.Pairs[i].From != m.Pairs[j].From {
+			return m.Pairs[i].From < m.Pairs[j].From
+		}
+		return m.Pairs[i].To < m.Pairs[j].To
+	})
+
+	return m
+}
+
+func isContinuum(b, a Picker) bool {
+	bc, ok := b.(*Continuum)
+	if !ok {
+		return false
+	}
+	ac, ok := a.(*Continuum)
+	return ok && bc.Hash == ac.Hash && len(bc.Table) > 0 && len(ac.Table) > 0
+}
+
+func isSameMaglev(b, a Picker) bool {
+	bm, ok := b.(*Maglev)
+	if !ok {
+		return false
+	}
+	am, ok := a.(*Maglev)
+	return ok && len(bm.owners) == len(am.owners) && len(bm.owners) > 0
+}
+
+// compareContinuums splits the circle by the points of both continuums.
+// The owners of both continuums don't change within each segment.
+func compareContinuums(before, after *Continuum, pairs map[[2]string]float64) {
+	var points []uint32
+	for _, v := range before.Table {
+		points = append(points, v.Hash)
+	}
+	for _, v := range after.Table {
+		points = append(points, v.Hash)
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i] < points[j] })
+
+	for i, p := range points {
+		prev := points[len(points)-1]
+		if i > 0 {
+			prev = points[i-1]
+		}
+		length := float64(p-prev) / (1 << 32)
+		if len(points) == 1 {
+			length = 1
+		}
+		if length == 0 {
+			continue
+		}
+
+		// CRC32 picks the first point which is larger than the hash, so the segment is [prev, p).
+		// Ketama picks the first point which is equal to or larger than the hash, so the segment is (prev, p].
+		h := prev
+		if before.Hash == HashKetama {
+			h = p
+		}
+		addMovement(pairs, before.pickHash(h), after.pickHash(h), length)
+	}
+}
+
+func compareMaglevs(before, after *Maglev, pairs map[[2]string]float64) {
+	for i := range before.owners {
+		addMovement(pairs, before.Servers[before.owners[i]], after.Servers[after.owners[i]], 1/float64(len(before.owners)))
+	}
+}
+
+func addMovement(pairs map[[2]string]float64, before, after *Memcached, share float64) {
+	if before == nil || after == nil || before.Name == after.Name {
+		return
+	}
+	pairs[[2]string{before.Name, after.Name}] += share
+}
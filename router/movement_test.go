@@ -0,0 +1,62 @@
+package router
+
+import (
+	"math"
+	"testing"
+)
+
+func TestCompareRings(t *testing.T) {
+	keys := newTestKeys(100000)
+
+	for _, mode := range pickerModes {
+		servers := newTestServers(11)
+		before, err := NewRingWithHash(newTestServers(10), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := NewRingWithHash(servers, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := CompareRings(before, after)
+		if e := mode == HashCRC32 || mode == HashKetama || mode == HashMaglev; m.Exact != e {
+			t.Errorf("%s: expected exact=%v", mode, e)
+		}
+		sampled, _ := movement(t, before, after, keys)
+		if math.Abs(m.Moved-sampled) > 0.01 {
+			t.Errorf("%s: %f of the keyspace moves but %f of keys move", mode, m.Moved, sampled)
+		}
+
+		total := 0.0
+		for _, p := range m.Pairs {
+			total += p.Share
+			if mode != HashMaglev && p.To != "server10" {
+				t.Errorf("%s: the keys move from %s to %s", mode, p.From, p.To)
+			}
+		}
+		if math.Abs(total-m.Moved) > 1e-9 {
+			t.Errorf("%s: the total of the pairs %f doesn't match %f", mode, total, m.Moved)
+		}
+		if len(m.Before) != 10 || len(m.After) != 11 {
+			t.Errorf("%s: unexpected stats: %d %d", mode, len(m.Before), len(m.After))
+		}
+	}
+}
+
+func TestCompareRings_Same(t *testing.T) {
+	for _, mode := range pickerModes {
+		before, err := NewRingWithHash(newTestServers(5), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := NewRingWithHash(newTestServers(5), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if m := CompareRings(before, after); m.Moved != 0 || len(m.Pairs) != 0 {
+			t.Errorf("%s: the keys move between the same rings: %f", mode, m.Moved)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package router
+
+import (
+	"hash/fnv"
+)
+
+// Picker picks the server which owns the key.
+//
+// Pick returns the routing entry of the key rather than the server itself.
+// If the owner is migrating, the entry has the Mode of the owner and the successor which has the keys of the owner
+// in the layout without the owner. The implementation documents how it chooses the successor.
+type Picker interface {
+	Pick(key []byte) *Memcached
+}
+
+// ReplicaPicker is implemented by the Picker which can pick the servers which have the replicas of the key.
+type ReplicaPicker interface {
+	// PickN returns the routing entry of the owner followed by the entries of the replicas.
+	// The servers are distinct and the number is at most n.
+	PickN(key []byte, n int) []*Memcached
+}
+
+// Sharer is implemented by the Picker which can compute the share of the keyspace of each server.
+// Share is keyed by the name of the server.
+type Sharer interface {
+	Share() map[string]float64
+}
+
+// newRoute returns the routing entry of the keys which are owned by owner.
+// successor is the owner of the keys in the layout without owner. successor is ignored unless owner is migrating.
+// The entry is a copy, so the servers which are shared by the other entries are not modified.
+func newRoute(owner, successor *Memcached) *Memcached {
+	r := owner.Dup()
+	r.Mode = ModeReadWrite
+	r.next = nil
+	if owner.Status == StatusNormal || successor == nil {
+		return r
+	}
+
+	next := successor.Dup()
+	next.next = nil
+	switch owner.Status {
+	case StatusAdding:
+		switch owner.Phase {
+		case PhaseDeleteOnly:
+			r.Mode = ModeDeleteOnly
+			next.Mode = ModeReadWrite
+		case PhaseWriteOnly:
+			r.Mode = ModeWriteOnly
+			next.Mode = ModeReadWrite
+		case PhaseReadWrite:
+			r.Mode = ModeReadWrite
+			next.Mode = ModeWriteOnly
+		}
+	case StatusDeleting:
+		switch owner.Phase {
+		case PhaseDeleteOnly:
+			r.Mode = ModeReadWrite
+			next.Mode = ModeDeleteOnly
+		case PhaseWriteOnly:
+			r.Mode = ModeReadWrite
+			next.Mode = ModeWriteOnly
+		case PhaseReadWrite:
+			r.Mode = ModeWriteOnly
+			next.Mode = ModeReadWrite
+		}
+	}
+	r.next = next
+
+	return r
+}
+
+// routes holds the routing entries of the pickers which choose the owner by the index of the server.
+// The entries are built at the construction, so Pick doesn't allocate.
+type routes struct {
+	normal    []*Memcached
+	migrating map[[2]int]*Memcached
+}
+
+func newRoutes(servers []*Memcached) *routes {
+	r := &routes{normal: make([]*Memcached, len(servers)), migrating: make(map[[2]int]*Memcached)}
+	for i, v := range servers {
+		r.normal[i] = newRoute(v, nil)
+		if v.Status == StatusNormal {
+			continue
+		}
+		for j, s := range servers {
+			if i != j {
+				r.migrating[[2]int{i, j}] = newRoute(v, s)
+			}
+		}
+	}
+
+	return r
+}
+
+// get returns the entry of the keys which are owned by owner. successor is called only if owner is migrating.
+func (r *routes) get(servers []*Memcached, owner int, successor func() int) *Memcached {
+	if servers[owner].Status == StatusNormal {
+		return r.normal[owner]
+	}
+	if e, ok := r.migrating[[2]int{owner, successor()}]; ok {
+		return e
+	}
+
+	// There is no other server.
+	return r.normal[owner]
+}
+
+// hash64 returns the 64 bit hash of b.
+// FNV-1a is mixed by the finalizer of SplitMix64 because the high bits of FNV-1a are not distributed well for the short keys.
+func hash64(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return mix64(h.Sum64())
+}
+
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+)
+
+var pickerModes = []HashMode{HashCRC32, HashKetama, HashJump, HashRendezvous, HashMaglev}
+
+func newTestServers(n int) []*Memcached {
+	servers := make([]*Memcached, n)
+	for i := range servers {
+		servers[i] = &Memcached{Name: fmt.Sprintf("server%d", i), Host: "127.0.0.1", Port: 11211 + i}
+	}
+
+	return servers
+}
+
+func newTestKeys(n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+	}
+
+	return keys
+}
+
+// movement returns the fraction of keys which move between the rings
+// and the fraction of keys which move between the servers which are in both rings.
+func movement(t *testing.T, before, after *Ring, keys [][]byte) (moved, unrelated float64) {
+	t.Helper()
+
+	inBoth := make(map[string]bool)
+	for _, v := range before.Servers {
+		inBoth[v.Name] = false
+	}
+	for _, v := range after.Servers {
+		if _, ok := inBoth[v.Name]; ok {
+			inBoth[v.Name] = true
+		}
+	}
+
+	var m, u int
+	for _, key := range keys {
+		b, a := before.Pick(key).Name, after.Pick(key).Name
+		if b == a {
+			continue
+		}
+		m++
+		if inBoth[b] && inBoth[a] {
+			u++
+		}
+	}
+
+	return float64(m) / float64(len(keys)), float64(u) / float64(len(keys))
+}
+
+func TestPicker_KeyMovement(t *testing.T) {
+	keys := newTestKeys(100000)
+
+	for _, mode := range pickerModes {
+		servers := newTestServers(11)
+		ten, err := NewRingWithHash(servers[:10], mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		eleven, err := NewRingWithHash(servers, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		moved, unrelated := movement(t, ten, eleven, keys)
+		t.Logf("%s: adding the 11th server moves %.2f%% of keys (%.2f%% between the existing servers)", mode, moved*100, unrelated*100)
+
+		// The ideal is 1/11 (9.09%).
+		if moved < 0.05 || moved > 0.14 {
+			t.Errorf("%s: unexpected fraction of moved keys: %f", mode, moved)
+		}
+		limit := 0.0
+		if mode == HashMaglev {
+			limit = 0.02
+		}
+		if unrelated > limit {
+			t.Errorf("%s: %f of keys move between the existing servers", mode, unrelated)
+		}
+	}
+}
+
+func TestPicker_Balance(t *testing.T) {
+	keys := newTestKeys(100000)
+
+	for _, mode := range pickerModes {
+		r, err := NewRingWithHash(newTestServers(10), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count := make(map[string]int)
+		for _, key := range keys {
+			count[r.Pick(key).Name]++
+		}
+		min, max := len(keys), 0
+		for _, v := range r.Servers {
+			if count[v.Name] < min {
+				min = count[v.Name]
+			}
+			if count[v.Name] > max {
+				max = count[v.Name]
+			}
+		}
+		t.Logf("%s: min %d max %d of %d keys", mode, min, max, len(keys))
+
+		// The ideal is 10000 keys per server. CRC32 with 100 points per server has the largest variance.
+		if min < 7000 || max > 15000 {
+			t.Errorf("%s: unbalanced: min %d max %d", mode, min, max)
+		}
+	}
+}
+
+func TestNewMaglev(t *testing.T) {
+	if _, err := NewMaglev(newTestServers(3), 65536); err != ErrInvalidTableSize {
+		t.Errorf("expected ErrInvalidTableSize but got %v", err)
+	}
+	if _, err := NewMaglev(newTestServers(3), 251); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkPicker_Pick(b *testing.B) {
+	keys := newTestKeys(1024)
+
+	for _, mode := range pickerModes {
+		for _, n := range []int{10, 100} {
+			r, err := NewRingWithHash(newTestServers(n), mode)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run(fmt.Sprintf("%s/%d", mode, n), func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					r.Pick(keys[i%len(keys)])
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package router
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/logger"
+	"github.com/go-yaml/yaml"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultReloadInterval = 5 * time.Second
+	// reloadRedialTimeout bounds the dial of the failed connection which is kept by the reload,
+	// because the reload holds the lock and the unreachable server must not stall it.
+	reloadRedialTimeout = 500 * time.Millisecond
+)
+
+// Reloader builds the cluster of Router from the config file and rebuilds it when the file is changed.
+//
+// The file is polled rather than watched by inotify, because ConfigMap of Kubernetes replaces the file by swapping the symlink
+// of the parent directory and the watch on the file is lost.
+// The new cluster reuses the connections of the servers which have the same address as the current cluster.
+// The connections of the removed servers are closed after the requests on the previous cluster finished.
+type Reloader struct {
+	Path   string
+	Router *Router
+	// Interval is the interval of checking the config file.
+	Interval time.Duration
+	// Health checks the servers of the new cluster if the config has the health check section.
+	Health *HealthChecker
+
+	mu      sync.Mutex
+	conf    *Config
+	servers map[string]*Memcached
+	sum     [sha256.Size]byte
+}
+
+func NewReloader(path string, r *Router) *Reloader {
+	return &Reloader{Path: path, Router: r, Interval: defaultReloadInterval}
+}
+
+// Reload reads the config file and replaces the cluster of Router.
+// If Reload fails, Router keeps the current cluster.
+func (r *Reloader) Reload() error {
+	b, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		configReloads.Add("failure", 1)
+		return err
+	}
+
+	return r.apply(b)
+}
+
+// Watch checks the config file every Interval and reloads it if the content is changed. Watch blocks until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) {
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		b, err := ioutil.ReadFile(r.Path)
+		if err != nil {
+			logger.Log.Infow("failed to read the config", "path", r.Path, "err", err)
+			continue
+		}
+		if r.unchanged(b) {
+			continue
+		}
+
+		if err := r.apply(b); err != nil {
+			logger.Log.Infow("failed to reload the config", "path", r.Path, "err", err)
+		}
+	}
+}
+
+func (r *Reloader) apply(b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(b); err != nil {
+		configReloads.Add("failure", 1)
+		return err
+	}
+	configReloads.Add("success", 1)
+	return nil
+}
+
+// reload builds the cluster from the content of the config file. r.mu must be held.
+func (r *Reloader) reload(b []byte) error {
+	var conf Config
+	if err := yaml.Unmarshal(b, &conf); err != nil {
+		return err
+	}
+
+	servers := conf.ToRouter()
+	gutter := conf.ToGutter()
+	next := make(map[string]*Memcached, len(servers)+len(gutter))
+	var connected []*Memcached
+	closeConnected := func() {
+		for _, v := range connected {
+			v.Client.Close()
+		}
+	}
+	for _, v := range append(append([]*Memcached{}, servers...), gutter...) {
+		if prev, ok := r.servers[v.Addr()]; ok {
+			// The server which is down doesn't fail the reload. The health checker redials it later.
+			if err := prev.Client.Redial(reloadRedialTimeout); err != nil {
+				logger.Log.Infow("failed to redial", "server", v.Name, "err", err)
+			}
+			v.Client = prev.Client
+			if prev.Name == v.Name && sameBreakerConfig(r.conf.Breaker, conf.Breaker) {
+				v.Breaker = prev.Breaker
+			}
+		} else if s, ok := next[v.Addr()]; ok {
+			v.Client = s.Client
+		} else {
+			if err := v.Connect(); err != nil {
+				closeConnected()
+				return errors.Wrapf(err, "failed to connect to %s", v.Name)
+			}
+			connected = append(connected, v)
+		}
+		next[v.Addr()] = v
+	}
+
+	c, err := conf.NewCluster(servers)
+	if err != nil {
+		closeConnected()
+		return err
+	}
+	c.Gutter, err = conf.NewGutter(gutter)
+	if err != nil {
+		closeConnected()
+		return err
+	}
+	if r.Health != nil {
+		ring := c.Ring
+		if conf.HealthCheck != nil {
+			r.Health.SetConfig(conf.HealthCheck.ToHealthConfig())
+		} else {
+			ring = nil
+		}
+		// The ejected servers are ejected from the new ring before it serves.
+		if err := r.Health.SetRing(ring); err != nil {
+			closeConnected()
+			return err
+		}
+	}
+	done := r.Router.SetCluster(c)
+	// The reused breakers keep their state, so the gauges are published after the swap.
+	for _, v := range next {
+		if v.Breaker != nil {
+			v.Breaker.publish()
+		}
+	}
+
+	var removed []*Memcached
+	for addr, v := range r.servers {
+		if _, ok := next[addr]; !ok {
+			removed = append(removed, v)
+		}
+	}
+	if len(removed) > 0 {
+		go func() {
+			<-done
+			for _, v := range removed {
+				v.Client.Close()
+			}
+		}()
+	}
+
+	for _, v := range c.Ring.Stats() {
+		logger.Log.Infow("keyspace share", "server", v.Name, "weight", v.Weight, "share", v.Share)
+	}
+	logger.Log.Infow("reloaded the config", "path", r.Path, "servers", len(servers), "gutter", len(gutter), "removed", len(removed))
+	r.conf = &conf
+	r.servers = next
+	r.sum = sha256.Sum256(b)
+	return nil
+}
+
+func sameBreakerConfig(a, b *ConfigBreaker) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// unchanged reports whether b is the content which has been loaded.
+func (r *Reloader) unchanged(b []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return sha256.Sum256(b) == r.sum
+}
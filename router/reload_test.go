@@ -0,0 +1,239 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func newTestServer(t *testing.T) *memcachedtest.Server {
+	s, err := memcachedtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	return s
+}
+
+func writeTestConfig(t *testing.T, path string, servers ...*memcachedtest.Server) {
+	conf := "servers:\n"
+	for i, s := range servers {
+		host, port := s.Host()
+		conf += fmt.Sprintf("  - name: server%d\n    host: %s\n    port: %d\n", i, host, port)
+	}
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func currentServers(r *Router) map[string]*Memcached {
+	snap := r.acquire()
+	defer snap.release()
+
+	servers := make(map[string]*Memcached)
+	for _, v := range snap.cluster.Ring.Servers {
+		servers[v.Addr()] = v
+	}
+	return servers
+}
+
+func TestReloader_Reload(t *testing.T) {
+	s1, s2 := newTestServer(t), newTestServer(t)
+	path := filepath.Join(t.TempDir(), "router.yaml")
+
+	writeTestConfig(t, path, s1)
+	r := &Router{}
+	reloader := NewReloader(path, r)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	before := currentServers(r)
+	if len(before) != 1 {
+		t.Fatalf("expected 1 server but got %d", len(before))
+	}
+
+	writeTestConfig(t, path, s1, s2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	after := currentServers(r)
+	if len(after) != 2 {
+		t.Fatalf("expected 2 servers but got %d", len(after))
+	}
+	for addr, v := range before {
+		if after[addr].Client != v.Client {
+			t.Errorf("the client of %s is not reused", addr)
+		}
+	}
+
+	// Remove the first server while the request is in flight.
+	snap := r.acquire()
+	old := after
+	writeTestConfig(t, path, s2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(currentServers(r)) != 1 {
+		t.Fatal("the server is not removed")
+	}
+	host, port := s1.Host()
+	removed := old[fmt.Sprintf("%s:%d", host, port)]
+	if err := removed.Client.Set([]byte("key"), []byte("value"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatalf("the client is closed before the request finished: %v", err)
+	}
+
+	snap.release()
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := removed.Client.GetAsync([]byte("key")); err == client.ErrClosed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the client of the removed server is not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloader_ReloadFailure(t *testing.T) {
+	s1 := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "router.yaml")
+
+	writeTestConfig(t, path, s1)
+	r := &Router{}
+	reloader := NewReloader(path, r)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("servers:\n  - name: a\n  - name: a\n    socket: /nonexistent\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.Reload(); err == nil {
+		t.Fatal("expected the error")
+	}
+	if len(currentServers(r)) != 1 {
+		t.Error("the cluster is replaced by the broken config")
+	}
+}
+
+func TestReloader_ReloadRedials(t *testing.T) {
+	s1, s2 := newTestServer(t), newTestServer(t)
+	path := filepath.Join(t.TempDir(), "router.yaml")
+
+	writeTestConfig(t, path, s1)
+	r := &Router{}
+	reloader := NewReloader(path, r)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	c := currentServers(r)[s1.Addr].Client
+
+	s1.Close()
+	for c.Noop() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s1, err := memcachedtest.Listen("tcp", s1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	// The connection of the kept server is dialed again.
+	writeTestConfig(t, path, s1, s2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if err := currentServers(r)[s1.Addr].Client.Noop(); err != nil {
+		t.Errorf("the failed connection is kept: %v", err)
+	}
+}
+
+func TestReloader_ReloadKeepsBreakerGauge(t *testing.T) {
+	s1, s2 := newTestServer(t), newTestServer(t)
+	path := filepath.Join(t.TempDir(), "router.yaml")
+	write := func(servers ...*memcachedtest.Server) {
+		conf := "breaker:\n  consecutive_failures: 1\n  open_timeout: 1m\nservers:\n"
+		for i, s := range servers {
+			host, port := s.Host()
+			conf += fmt.Sprintf("  - name: gauge%d\n    host: %s\n    port: %d\n", i, host, port)
+		}
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gauge := func() string { return breakerState.Get("gauge0").String() }
+
+	write(s1)
+	r := &Router{}
+	reloader := NewReloader(path, r)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range currentServers(r) {
+		v.Breaker.Done(false)
+	}
+	if gauge() != "1" {
+		t.Fatalf("expected the open breaker but got %s", gauge())
+	}
+
+	// The breaker is reused by the reload, and the gauge keeps its state.
+	write(s1, s2)
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if gauge() != "1" {
+		t.Errorf("the gauge of the reused breaker is reset: %s", gauge())
+	}
+}
+
+// TestReloader_Watch swaps the config by the symlink as ConfigMap of Kubernetes does.
+func TestReloader_Watch(t *testing.T) {
+	s1, s2 := newTestServer(t), newTestServer(t)
+	dir := t.TempDir()
+
+	swap := func(version string, servers ...*memcachedtest.Server) {
+		if err := os.Mkdir(filepath.Join(dir, version), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeTestConfig(t, filepath.Join(dir, version, "router.yaml"), servers...)
+		if err := os.Symlink(version, filepath.Join(dir, "..data_tmp")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	swap("..v1", s1)
+	path := filepath.Join(dir, "router.yaml")
+	if err := os.Symlink(filepath.Join("..data", "router.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &Router{}
+	reloader := NewReloader(path, r)
+	reloader.Interval = 10 * time.Millisecond
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.Watch(ctx)
+
+	swap("..v2", s1, s2)
+	deadline := time.Now().Add(time.Second)
+	for len(currentServers(r)) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("the config is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"math"
+	"sort"
+)
+
+// Rendezvous is the highest random weight hashing.
+// Each server has the score of the key and the key is owned by the server of the highest score.
+// The score is -weight / ln(h) where h is the hash of the key and the server in (0, 1),
+// so the probability that the server has the highest score is proportional to the weight.
+// Pick computes the score of all servers, so it is O(n) and is slower than the other pickers for the large cluster.
+//
+// The successor of the migrating server is the server of the second highest score.
+// It is exactly the owner in the layout without the migrating server, so any server can be added or deleted
+// and only the keys of the migrating server move.
+type Rendezvous struct {
+	Servers []*Memcached
+
+	seeds  []uint64
+	routes *routes
+}
+
+func NewRendezvous(servers []*Memcached) *Rendezvous {
+	seeds := make([]uint64, len(servers))
+	for i, v := range servers {
+		seeds[i] = hash64([]byte(v.Name))
+	}
+
+	return &Rendezvous{Servers: servers, seeds: seeds, routes: newRoutes(servers)}
+}
+
+func (r *Rendezvous) Pick(key []byte) *Memcached {
+	if len(r.Servers) == 0 {
+		return nil
+	}
+
+	h := hash64(key)
+	first, second := -1, -1
+	var firstScore, secondScore float64
+	for i, seed := range r.seeds {
+		score := r.score(i, mix64(h^seed))
+		switch {
+		case first == -1 || score > firstScore:
+			second, secondScore = first, firstScore
+			first, firstScore = i, score
+		case second == -1 || score > secondScore:
+			second, secondScore = i, score
+		}
+	}
+
+	return r.routes.get(r.Servers, first, func() int { return second })
+}
+
+// PickN returns the routing entry of the owner and the servers of the next highest scores.
+// The servers are distinct and the number is at most n. The replicas always serve the reads and writes.
+func (r *Rendezvous) PickN(key []byte, n int) []*Memcached {
+	owner := r.Pick(key)
+	if owner == nil || n < 1 {
+		return nil
+	}
+
+	h := hash64(key)
+	scores := make([]float64, len(r.Servers))
+	indexes := make([]int, len(r.Servers))
+	for i, seed := range r.seeds {
+		scores[i] = r.score(i, mix64(h^seed))
+		indexes[i] = i
+	}
+	sort.Slice(indexes, func(a, b int) bool { return scores[indexes[a]] > scores[indexes[b]] })
+
+	result := []*Memcached{owner}
+	for _, i := range indexes[1:] {
+		if len(result) >= n {
+			break
+		}
+		result = append(result, r.routes.normal[i])
+	}
+
+	return result
+}
+
+func (r *Rendezvous) score(i int, h uint64) float64 {
+	// The upper 53 bits in (0, 1)
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -float64(r.Servers[i].weight()) / math.Log(u)
+}
+
+// Share returns the ratio of the weight of each server. It is the expected share of the keyspace.
+func (r *Rendezvous) Share() map[string]float64 {
+	total := 0
+	for _, v := range r.Servers {
+		total += v.weight()
+	}
+
+	share := make(map[string]float64)
+	for _, v := range r.Servers {
+		share[v.Name] = float64(v.weight()) / float64(total)
+	}
+
+	return share
+}
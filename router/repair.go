@@ -0,0 +1,92 @@
+package router
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// ErrRepairTTLRequired is returned if the TTL of the read repair is not set.
+var ErrRepairTTLRequired = errors.New("router: ttl of the read repair is required")
+
+// ReadRepair writes the value back to the authoritative server when the read missed on it and hit on the fallback server.
+// The repair is asynchronous and is limited by the token bucket of Rate and Burst.
+//
+// The binary protocol can't read the remaining TTL of the item, so the repaired value expires after TTL
+// even if the original value expires earlier. Keep TTL shorter than the TTL of the values.
+// The value is written by add, so the repair never overwrites the value which is written after the read.
+type ReadRepair struct {
+	TTL time.Duration
+	// Rate is the number of the repairs per second. Zero or less disables the limit.
+	Rate float64
+	// Burst is the number of the repairs which can be done at once.
+	Burst int
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+func NewReadRepair(ttl time.Duration, rate float64, burst int) *ReadRepair {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &ReadRepair{TTL: ttl, Rate: rate, Burst: burst, tokens: float64(burst), now: time.Now}
+}
+
+// repair writes v to s in background.
+func (r *ReadRepair) repair(s *Memcached, key []byte, v *client.Item) {
+	if !r.allow() {
+		readRepairs.Add("rate_limited", 1)
+		return
+	}
+
+	flag := v.Extra
+	if len(flag) != 4 {
+		flag = make([]byte, 4)
+	}
+	res, err := s.add(key, v.Value, flag, r.expiration())
+	if err != nil {
+		readRepairs.Add("failed", 1)
+		return
+	}
+	go func() {
+		switch (<-res).Err {
+		case nil:
+			readRepairs.Add("repaired", 1)
+		case client.ErrKeyAlreadyExists, client.ErrItemNotStored:
+			readRepairs.Add("conflict", 1)
+		default:
+			readRepairs.Add("failed", 1)
+		}
+	}()
+}
+
+func (r *ReadRepair) allow() bool {
+	if r.Rate <= 0 {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if !r.last.IsZero() {
+		r.tokens = math.Min(float64(r.Burst), r.tokens+now.Sub(r.last).Seconds()*r.Rate)
+	}
+	r.last = now
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+func (r *ReadRepair) expiration() int {
+	return client.ExpirationAt(r.TTL, r.now())
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/internal/memcachedtest"
+)
+
+func waitValue(t *testing.T, s *memcachedtest.Server, key, value string) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if v, ok := s.Value(key); ok && string(v) == value {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not repaired", key)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCluster_ReadRepairReplica(t *testing.T) {
+	c := newTestCluster(t, 3, 2, WriteAckAll)
+	c.Repair = NewReadRepair(time.Minute, 0, 1)
+
+	c.set(t, "key", "value")
+	owner := c.Ring.Pick([]byte("key"))
+	if err := owner.Client.Del([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.get(t, "key"); v.Err != nil || string(v.Value) != "value" {
+		t.Fatalf("expected the value of the replica: %v", v.Err)
+	}
+	waitValue(t, c.servers[owner.Name], "key", "value")
+}
+
+// newTestMigratingCluster returns the cluster which is adding the server in the read-write phase
+// and the key which is owned by the adding server.
+func newTestMigratingCluster(t *testing.T) (*testCluster, []byte) {
+	var servers []*Memcached
+	backends := make(map[string]*memcachedtest.Server)
+	for i := 0; i < 3; i++ {
+		m, s := newTestMemcachedServer(t, fmt.Sprintf("server%d", i))
+		servers = append(servers, m)
+		backends[m.Name] = s
+	}
+	servers[2].Status = StatusAdding
+	servers[2].Phase = PhaseReadWrite
+	ring, err := NewRing(servers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; ; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		if ring.Pick(key).Name == "server2" {
+			return &testCluster{Cluster: &Cluster{Ring: ring}, servers: backends}, key
+		}
+	}
+}
+
+func TestCluster_ReadRepairOldOwner(t *testing.T) {
+	c, key := newTestMigratingCluster(t)
+	c.Repair = NewReadRepair(time.Minute, 0, 1)
+
+	// The key is written before the migration.
+	old := c.Ring.Pick(key).next
+	if err := old.Client.Set(key, []byte("value"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := c.get(t, string(key)); v.Err != nil || string(v.Value) != "value" {
+		t.Fatalf("expected the value of the old owner: %v", v.Err)
+	}
+	waitValue(t, c.servers["server2"], string(key), "value")
+}
+
+func TestCluster_ReadRepairGetMulti(t *testing.T) {
+	c, key := newTestMigratingCluster(t)
+	c.Repair = NewReadRepair(time.Minute, 0, 1)
+
+	old := c.Ring.Pick(key).next
+	if err := old.Client.Set(key, []byte("value"), 0, make([]byte, 4), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := c.GetMulti([][]byte{key, []byte("unknown")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := items[string(key)]; !ok || string(v.Value) != "value" {
+		t.Fatal("expected the value of the old owner")
+	}
+	waitValue(t, c.servers["server2"], string(key), "value")
+}
+
+func TestReadRepair_Allow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewReadRepair(time.Minute, 1, 2)
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if !r.allow() {
+			t.Fatalf("%d: expected to be allowed within the burst", i)
+		}
+	}
+	if r.allow() {
+		t.Fatal("expected to be limited")
+	}
+
+	now = now.Add(time.Second)
+	if !r.allow() {
+		t.Fatal("expected to be allowed after the token is refilled")
+	}
+	if r.allow() {
+		t.Fatal("expected to be limited")
+	}
+}
+
+func TestConfig_NewClusterRepairTTL(t *testing.T) {
+	servers := []ConfigServer{{Name: "server0", Host: "127.0.0.1", Port: 11211}}
+	conf := &Config{Servers: servers, Repair: &ConfigRepair{Rate: 10}}
+	if _, err := conf.NewCluster(conf.ToRouter()); err != ErrRepairTTLRequired {
+		t.Errorf("expected ErrRepairTTLRequired but got %v", err)
+	}
+
+	conf.Repair.TTL = time.Minute
+	c, err := conf.NewCluster(conf.ToRouter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Repair == nil || c.Repair.TTL != time.Minute {
+		t.Errorf("unexpected repair: %+v", c.Repair)
+	}
+}
@@ -1,87 +1,521 @@
 package router
 
 import (
+	"crypto/md5"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/crc32"
+	"math"
+	"net"
 	"sort"
+	"strconv"
+	"sync/atomic"
 )
 
 var (
-	ErrConflictName = errors.New("router: conflict name")
+	ErrConflictName    = errors.New("router: conflict name")
+	ErrUnknownHashMode = errors.New("router: unknown hash mode")
+	// ErrEjectionNotSupported is returned when the ring is built with the picker which can't be rebuilt without the servers.
+	ErrEjectionNotSupported = errors.New("router: ejection is not supported by the ring")
 )
 
+const (
+	// HashCRC32 places 100 points per weight by CRC32 of "<name>-<i>".
+	HashCRC32 HashMode = iota
+	// HashKetama places the points compatible with libketama.
+	// Each server has MD5 digests of "<host>:<port>-<i>" and each digest makes 4 points.
+	// The number of the digests is floor(weight / total weight * 40 * the number of servers) as libketama.
+	// The key is owned by the first point which is equal to or larger than the hash of the key.
+	HashKetama
+	// HashJump is the jump consistent hash of Lamping and Veach.
+	HashJump
+	// HashRendezvous is the highest random weight hashing.
+	HashRendezvous
+	// HashMaglev is the lookup table of Maglev.
+	HashMaglev
+)
+
+const defaultCRC32VNodes = 100
+
+type HashMode int
+
+func ParseHashMode(s string) (HashMode, error) {
+	switch s {
+	case "", "crc32":
+		return HashCRC32, nil
+	case "ketama":
+		return HashKetama, nil
+	case "jump":
+		return HashJump, nil
+	case "rendezvous":
+		return HashRendezvous, nil
+	case "maglev":
+		return HashMaglev, nil
+	default:
+		return 0, ErrUnknownHashMode
+	}
+}
+
+func (h HashMode) String() string {
+	switch h {
+	case HashCRC32:
+		return "crc32"
+	case HashKetama:
+		return "ketama"
+	case HashJump:
+		return "jump"
+	case HashRendezvous:
+		return "rendezvous"
+	case HashMaglev:
+		return "maglev"
+	default:
+		return "unknown"
+	}
+}
+
 type node struct {
 	Hash   uint32
 	Server *Memcached
+
+	// route is the routing entry of the keys which are owned by the point.
+	route *Memcached
 }
 
+// entry returns the routing entry of the point. The point which is not built by NewContinuum routes to Server.
+func (n *node) entry() *Memcached {
+	if n.route != nil {
+		return n.route
+	}
+
+	return n.Server
+}
+
+// RingConfig is the placement of the keys.
+type RingConfig struct {
+	Hash HashMode
+	// VNodes is the number of the points per weight on the continuum. Zero is the default of Hash.
+	VNodes int
+}
+
+// Ring routes the keys to Servers by Picker.
+//
+// The servers which are ejected by SetEjected don't own any key.
+// The keys of the ejected server are routed to the ring which is built from the healthy servers with the same placement,
+// so they move to the next healthy server and the keys of the other servers don't move.
 type Ring struct {
 	Servers []*Memcached
-	Table   []*node
+	Hash    HashMode
+	Picker  Picker
+
+	conf    *RingConfig
+	ejected atomic.Value
+}
+
+// ejection is the ring without the ejected servers.
+type ejection struct {
+	names map[string]struct{}
+	ring  *Ring
+}
+
+// ServerStat is the placement of a server in the ring.
+type ServerStat struct {
+	Name   string
+	Weight int
+	// Share is the fraction of the keyspace which is owned by the server.
+	Share float64
 }
 
 func NewRing(servers []*Memcached) (*Ring, error) {
+	return NewRingWithHash(servers, HashCRC32)
+}
+
+// NewRingWithHash builds the ring of servers with the picker of mode.
+func NewRingWithHash(servers []*Memcached, mode HashMode) (*Ring, error) {
+	return NewRingWithConfig(servers, RingConfig{Hash: mode})
+}
+
+// NewRingWithConfig builds the ring of servers with the picker of conf.
+func NewRingWithConfig(servers []*Memcached, conf RingConfig) (*Ring, error) {
+	if err := checkNames(servers); err != nil {
+		return nil, err
+	}
+
+	mode := conf.Hash
+	var p Picker
+	switch mode {
+	case HashCRC32, HashKetama:
+		c, err := NewContinuum(servers, mode, conf.VNodes)
+		if err != nil {
+			return nil, err
+		}
+		p = c
+	case HashJump:
+		p = NewJump(servers)
+	case HashRendezvous:
+		p = NewRendezvous(servers)
+	case HashMaglev:
+		m, err := NewMaglev(servers, DefaultMaglevTableSize)
+		if err != nil {
+			return nil, err
+		}
+		p = m
+	default:
+		return nil, ErrUnknownHashMode
+	}
+
+	return &Ring{Servers: servers, Hash: mode, Picker: p, conf: &conf}, nil
+}
+
+// NewRingWithPicker builds the ring of servers with p.
+// p must be built from the same servers.
+func NewRingWithPicker(servers []*Memcached, p Picker) (*Ring, error) {
+	if err := checkNames(servers); err != nil {
+		return nil, err
+	}
+
+	return &Ring{Servers: servers, Picker: p}, nil
+}
+
+func checkNames(servers []*Memcached) error {
 	c := make(map[string]struct{})
-	t := make([]*node, 0, len(servers)*100)
 	for _, v := range servers {
 		if _, ok := c[v.Name]; ok {
-			return nil, ErrConflictName
-		} else {
-			c[v.Name] = struct{}{}
+			return ErrConflictName
+		}
+		c[v.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// SetEjected replaces the ejected servers by names.
+// If all servers are ejected, the keys are routed to the original owners because there is no server to take over them.
+func (r *Ring) SetEjected(names []string) error {
+	if r.conf == nil {
+		return ErrEjectionNotSupported
+	}
+
+	e := &ejection{names: make(map[string]struct{})}
+	for _, v := range names {
+		e.names[v] = struct{}{}
+	}
+	var healthy []*Memcached
+	for _, v := range r.Servers {
+		if _, ok := e.names[v.Name]; !ok {
+			healthy = append(healthy, v)
+		}
+	}
+	if len(healthy) == len(r.Servers) || len(healthy) == 0 {
+		r.ejected.Store((*ejection)(nil))
+		return nil
+	}
+
+	ring, err := NewRingWithConfig(healthy, *r.conf)
+	if err != nil {
+		return err
+	}
+	e.ring = ring
+	r.ejected.Store(e)
+	return nil
+}
+
+// Ejected returns the names of the servers which are ejected from the ring.
+func (r *Ring) Ejected() []string {
+	e := r.ejection()
+	if e == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(e.names))
+	for _, v := range r.Servers {
+		if _, ok := e.names[v.Name]; ok {
+			names = append(names, v.Name)
+		}
+	}
+	return names
+}
+
+func (r *Ring) isEjected(name string) bool {
+	e := r.ejection()
+	if e == nil {
+		return false
+	}
+
+	_, ok := e.names[name]
+	return ok
+}
+
+func (r *Ring) ejection() *ejection {
+	e, _ := r.ejected.Load().(*ejection)
+	return e
+}
+
+func (r *Ring) Pick(key []byte) *Memcached {
+	s := r.Picker.Pick(key)
+	if s == nil {
+		return nil
+	}
+	if e := r.ejection(); e != nil {
+		if _, ok := e.names[s.Name]; ok {
+			return e.ring.Pick(key)
 		}
+	}
 
-		for i := 0; i < 100; i++ {
-			h := fmt.Sprintf("%s-%d", v.Name, i)
-			hash := crc32.ChecksumIEEE([]byte(h))
-			t = append(t, &node{Hash: hash, Server: v})
+	return s
+}
+
+// PickN returns the routing entry of the owner of key followed by the servers which have the replicas.
+// If Picker doesn't implement ReplicaPicker, PickN returns only the owner.
+// The ejected servers are skipped and the owner is replaced by the next healthy server.
+func (r *Ring) PickN(key []byte, n int) []*Memcached {
+	e := r.ejection()
+	if e == nil {
+		return r.pickN(key, n)
+	}
+
+	candidates := r.pickN(key, n+len(e.names))
+	if len(candidates) == 0 || n < 1 {
+		return nil
+	}
+	result := make([]*Memcached, 0, n)
+	if _, ok := e.names[candidates[0].Name]; ok {
+		result = append(result, e.ring.Pick(key))
+	}
+	for _, v := range candidates {
+		if len(result) >= n {
+			break
+		}
+		if _, ok := e.names[v.Name]; ok || (len(result) > 0 && v.Name == result[0].Name) {
+			continue
 		}
+		result = append(result, v)
+	}
+
+	return result
+}
+
+func (r *Ring) pickN(key []byte, n int) []*Memcached {
+	if p, ok := r.Picker.(ReplicaPicker); ok {
+		return p.PickN(key, n)
 	}
 
-	sort.Slice(t, func(i, j int) bool {
+	s := r.Picker.Pick(key)
+	if s == nil {
+		return nil
+	}
+	return []*Memcached{s}
+}
+
+// Stats returns the placement of each server.
+// The share is computed by the picker if it implements Sharer, otherwise it is estimated from the sample keys.
+func (r *Ring) Stats() []ServerStat {
+	var share map[string]float64
+	if s, ok := r.Picker.(Sharer); ok {
+		share = s.Share()
+	} else {
+		share = sampleShare(r.Picker, 100000)
+	}
+
+	stats := make([]ServerStat, len(r.Servers))
+	for i, v := range r.Servers {
+		stats[i] = ServerStat{Name: v.Name, Weight: v.weight(), Share: share[v.Name]}
+	}
+
+	return stats
+}
+
+func sampleShare(p Picker, n int) map[string]float64 {
+	share := make(map[string]float64)
+	for i := 0; i < n; i++ {
+		if s := p.Pick([]byte("ring-stats-" + strconv.Itoa(i))); s != nil {
+			share[s.Name] += 1 / float64(n)
+		}
+	}
+
+	return share
+}
+
+// Continuum places the points of each server on the circle of uint32. The number of the points is proportional to the weight.
+// The key is owned by the server of the point which follows the hash of the key.
+//
+// The migrating server hands over the keys of each point to the server of the next point which belongs to another server.
+// It is the owner of the keys in the continuum without the migrating server.
+type Continuum struct {
+	Table []*node
+	Hash  HashMode
+
+	// replicas is the routing entry of each server as the replica.
+	replicas map[*Memcached]*Memcached
+}
+
+// NewContinuum builds the continuum of servers. mode must be HashCRC32 or HashKetama.
+// vnodes is the number of the points per weight. Zero is the default of mode.
+func NewContinuum(servers []*Memcached, mode HashMode, vnodes int) (*Continuum, error) {
+	totalWeight := 0
+	for _, v := range servers {
+		totalWeight += v.weight()
+	}
+
+	var t []*node
+	for _, v := range servers {
+		switch mode {
+		case HashCRC32:
+			if vnodes <= 0 {
+				vnodes = defaultCRC32VNodes
+			}
+			t = append(t, crc32Points(v, vnodes*v.weight())...)
+		case HashKetama:
+			var digests int
+			if vnodes > 0 {
+				digests = (vnodes*v.weight() + 3) / 4
+			} else {
+				// libketama computes the ratio of the weight in float and the number of the digests in double.
+				pct := float32(v.weight()) / float32(totalWeight)
+				digests = int(math.Floor(float64(pct) * 40.0 * float64(len(servers))))
+			}
+			t = append(t, ketamaPoints(v, digests)...)
+		default:
+			return nil, ErrUnknownHashMode
+		}
+	}
+
+	sort.SliceStable(t, func(i, j int) bool {
 		return t[i].Hash < t[j].Hash
 	})
 
+	replicas := make(map[*Memcached]*Memcached, len(servers))
+	for _, v := range servers {
+		replicas[v] = newRoute(v, nil)
+	}
+
+	// The routing entries are shared by the points which have the same owner and successor.
+	routes := make(map[[2]*Memcached]*Memcached)
 	for i, v := range t {
-		switch v.Server.Status {
-		case StatusAdding:
-			switch v.Server.Phase {
-			case PhaseDeleteOnly:
-				v.Server.Mode = ModeDeleteOnly
-				v.Server.next = t[i+1].Server
-			case PhaseWriteOnly:
-				v.Server.Mode = ModeWriteOnly
-				v.Server.next = t[i+1].Server
-			case PhaseReadWrite:
-				v.Server.Mode = ModeReadWrite
-				v.Server.next = t[i+1].Server.Dup()
-				v.Server.next.Mode = ModeWriteOnly
-			}
-		case StatusDeleting:
-			switch v.Server.Phase {
-			case PhaseDeleteOnly:
-				v.Server.Mode = ModeReadWrite
-				v.Server.next = t[i+1].Server.Dup()
-				v.Server.next.Mode = ModeDeleteOnly
-			case PhaseWriteOnly:
-				v.Server.Mode = ModeReadWrite
-				v.Server.next = t[i+1].Server.Dup()
-				v.Server.next.Mode = ModeWriteOnly
-			case PhaseReadWrite:
-				v.Server.Mode = ModeWriteOnly
-				v.Server.next = t[i+1].Server.Dup()
-				v.Server.next.Mode = ModeReadWrite
+		var successor *Memcached
+		if v.Server.Status != StatusNormal {
+			successor = nextDistinctServer(t, i)
+		}
+		k := [2]*Memcached{v.Server, successor}
+		if _, ok := routes[k]; !ok {
+			routes[k] = newRoute(v.Server, successor)
+		}
+		v.route = routes[k]
+	}
+
+	return &Continuum{Table: t, Hash: mode, replicas: replicas}, nil
+}
+
+// nextDistinctServer returns the server of the first point after t[i] which belongs to another server.
+// It returns nil if all points belong to the same server.
+func nextDistinctServer(t []*node, i int) *Memcached {
+	for j := 1; j < len(t); j++ {
+		if s := t[(i+j)%len(t)].Server; s != t[i].Server {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func crc32Points(s *Memcached, n int) []*node {
+	t := make([]*node, 0, n)
+	for i := 0; i < n; i++ {
+		h := fmt.Sprintf("%s-%d", s.Name, i)
+		hash := crc32.ChecksumIEEE([]byte(h))
+		t = append(t, &node{Hash: hash, Server: s})
+	}
+
+	return t
+}
+
+func ketamaPoints(s *Memcached, digests int) []*node {
+	t := make([]*node, 0, digests*4)
+	key := ketamaServerKey(s)
+	for i := 0; i < digests; i++ {
+		digest := md5.Sum([]byte(key + "-" + strconv.Itoa(i)))
+		for j := 0; j < 4; j++ {
+			t = append(t, &node{Hash: binary.LittleEndian.Uint32(digest[j*4 : j*4+4]), Server: s})
+		}
+	}
+
+	return t
+}
+
+// ketamaServerKey returns the identifier of the server for libketama.
+// libketama uses the address of the server. The unix socket is identified by the path.
+func ketamaServerKey(s *Memcached) string {
+	if s.Socket != "" {
+		return s.Socket
+	}
+
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+func ketamaHash(key []byte) uint32 {
+	digest := md5.Sum(key)
+	return binary.LittleEndian.Uint32(digest[0:4])
+}
+
+func (r *Continuum) Pick(key []byte) *Memcached {
+	return r.pickHash(r.hash(key))
+}
+
+// PickN returns the routing entry of the owner and the servers of the following points.
+// The servers are distinct and the number is at most n.
+// The replicas are not migrated, so the entries of them always serve the reads and writes.
+func (r *Continuum) PickN(key []byte, n int) []*Memcached {
+	if len(r.Table) == 0 || n < 1 {
+		return nil
+	}
+
+	i := r.index(r.hash(key))
+	result := []*Memcached{r.Table[i].entry()}
+	for j := 1; j < len(r.Table) && len(result) < n; j++ {
+		s := r.Table[(i+j)%len(r.Table)].Server
+		found := false
+		for _, v := range result {
+			if v.Name == s.Name {
+				found = true
+				break
 			}
-		default:
-			v.Server.Mode = ModeReadWrite
+		}
+		if !found {
+			result = append(result, r.replica(s))
 		}
 	}
 
-	return &Ring{Servers: servers, Table: t}, nil
+	return result
 }
 
-func (r *Ring) Pick(key []byte) *Memcached {
-	h := crc32.ChecksumIEEE(key)
+func (r *Continuum) hash(key []byte) uint32 {
+	if r.Hash == HashKetama {
+		return ketamaHash(key)
+	}
+
+	return crc32.ChecksumIEEE(key)
+}
+
+// replica returns the routing entry of s which is not migrated.
+func (r *Continuum) replica(s *Memcached) *Memcached {
+	if e, ok := r.replicas[s]; ok {
+		return e
+	}
+
+	return s
+}
+
+// pickHash returns the routing entry of the point which owns the hash h.
+func (r *Continuum) pickHash(h uint32) *Memcached {
+	return r.Table[r.index(h)].entry()
+}
+
+// index returns the index of the point which owns the hash h.
+func (r *Continuum) index(h uint32) int {
+	if r.Hash == HashKetama {
+		return r.indexKetama(h)
+	}
+
 	start := 0
 	end := len(r.Table) - 1
 	for end-start > 0 {
@@ -96,5 +530,35 @@ func (r *Ring) Pick(key []byte) *Memcached {
 		start = 0
 	}
 
-	return r.Table[start].Server
+	return start
+}
+
+// indexKetama returns the index of the first point which is equal to or larger than h.
+func (r *Continuum) indexKetama(h uint32) int {
+	i := sort.Search(len(r.Table), func(i int) bool {
+		return r.Table[i].Hash >= h
+	})
+	if i == len(r.Table) {
+		i = 0
+	}
+
+	return i
+}
+
+// Share returns the length of the arcs of each server.
+func (r *Continuum) Share() map[string]float64 {
+	share := make(map[string]float64)
+	if len(r.Table) == 1 {
+		share[r.Table[0].Server.Name] = 1
+		return share
+	}
+	for i, v := range r.Table {
+		prev := r.Table[len(r.Table)-1].Hash
+		if i > 0 {
+			prev = r.Table[i-1].Hash
+		}
+		share[v.Server.Name] += float64(v.Hash-prev) / (1 << 32)
+	}
+
+	return share
 }
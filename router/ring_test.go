@@ -1,6 +1,12 @@
 package router
 
-import "testing"
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"testing"
+)
 
 func TestRing_Pick(t *testing.T) {
 	cases := []struct {
@@ -33,15 +39,270 @@ func TestRing_Pick(t *testing.T) {
 		},
 	}
 
-	r := &Ring{}
+	r := &Continuum{}
 	for _, c := range cases {
 		r.Table = c.Table
 		s := r.Pick([]byte("test"))
-		if len(s) != 1 {
+		if s == nil {
 			t.Fatal("expected 1 server but not")
 		}
-		if s[0].Name != c.PickedServerName {
-			t.Errorf("expected host3 but not: %s", s[0].Name)
+		if s.Name != c.PickedServerName {
+			t.Errorf("expected %s but not: %s", c.PickedServerName, s.Name)
 		}
 	}
 }
+
+// testdata/ketama_4node.json is the expected placement of libcouchbase's ketama which is compatible with libketama.
+// It is taken from the test data of gocbcore. The index is the position of the server in the sorted server list.
+func TestRing_PickKetama(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/ketama_4node.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := make(map[string]struct {
+		Hash  uint32 `json:"hash"`
+		Index int    `json:"index"`
+	})
+	if err := json.Unmarshal(b, &expected); err != nil {
+		t.Fatal(err)
+	}
+
+	servers := []*Memcached{
+		{Name: "server0", Host: "10.0.0.195", Port: 12000},
+		{Name: "server1", Host: "localhost", Port: 12002},
+		{Name: "server2", Host: "localhost", Port: 12004},
+		{Name: "server3", Host: "localhost", Port: 12006},
+	}
+	r, err := NewRingWithHash(servers, HashKetama)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(r.Picker.(*Continuum).Table); l != 160*4 {
+		t.Fatalf("expected 640 points but got %d", l)
+	}
+
+	for key, e := range expected {
+		if h := ketamaHash([]byte(key)); h != e.Hash {
+			t.Fatalf("unexpected hash of %s: expected %d but got %d", key, e.Hash, h)
+		}
+		if s := r.Pick([]byte(key)); s.Name != servers[e.Index].Name {
+			t.Errorf("%s: expected %s but got %s", key, servers[e.Index].Name, s.Name)
+		}
+	}
+}
+
+func TestParseHashMode(t *testing.T) {
+	cases := []struct {
+		Value string
+		Mode  HashMode
+		Err   error
+	}{
+		{Value: "", Mode: HashCRC32},
+		{Value: "crc32", Mode: HashCRC32},
+		{Value: "ketama", Mode: HashKetama},
+		{Value: "jump", Mode: HashJump},
+		{Value: "rendezvous", Mode: HashRendezvous},
+		{Value: "maglev", Mode: HashMaglev},
+		{Value: "md5", Err: ErrUnknownHashMode},
+	}
+
+	for _, c := range cases {
+		m, err := ParseHashMode(c.Value)
+		if err != c.Err {
+			t.Errorf("%s: expected %v but got %v", c.Value, c.Err, err)
+			continue
+		}
+		if m != c.Mode {
+			t.Errorf("%s: expected %s but got %s", c.Value, c.Mode, m)
+		}
+	}
+}
+
+func TestNewRingWithConfig_VNodes(t *testing.T) {
+	cases := []struct {
+		Conf   RingConfig
+		Points []int
+	}{
+		{Conf: RingConfig{Hash: HashCRC32}, Points: []int{100, 200, 300}},
+		{Conf: RingConfig{Hash: HashCRC32, VNodes: 10}, Points: []int{10, 20, 30}},
+		// libketama: floor(weight / 6 * 40 * 3) digests
+		{Conf: RingConfig{Hash: HashKetama}, Points: []int{20 * 4, 40 * 4, 60 * 4}},
+		{Conf: RingConfig{Hash: HashKetama, VNodes: 10}, Points: []int{3 * 4, 5 * 4, 8 * 4}},
+	}
+
+	for _, c := range cases {
+		servers := newTestServers(3)
+		for i, v := range servers {
+			v.Weight = i + 1
+		}
+		r, err := NewRingWithConfig(servers, c.Conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		points := make(map[string]int)
+		for _, v := range r.Picker.(*Continuum).Table {
+			points[v.Server.Name]++
+		}
+		for i, v := range servers {
+			if points[v.Name] != c.Points[i] {
+				t.Errorf("%s vnodes=%d: expected %d points of %s but got %d", c.Conf.Hash, c.Conf.VNodes, c.Points[i], v.Name, points[v.Name])
+			}
+		}
+	}
+}
+
+func TestRing_Stats(t *testing.T) {
+	for _, mode := range pickerModes {
+		servers := newTestServers(4)
+		weights := []int{1, 2, 1, 4}
+		for i, v := range servers {
+			v.Weight = weights[i]
+		}
+		r, err := NewRingWithConfig(servers, RingConfig{Hash: mode, VNodes: 1000})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sampled := sampleShare(r.Picker, 100000)
+		total := 0.0
+		for i, s := range r.Stats() {
+			t.Logf("%s: %s weight=%d share=%.4f sampled=%.4f", mode, s.Name, s.Weight, s.Share, sampled[s.Name])
+			total += s.Share
+
+			if s.Weight != weights[i] {
+				t.Errorf("%s: expected weight %d but got %d", mode, weights[i], s.Weight)
+			}
+			if e := float64(weights[i]) / 8; math.Abs(s.Share-e) > 0.03 {
+				t.Errorf("%s: the share of %s is not proportional to the weight: %f", mode, s.Name, s.Share)
+			}
+			if math.Abs(s.Share-sampled[s.Name]) > 0.01 {
+				t.Errorf("%s: the share of %s is %f but %f of keys are picked", mode, s.Name, s.Share, sampled[s.Name])
+			}
+		}
+		if math.Abs(total-1) > 1e-6 {
+			t.Errorf("%s: the total of the share is %f", mode, total)
+		}
+	}
+}
+
+func TestRing_Migration(t *testing.T) {
+	cases := []struct {
+		Status        Status
+		Phase         Phase
+		OwnerMode     Mode
+		SuccessorMode Mode
+		// ReadFromOwner is true if the reads go to the migrating server.
+		ReadFromOwner bool
+	}{
+		{Status: StatusAdding, Phase: PhaseDeleteOnly, OwnerMode: ModeDeleteOnly, SuccessorMode: ModeReadWrite},
+		{Status: StatusAdding, Phase: PhaseWriteOnly, OwnerMode: ModeWriteOnly, SuccessorMode: ModeReadWrite},
+		{Status: StatusAdding, Phase: PhaseReadWrite, OwnerMode: ModeReadWrite, SuccessorMode: ModeWriteOnly, ReadFromOwner: true},
+		{Status: StatusDeleting, Phase: PhaseDeleteOnly, OwnerMode: ModeReadWrite, SuccessorMode: ModeDeleteOnly, ReadFromOwner: true},
+		{Status: StatusDeleting, Phase: PhaseWriteOnly, OwnerMode: ModeReadWrite, SuccessorMode: ModeWriteOnly, ReadFromOwner: true},
+		{Status: StatusDeleting, Phase: PhaseReadWrite, OwnerMode: ModeWriteOnly, SuccessorMode: ModeReadWrite},
+	}
+	keys := newTestKeys(10000)
+
+	for _, mode := range pickerModes {
+		// The successor is the owner in the ring without the migrating server.
+		// Jump can migrate only the last server, so the last server is migrating in all modes.
+		without, err := NewRingWithHash(newTestServers(4), mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range cases {
+			servers := newTestServers(5)
+			servers[4].Status = c.Status
+			servers[4].Phase = c.Phase
+			r, err := NewRingWithHash(servers, mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, v := range servers {
+				if v.next != nil {
+					t.Fatalf("%s: the shared server %s is modified", mode, v.Name)
+				}
+			}
+
+			migrated := 0
+			for _, key := range keys {
+				s := r.Pick(key)
+				if s.Name != "server4" {
+					if s.Mode != ModeReadWrite || s.next != nil {
+						t.Fatalf("%s: %s is not migrating but the route is", mode, s.Name)
+					}
+					continue
+				}
+				migrated++
+
+				if s.Mode != c.OwnerMode {
+					t.Fatalf("%s %d/%d: expected the mode of the owner %d but got %d", mode, c.Status, c.Phase, c.OwnerMode, s.Mode)
+				}
+				if s.next == nil {
+					t.Fatalf("%s %d/%d: the route doesn't have the successor", mode, c.Status, c.Phase)
+				}
+				if s.next.Mode != c.SuccessorMode {
+					t.Fatalf("%s %d/%d: expected the mode of the successor %d but got %d", mode, c.Status, c.Phase, c.SuccessorMode, s.next.Mode)
+				}
+				if e := without.Pick(key).Name; s.next.Name != e {
+					t.Fatalf("%s %d/%d: %s: expected the successor %s but got %s", mode, c.Status, c.Phase, key, e, s.next.Name)
+				}
+				if read := s.ReadServer(); (read.Name == "server4") != c.ReadFromOwner {
+					t.Fatalf("%s %d/%d: the reads go to %s", mode, c.Status, c.Phase, read.Name)
+				}
+			}
+			if migrated == 0 {
+				t.Fatalf("%s: no key is owned by the migrating server", mode)
+			}
+		}
+	}
+}
+
+func TestContinuum_Successor(t *testing.T) {
+	// Find the servers which the last point belongs to the migrating server, so the successor wraps around.
+	var servers []*Memcached
+	var c *Continuum
+	for i := 0; ; i++ {
+		servers = []*Memcached{
+			{Name: "server0"},
+			{Name: "server1"},
+			{Name: fmt.Sprintf("adding%d", i), Status: StatusAdding, Phase: PhaseWriteOnly},
+		}
+		var err error
+		c, err = NewContinuum(servers, HashCRC32, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Table[len(c.Table)-1].Server == servers[2] {
+			break
+		}
+	}
+
+	for i, v := range c.Table {
+		if v.Server != servers[2] {
+			continue
+		}
+
+		var expected *Memcached
+		for j := i + 1; ; j++ {
+			if s := c.Table[j%len(c.Table)].Server; s != servers[2] {
+				expected = s
+				break
+			}
+		}
+		if v.route.next.Name != expected.Name {
+			t.Errorf("point %d: expected the successor %s but got %s", i, expected.Name, v.route.next.Name)
+		}
+	}
+
+	// The only server doesn't have the successor.
+	c, err := NewContinuum([]*Memcached{{Name: "adding", Status: StatusAdding, Phase: PhaseWriteOnly}}, HashCRC32, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Pick([]byte("key")); s.Mode != ModeReadWrite || s.next != nil {
+		t.Error("the only server must serve the reads and writes")
+	}
+}
@@ -1,17 +1,37 @@
 package router
 
 import (
+	"bufio"
 	"encoding/binary"
 	"io"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
 
 	"github.com/f110/memcached-operator/client"
 	"github.com/f110/memcached-operator/logger"
 )
 
 type Router struct {
-	Addr    string
+	Addr string
+	// MaxBodySize is the maximum length of the body of the request. Zero is DefaultMaxBodySize.
+	MaxBodySize int
+	// Cluster is the initial cluster. Use SetCluster to replace it while serving.
 	Cluster *Cluster
+
+	initOnce sync.Once
+	current  atomic.Value
+	conns    connStats
+}
+
+// snapshot is the cluster which serves the requests.
+// The request holds the read lock until it finishes, so the retired snapshot can wait for the in-flight requests.
+type snapshot struct {
+	cluster *Cluster
+
+	mu      sync.RWMutex
+	retired bool
 }
 
 func NewRouter(addr string, servers []*Memcached) *Router {
@@ -21,8 +41,65 @@ func NewRouter(addr string, servers []*Memcached) *Router {
 	}
 }
 
+// SetCluster replaces the cluster which serves the requests.
+// The requests which have started on the previous cluster finish on it.
+// The returned channel is closed when no request uses the previous cluster.
+func (s *Router) SetCluster(c *Cluster) <-chan struct{} {
+	s.init()
+	prev := s.current.Swap(&snapshot{cluster: c}).(*snapshot)
+
+	done := make(chan struct{})
+	go func() {
+		prev.mu.Lock()
+		prev.retired = true
+		prev.mu.Unlock()
+		close(done)
+	}()
+
+	return done
+}
+
+func (s *Router) init() {
+	s.initOnce.Do(func() {
+		s.current.Store(&snapshot{cluster: s.Cluster})
+	})
+}
+
+// acquire returns the current snapshot. The caller must call release after the request finishes.
+func (s *Router) acquire() *snapshot {
+	s.init()
+	for {
+		snap := s.current.Load().(*snapshot)
+		snap.mu.RLock()
+		if !snap.retired {
+			return snap
+		}
+		// SetCluster replaced the snapshot after it was loaded.
+		snap.mu.RUnlock()
+	}
+}
+
+func (snap *snapshot) release() {
+	snap.mu.RUnlock()
+}
+
+// ListenAndServe listens on s.Addr and serves the requests.
+// s.Addr accepts the same format as client.Dial. e.g. ":11211" or "unix:///var/run/router.sock"
 func (s *Router) ListenAndServe() error {
-	l, err := net.Listen("tcp", s.Addr)
+	network, address, err := client.ParseAddr(s.Addr)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		// Remove the socket file which is left by the previous process
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return err
+			}
+		}
+	}
+
+	l, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
@@ -35,90 +112,142 @@ func (s *Router) ListenAndServe() error {
 	}
 }
 
-func (s *Router) serve(conn net.Conn) {
-	buf := make([]byte, 1500)
-	msg := make([]byte, 0)
-	for {
-		n, err := conn.Read(buf)
-		if err == io.EOF {
-			return
-		}
-		if err != nil {
-			return
-		}
-		if n == 1500 {
-			msg = append(msg, buf...)
-			continue
-		}
+// maxInFlight is the number of the requests of a connection which wait for the responses.
+// The router stops reading the connection while the limit is reached.
+const maxInFlight = 1024
 
-		s.parseRequest(conn, msg)
-		msg = msg[:0]
-	}
+// maxBatchKeys is the maximum number of the keys of a multi-get batch.
+const maxBatchKeys = 1024
+
+// pending is the response which is written in the order of the requests.
+type pending struct {
+	// raw is the response which the router makes without the backend. It is nil if the response is omitted.
+	raw []byte
+	// result receives the response of the backend. It is nil if raw is the response.
+	result chan *client.Item
+	// encode encodes the response of the backend. It returns nil if the response is omitted.
+	encode func(res *client.Item) []byte
+	// quit closes the connection after the response is written.
+	quit bool
 }
 
-func (s *Router) parseRequest(conn net.Conn, req []byte) {
-	if req[0] != client.MagicRequest {
-		return
-	}
+// serve processes the requests of conn as a pipeline.
+// The requests are sent to the backends in the order of the requests, and the responses are written in the same order
+// even if the backends respond out of order.
+// The protocol is detected by the first byte. The binary protocol starts with the magic byte and the others are the text protocol.
+func (s *Router) serve(conn net.Conn) {
+	s.conns.open()
+	defer s.conns.close()
 
-	opcode := req[1]
-	keyLength := int(binary.BigEndian.Uint16(req[2:4]))
-	extraLength := int(req[4])
-	totalBody := int(binary.BigEndian.Uint32(req[8:12]))
-	opaque := binary.BigEndian.Uint32(req[12:16])
-	cas := binary.BigEndian.Uint64(req[16:24])
-	valueLength := totalBody - extraLength - keyLength
-	req = req[24:]
-	var extra []byte
-	if extraLength > 0 {
-		extra = make([]byte, extraLength)
-		copy(extra, req[:extraLength])
-		req = req[extraLength:]
-	}
-	var key []byte
-	if keyLength > 0 {
-		key = make([]byte, keyLength)
-		copy(key, req[:keyLength])
-		req = req[keyLength:]
+	queue := make(chan *pending, maxInFlight)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		writeResponses(conn, queue)
+	}()
+	defer func() {
+		close(queue)
+		<-done
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	b, err := r.Peek(1)
+	if err != nil {
+		return
 	}
-	var value []byte
-	if valueLength > 0 {
-		value := make([]byte, valueLength)
-		copy(value, req[:valueLength])
-		req = req[:valueLength]
+	if b[0] == client.MagicRequest {
+		s.serveBinary(r, queue)
+	} else {
+		s.serveText(r, queue)
 	}
-
-	s.handle(conn, opcode, key, value, cas, extra, opaque)
 }
 
-func (s *Router) handle(conn net.Conn, opcode byte, key, value []byte, cas uint64, extra []byte, opaque uint32) {
-	switch opcode {
-	case client.OpcodeGet:
-		v, err := s.Cluster.Get(key)
-		if err != nil {
-			logger.Log.Info(err)
+// serveBinary reads the request frames of the binary protocol from r until the client quits.
+// The malformed frame gets the error response. The connection is closed if the boundary of the next frame is unknown.
+//
+// The consecutive GetQ and GetKQ are a multi-get batch. The batch is sent when the other request (usually Noop) terminates it,
+// so the hits are written before the response of the terminator.
+func (s *Router) serveBinary(rd *bufio.Reader, queue chan<- *pending) {
+	var batch []*request
+	flush := func() {
+		if len(batch) > 0 {
+			queue <- s.handleGetMulti(batch)
+			batch = nil
 		}
-		if v == nil {
-			return
-		}
-		res := <-v
-		_, err = conn.Write(res.Raw)
+	}
+
+	r := newFrameReader(rd, s.MaxBodySize)
+	for {
+		req, err := r.next()
 		if err != nil {
-			logger.Log.Info(err)
+			flush()
+			fe, ok := err.(*frameError)
+			if !ok {
+				if err != io.EOF {
+					logger.Log.Debugw("failed to read the request", "err", err)
+				}
+				return
+			}
+			logger.Log.Debugw("invalid request", "err", err)
+			queue <- &pending{raw: errorResponse(fe)}
+			if fe.fatal {
+				return
+			}
+			continue
 		}
-	case client.OpcodeSet:
-		expiration := int(binary.BigEndian.Uint32(extra[4:8]))
-		v, err := s.Cluster.Set(key, value, cas, extra[:4], expiration)
-		if err != nil {
-			logger.Log.Info(err)
+
+		if (req.Opcode == client.OpcodeGetQ || req.Opcode == client.OpcodeGetKQ) && validate(req) == client.StatusNoError {
+			batch = append(batch, req)
+			if len(batch) >= maxBatchKeys {
+				flush()
+			}
+			continue
 		}
-		if v == nil {
+		flush()
+
+		p := s.handle(req)
+		queue <- p
+		if p.quit {
 			return
 		}
-		res := <-v
-		_, err = conn.Write(res.Raw)
-		if err != nil {
-			logger.Log.Info(err)
+	}
+}
+
+// writeResponses writes the responses of queue in order until queue is closed.
+// The responses are buffered while the next response is ready.
+func writeResponses(conn net.Conn, queue <-chan *pending) {
+	w := bufio.NewWriter(conn)
+	for p := range queue {
+		b := p.raw
+		if p.result != nil {
+			b = p.encode(<-p.result)
+		}
+		if b != nil {
+			w.Write(b)
+		}
+		if len(queue) == 0 {
+			if err := w.Flush(); err != nil {
+				logger.Log.Debugw("failed to write the response", "err", err)
+			}
 		}
 	}
+	w.Flush()
+}
+
+func encodeResponse(opcode byte, status uint16, opaque uint32, cas uint64, extra, key, value []byte) []byte {
+	buf := make([]byte, 24+len(extra)+len(key)+len(value))
+	buf[0] = client.MagicResponse
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = byte(len(extra))
+	binary.BigEndian.PutUint16(buf[6:8], status)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extra)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	copy(buf[24:], extra)
+	copy(buf[24+len(extra):], key)
+	copy(buf[24+len(extra)+len(key):], value)
+
+	return buf
 }
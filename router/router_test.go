@@ -0,0 +1,464 @@
+package router
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// newTestRouter serves r on the loopback interface and returns the connection to it.
+func newTestRouter(t *testing.T, r *Router) net.Conn {
+	return dialTestRouter(t, serveTestRouter(t, r))
+}
+
+// serveTestRouter serves r on the loopback interface and returns the address.
+func serveTestRouter(t *testing.T, r *Router) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func dialTestRouter(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	return conn
+}
+
+func encodeTestRequest(opcode byte, opaque uint32, cas uint64, extra, key, value []byte) []byte {
+	buf := make([]byte, 24+len(extra)+len(key)+len(value))
+	buf[0] = client.MagicRequest
+	buf[1] = opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(key)))
+	buf[4] = byte(len(extra))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(extra)+len(key)+len(value)))
+	binary.BigEndian.PutUint32(buf[12:16], opaque)
+	binary.BigEndian.PutUint64(buf[16:24], cas)
+	copy(buf[24:], extra)
+	copy(buf[24+len(extra):], key)
+	copy(buf[24+len(extra)+len(key):], value)
+
+	return buf
+}
+
+type testResponse struct {
+	Opcode byte
+	Status uint16
+	Opaque uint32
+	CAS    uint64
+	Extra  []byte
+	Key    []byte
+	Value  []byte
+}
+
+func readTestResponse(t *testing.T, r io.Reader) *testResponse {
+	t.Helper()
+
+	res, err := decodeTestResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func decodeTestResponse(r io.Reader) (*testResponse, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != client.MagicResponse {
+		return nil, fmt.Errorf("unexpected magic: %x", header[0])
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[8:12]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	keyLength := int(binary.BigEndian.Uint16(header[2:4]))
+	extraLength := int(header[4])
+
+	return &testResponse{
+		Opcode: header[1],
+		Status: binary.BigEndian.Uint16(header[6:8]),
+		Opaque: binary.BigEndian.Uint32(header[12:16]),
+		CAS:    binary.BigEndian.Uint64(header[16:24]),
+		Extra:  body[:extraLength],
+		Key:    body[extraLength : extraLength+keyLength],
+		Value:  body[extraLength+keyLength:],
+	}, nil
+}
+
+func setExtra(flags uint32, expiration uint32) []byte {
+	extra := make([]byte, 8)
+	binary.BigEndian.PutUint32(extra[:4], flags)
+	binary.BigEndian.PutUint32(extra[4:], expiration)
+	return extra
+}
+
+func TestRouter_Serve(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+
+	// The frames are pipelined in a single write.
+	var buf bytes.Buffer
+	buf.Write(encodeTestRequest(client.OpcodeSet, 1, 0, setExtra(0, 0), []byte("key1"), []byte("value1")))
+	buf.Write(encodeTestRequest(client.OpcodeSet, 2, 0, setExtra(0, 0), []byte("key2"), []byte("value2")))
+	buf.Write(encodeTestRequest(client.OpcodeGet, 3, 0, nil, []byte("key1"), nil))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if res := readTestResponse(t, conn); res.Opcode != client.OpcodeSet || res.Status != client.StatusNoError {
+			t.Fatalf("unexpected response: %+v", res)
+		}
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusNoError || string(res.Value) != "value1" {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// The frame is fragmented into single bytes.
+	for _, b := range encodeTestRequest(client.OpcodeGet, 4, 0, nil, []byte("key2"), nil) {
+		if _, err := conn.Write([]byte{b}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusNoError || string(res.Value) != "value2" {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// The value which is larger than the read buffer.
+	large := bytes.Repeat([]byte("a"), 10000)
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeSet, 5, 0, setExtra(0, 0), []byte("large"), large)); err != nil {
+		t.Fatal(err)
+	}
+	readTestResponse(t, conn)
+	if v, ok := c.servers[c.Ring.Pick([]byte("large")).Name].Value("large"); !ok || !bytes.Equal(v, large) {
+		t.Error("the large value is not stored")
+	}
+}
+
+func TestRouter_ServeMalformed(t *testing.T) {
+	c := newTestCluster(t, 1, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster, MaxBodySize: 100})
+
+	// The key is longer than the body.
+	req := encodeTestRequest(client.OpcodeGet, 1, 0, nil, []byte("key"), nil)
+	binary.BigEndian.PutUint16(req[2:4], 10)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusInvalidArguments || res.Opaque != 1 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// Set without the extras.
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeSet, 2, 0, nil, []byte("key"), []byte("value"))); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusInvalidArguments || res.Opaque != 2 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// The body is discarded and the next frame is processed.
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeSet, 3, 0, setExtra(0, 0), []byte("key"), make([]byte, 200))); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusValueTooLarge || res.Opaque != 3 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeGet, 4, 0, nil, []byte("key"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusKeyNotFound {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	// The connection is closed after the invalid magic.
+	req = encodeTestRequest(client.OpcodeGet, 5, 0, nil, []byte("key"), nil)
+	req[0] = 0x81
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusInvalidArguments {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection is closed but got %v", err)
+	}
+}
+
+func counterExtra(delta, initial uint64, expiration uint32) []byte {
+	extra := make([]byte, 20)
+	binary.BigEndian.PutUint64(extra[0:8], delta)
+	binary.BigEndian.PutUint64(extra[8:16], initial)
+	binary.BigEndian.PutUint32(extra[16:20], expiration)
+	return extra
+}
+
+func TestRouter_Opcodes(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	touch := make([]byte, 4)
+	binary.BigEndian.PutUint32(touch, 100)
+
+	cases := []struct {
+		Name    string
+		Request []byte
+		// Status is the status of the response. -1 means no response.
+		Status int
+		Value  string
+		Key    string
+	}{
+		{Name: "Add", Request: encodeTestRequest(client.OpcodeAdd, 1, 0, setExtra(0, 0), []byte("key"), []byte("b")), Status: client.StatusNoError},
+		{Name: "AddExists", Request: encodeTestRequest(client.OpcodeAdd, 2, 0, setExtra(0, 0), []byte("key"), []byte("b")), Status: client.StatusKeyExists},
+		{Name: "Append", Request: encodeTestRequest(client.OpcodeAppend, 3, 0, nil, []byte("key"), []byte("c")), Status: client.StatusNoError},
+		{Name: "PrependQ", Request: encodeTestRequest(client.OpcodePrependQ, 4, 0, nil, []byte("key"), []byte("a")), Status: -1},
+		{Name: "GetK", Request: encodeTestRequest(client.OpcodeGetK, 5, 0, nil, []byte("key"), nil), Status: client.StatusNoError, Value: "abc", Key: "key"},
+		{Name: "GetQMiss", Request: encodeTestRequest(client.OpcodeGetQ, 6, 0, nil, []byte("missing"), nil), Status: -1},
+		{Name: "ReplaceMiss", Request: encodeTestRequest(client.OpcodeReplace, 7, 0, setExtra(0, 0), []byte("missing"), []byte("v")), Status: client.StatusKeyNotFound},
+		{Name: "SetQ", Request: encodeTestRequest(client.OpcodeSetQ, 8, 0, setExtra(0, 0), []byte("counter"), []byte("10")), Status: -1},
+		{Name: "Incr", Request: encodeTestRequest(client.OpcodeIncr, 9, 0, counterExtra(5, 0, 0), []byte("counter"), nil), Status: client.StatusNoError, Value: "\x00\x00\x00\x00\x00\x00\x00\x0f"},
+		{Name: "DecrNoCreate", Request: encodeTestRequest(client.OpcodeDecr, 10, 0, counterExtra(1, 0, 0xffffffff), []byte("missing"), nil), Status: client.StatusKeyNotFound},
+		{Name: "Touch", Request: encodeTestRequest(client.OpcodeTouch, 11, 0, touch, []byte("key"), nil), Status: client.StatusNoError},
+		{Name: "GATQ", Request: encodeTestRequest(client.OpcodeGATQ, 12, 0, touch, []byte("key"), nil), Status: client.StatusNoError, Value: "abc"},
+		{Name: "Del", Request: encodeTestRequest(client.OpcodeDel, 13, 0, nil, []byte("key"), nil), Status: client.StatusNoError},
+		{Name: "DelQMiss", Request: encodeTestRequest(client.OpcodeDelQ, 14, 0, nil, []byte("key"), nil), Status: client.StatusKeyNotFound},
+		{Name: "Version", Request: encodeTestRequest(client.OpcodeVersion, 15, 0, nil, nil, nil), Status: client.StatusNoError, Value: protocolVersion},
+		{Name: "Unknown", Request: encodeTestRequest(0x50, 16, 0, nil, nil, nil), Status: client.StatusUnknownCommand},
+		{Name: "Noop", Request: encodeTestRequest(client.OpcodeNoop, 17, 0, nil, nil, nil), Status: client.StatusNoError},
+	}
+
+	for _, tc := range cases {
+		if _, err := conn.Write(tc.Request); err != nil {
+			t.Fatal(err)
+		}
+		if tc.Status < 0 {
+			continue
+		}
+		res := readTestResponse(t, conn)
+		if res.Opcode != tc.Request[1] || int(res.Status) != tc.Status {
+			t.Fatalf("%s: unexpected response: %+v", tc.Name, res)
+		}
+		if tc.Value != "" && string(res.Value) != tc.Value {
+			t.Errorf("%s: expected %q but got %q", tc.Name, tc.Value, res.Value)
+		}
+		if string(res.Key) != tc.Key {
+			t.Errorf("%s: expected the key %q but got %q", tc.Name, tc.Key, res.Key)
+		}
+	}
+
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeQuit, 18, 0, nil, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Opcode != client.OpcodeQuit {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the connection is closed but got %v", err)
+	}
+}
+
+func TestRouter_PipelineOrder(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	slow := ownedKey(t, c.Ring, "server0")
+	fast := ownedKey(t, c.Ring, "server1")
+	c.set(t, slow, "slow")
+	c.set(t, fast, "fast")
+
+	// The response of server1 arrives first but it is written after the response of server0.
+	c.servers["server0"].Pause()
+	var buf bytes.Buffer
+	buf.Write(encodeTestRequest(client.OpcodeGet, 100, 0, nil, []byte(slow), nil))
+	buf.Write(encodeTestRequest(client.OpcodeGet, 101, 0, nil, []byte(fast), nil))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatal("the response is written before the preceding response")
+	}
+	c.servers["server0"].Resume()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	for _, expect := range []struct {
+		Opaque uint32
+		Value  string
+	}{{Opaque: 100, Value: "slow"}, {Opaque: 101, Value: "fast"}} {
+		res := readTestResponse(t, conn)
+		if res.Opaque != expect.Opaque || string(res.Value) != expect.Value {
+			t.Fatalf("expected %d %q but got %d %q", expect.Opaque, expect.Value, res.Opaque, res.Value)
+		}
+	}
+}
+
+func TestRouter_ConcurrentPipelines(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	addr := serveTestRouter(t, &Router{Cluster: c.Cluster})
+
+	const clients, requests = 8, 100
+	conns := make([]net.Conn, clients)
+	for i := range conns {
+		conns[i] = dialTestRouter(t, addr)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i, conn := range conns {
+		wg.Add(1)
+		go func(i int, conn net.Conn) {
+			defer wg.Done()
+
+			// Each client uses the same opaques as the others.
+			var buf bytes.Buffer
+			for j := 0; j < requests; j++ {
+				key := []byte(fmt.Sprintf("client%d-%d", i, j))
+				buf.Write(encodeTestRequest(client.OpcodeSet, uint32(j), 0, setExtra(0, 0), key, []byte(fmt.Sprintf("value%d-%d", i, j))))
+				buf.Write(encodeTestRequest(client.OpcodeGetK, uint32(j), 0, nil, key, nil))
+			}
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				errs <- err
+				return
+			}
+
+			for j := 0; j < requests; j++ {
+				set, err := decodeTestResponse(conn)
+				if err != nil {
+					errs <- err
+					return
+				}
+				get, err := decodeTestResponse(conn)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if set.Opcode != client.OpcodeSet || set.Opaque != uint32(j) || set.Status != client.StatusNoError {
+					errs <- fmt.Errorf("client%d: unexpected response of set %d: %+v", i, j, set)
+					return
+				}
+				if get.Opcode != client.OpcodeGetK || get.Opaque != uint32(j) || string(get.Value) != fmt.Sprintf("value%d-%d", i, j) {
+					errs <- fmt.Errorf("client%d: unexpected response of get %d: %+v", i, j, get)
+					return
+				}
+				if get.CAS != set.CAS || get.CAS == 0 {
+					errs <- fmt.Errorf("client%d: the CAS of get %d is %d but set returned %d", i, j, get.CAS, set.CAS)
+					return
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestRouter_MultiGet(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+
+	const n = 30
+	for i := 0; i < n; i += 2 {
+		c.set(t, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i))
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < n; i++ {
+		opcode := byte(client.OpcodeGetKQ)
+		if i%4 == 0 {
+			opcode = client.OpcodeGetQ
+		}
+		buf.Write(encodeTestRequest(opcode, uint32(i), 0, nil, []byte(fmt.Sprintf("key%d", i)), nil))
+	}
+	buf.Write(encodeTestRequest(client.OpcodeNoop, n, 0, nil, nil, nil))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < n; i += 2 {
+		res := readTestResponse(t, conn)
+		if res.Opaque != uint32(i) || res.Status != client.StatusNoError || string(res.Value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("unexpected response of key%d: %+v", i, res)
+		}
+		if i%4 == 0 {
+			if res.Opcode != client.OpcodeGetQ || len(res.Key) != 0 {
+				t.Errorf("unexpected response of GetQ: %+v", res)
+			}
+		} else if res.Opcode != client.OpcodeGetKQ || string(res.Key) != fmt.Sprintf("key%d", i) {
+			t.Errorf("unexpected response of GetKQ: %+v", res)
+		}
+	}
+	if res := readTestResponse(t, conn); res.Opcode != client.OpcodeNoop || res.Opaque != n {
+		t.Fatalf("expected Noop but got %+v", res)
+	}
+
+	// Each backend receives the keys as a single batch.
+	for name, s := range c.servers {
+		if r := s.Requests(client.OpcodeNoop); r != 1 {
+			t.Errorf("%s: expected 1 batch but got %d", name, r)
+		}
+		if r := s.Requests(client.OpcodeGet); r != 0 {
+			t.Errorf("%s: the keys are sent by Get: %d", name, r)
+		}
+	}
+}
+
+func TestRouter_MultiGetPipeline(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	slow := ownedKey(t, c.Ring, "server0")
+	fast := ownedKey(t, c.Ring, "server1")
+	c.set(t, slow, "slow")
+
+	// The request after the batch is sent while the backend of the batch doesn't respond.
+	c.servers["server0"].Pause()
+	var buf bytes.Buffer
+	buf.Write(encodeTestRequest(client.OpcodeGetKQ, 100, 0, nil, []byte(slow), nil))
+	buf.Write(encodeTestRequest(client.OpcodeSet, 101, 0, make([]byte, 8), []byte(fast), []byte("fast")))
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.servers["server1"].Value(fast); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.servers["server0"].Resume()
+			t.Fatal("the request after the batch is not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.servers["server0"].Resume()
+
+	if res := readTestResponse(t, conn); res.Opaque != 100 || string(res.Value) != "slow" {
+		t.Fatalf("unexpected response of the batch: %+v", res)
+	}
+	if res := readTestResponse(t, conn); res.Opaque != 101 || res.Status != client.StatusNoError {
+		t.Fatalf("unexpected response of Set: %+v", res)
+	}
+}
@@ -0,0 +1,268 @@
+package router
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/logger"
+)
+
+var errStatsTimeout = errors.New("router: stats timed out")
+
+// statsTimeout is the time to wait for the stats of each server.
+const statsTimeout = 2 * time.Second
+
+// started is the time when the process started. It is the origin of the uptime of stats.
+var started = time.Now()
+
+// nonAdditiveStats are the statistics of the servers which are not summed up.
+// pid, uptime, time and version of the router are returned instead.
+var nonAdditiveStats = map[string]bool{
+	"pid":              true,
+	"uptime":           true,
+	"time":             true,
+	"version":          true,
+	"libevent":         true,
+	"pointer_size":     true,
+	"max_connections":  true,
+	"threads":          true,
+	"reserved_fds":     true,
+	"hash_power_level": true,
+}
+
+// BackendStats is the statistics of a server.
+type BackendStats struct {
+	Name  string
+	Stats []client.Stat
+	Err   error
+}
+
+// Stats sends the stats command of group to the servers of the ring concurrently.
+// The results are in the order of Ring.Servers. The server which doesn't respond within statsTimeout has the error.
+func (c *Cluster) Stats(group string) []BackendStats {
+	result := make([]BackendStats, len(c.Ring.Servers))
+	var wg sync.WaitGroup
+	for i, v := range c.Ring.Servers {
+		wg.Add(1)
+		go func(i int, s *Memcached) {
+			defer wg.Done()
+			stats, err := serverStats(s, group, statsTimeout)
+			result[i] = BackendStats{Name: s.Name, Stats: stats, Err: err}
+		}(i, v)
+	}
+	wg.Wait()
+
+	return result
+}
+
+func serverStats(s *Memcached, group string, timeout time.Duration) ([]client.Stat, error) {
+	if s.Client == nil {
+		return nil, errNotConnected
+	}
+	c, err := s.Client.StatsAsync(group)
+	if err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	var stats []client.Stat
+	for {
+		select {
+		case v, ok := <-c:
+			if !ok {
+				return stats, nil
+			}
+			if v.Err != nil {
+				// The stream is closed after the error
+				return nil, v.Err
+			}
+			if len(v.Key) > 0 {
+				stats = append(stats, client.Stat{Name: string(v.Key), Value: string(v.Value)})
+			}
+		case <-t.C:
+			// The client blocks until the rest of the stream is received
+			go func() {
+				for range c {
+				}
+			}()
+			return nil, errStatsTimeout
+		}
+	}
+}
+
+// sumStats sums up the numeric statistics of the servers in the order of the first appearance.
+// The non-numeric statistics, the non-additive statistics and the servers which failed are skipped.
+func sumStats(backends []BackendStats) []client.Stat {
+	type sum struct {
+		name    string
+		integer int64
+		float   float64
+		isFloat bool
+	}
+
+	var sums []*sum
+	index := make(map[string]*sum)
+	for _, b := range backends {
+		if b.Err != nil {
+			continue
+		}
+		for _, v := range b.Stats {
+			if nonAdditiveStats[v.Name] {
+				continue
+			}
+			f, err := strconv.ParseFloat(v.Value, 64)
+			if err != nil {
+				continue
+			}
+			n, err := strconv.ParseInt(v.Value, 10, 64)
+			s, ok := index[v.Name]
+			if !ok {
+				s = &sum{name: v.Name}
+				index[v.Name] = s
+				sums = append(sums, s)
+			}
+			s.integer += n
+			s.float += f
+			if err != nil {
+				s.isFloat = true
+			}
+		}
+	}
+
+	stats := make([]client.Stat, len(sums))
+	for i, v := range sums {
+		if v.isFloat {
+			stats[i] = client.Stat{Name: v.name, Value: strconv.FormatFloat(v.float, 'f', 6, 64)}
+		} else {
+			stats[i] = client.Stat{Name: v.name, Value: strconv.FormatInt(v.integer, 10)}
+		}
+	}
+
+	return stats
+}
+
+// isStatsGroup reports whether group is known by stats.
+func isStatsGroup(group string) bool {
+	switch group {
+	case "", "detail", "router":
+		return true
+	default:
+		return false
+	}
+}
+
+// stats returns the statistics of group of c. group must be known by isStatsGroup.
+// The empty group returns pid, uptime, time and version of the router followed by the sum of the statistics of the servers.
+// "detail" returns the statistics of each server which are prefixed by "<server name>:",
+// and "router" returns the statistics of the router itself.
+// stats waits for the servers up to statsTimeout, so it is called in background.
+func (s *Router) stats(c *Cluster, group string) []client.Stat {
+	if group == "router" {
+		return s.routerStats(c)
+	}
+
+	backends := c.Stats("")
+	for _, v := range backends {
+		if v.Err != nil {
+			logger.Log.Infow("failed to get the stats", "server", v.Name, "err", v.Err)
+		}
+	}
+	if group == "detail" {
+		var stats []client.Stat
+		for _, b := range backends {
+			if b.Err != nil {
+				stats = append(stats, client.Stat{Name: b.Name + ":error", Value: b.Err.Error()})
+				continue
+			}
+			for _, v := range b.Stats {
+				stats = append(stats, client.Stat{Name: b.Name + ":" + v.Name, Value: v.Value})
+			}
+		}
+		return stats
+	}
+
+	return append(processStats(), sumStats(backends)...)
+}
+
+// processStats returns pid, uptime, time and version of the router.
+func processStats() []client.Stat {
+	now := time.Now()
+	return []client.Stat{
+		{Name: "pid", Value: strconv.Itoa(os.Getpid())},
+		{Name: "uptime", Value: strconv.FormatInt(int64(now.Sub(started).Seconds()), 10)},
+		{Name: "time", Value: strconv.FormatInt(now.Unix(), 10)},
+		{Name: "version", Value: protocolVersion},
+	}
+}
+
+func (s *Router) routerStats(c *Cluster) []client.Stat {
+	openBreakers := 0
+	for _, v := range c.Ring.Servers {
+		if v.Breaker != nil && v.Breaker.State() != BreakerClosed {
+			openBreakers++
+		}
+	}
+	gutter := 0
+	if c.Gutter != nil && c.Gutter.Ring != nil {
+		gutter = len(c.Gutter.Ring.Servers)
+	}
+	replicas := c.Replicas
+	if replicas < 1 {
+		replicas = 1
+	}
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+
+	return append(processStats(), []client.Stat{
+		{Name: "curr_connections", Value: strconv.FormatInt(s.conns.current(), 10)},
+		{Name: "total_connections", Value: strconv.FormatInt(s.conns.total(), 10)},
+		{Name: "servers", Value: strconv.Itoa(len(c.Ring.Servers))},
+		{Name: "ejected_servers", Value: strconv.Itoa(len(c.Ring.Ejected()))},
+		{Name: "open_breakers", Value: strconv.Itoa(openBreakers)},
+		{Name: "gutter_servers", Value: strconv.Itoa(gutter)},
+		{Name: "replicas", Value: strconv.Itoa(replicas)},
+		{Name: "write_ack", Value: c.WriteAck.String()},
+		{Name: "max_body_size", Value: strconv.Itoa(maxBodySize)},
+	}...)
+}
+
+// connStats counts the connections of the router.
+type connStats struct {
+	mu       sync.Mutex
+	curr     int64
+	accepted int64
+}
+
+func (c *connStats) open() {
+	c.mu.Lock()
+	c.curr++
+	c.accepted++
+	c.mu.Unlock()
+}
+
+func (c *connStats) close() {
+	c.mu.Lock()
+	c.curr--
+	c.mu.Unlock()
+}
+
+func (c *connStats) current() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.curr
+}
+
+func (c *connStats) total() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.accepted
+}
@@ -0,0 +1,176 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/f110/memcached-operator/client"
+)
+
+// readTestStats sends "stats <group>" and returns the statistics.
+func readTestStats(t *testing.T, conn io.ReadWriter, r *bufio.Reader, group string) map[string]string {
+	t.Helper()
+
+	if _, err := io.WriteString(conn, strings.TrimSpace("stats "+group)+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[string]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			return stats
+		}
+		fields := strings.SplitN(strings.TrimSuffix(line, "\r\n"), " ", 3)
+		if len(fields) != 3 || fields[0] != "STAT" {
+			t.Fatalf("unexpected line: %q", line)
+		}
+		stats[fields[1]] = fields[2]
+	}
+}
+
+func TestRouter_Stats(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	r := bufio.NewReader(conn)
+
+	const n = 30
+	for i := 0; i < n; i++ {
+		c.set(t, fmt.Sprintf("key%d", i), "value")
+	}
+
+	stats := readTestStats(t, conn, r, "")
+	if stats["curr_items"] != fmt.Sprint(n) {
+		t.Errorf("expected curr_items is the sum of the servers but got %s", stats["curr_items"])
+	}
+	if stats["version"] != protocolVersion {
+		t.Errorf("expected the version of the router but got %s", stats["version"])
+	}
+	if stats["rusage_user"] != "1.500000" {
+		t.Errorf("unexpected rusage_user: %s", stats["rusage_user"])
+	}
+	if _, ok := stats["evictions"]; !ok {
+		t.Error("evictions is missing")
+	}
+
+	detail := readTestStats(t, conn, r, "detail")
+	total := 0
+	for i := 0; i < 3; i++ {
+		v, ok := detail[fmt.Sprintf("server%d:curr_items", i)]
+		if !ok {
+			t.Fatalf("the stats of server%d are missing: %v", i, detail)
+		}
+		var items int
+		fmt.Sscan(v, &items)
+		total += items
+	}
+	if total != n {
+		t.Errorf("expected %d items in total but got %d", n, total)
+	}
+
+	router := readTestStats(t, conn, r, "router")
+	if router["servers"] != "3" || router["curr_connections"] != "1" || router["ejected_servers"] != "0" {
+		t.Errorf("unexpected router stats: %v", router)
+	}
+
+	io.WriteString(conn, "stats unknown\r\n")
+	if line, _ := r.ReadString('\n'); line != "ERROR\r\n" {
+		t.Errorf("unexpected response of the unknown group: %q", line)
+	}
+
+	// The server which fails is skipped.
+	c.Ring.Servers[0].Client.Close()
+	stats = readTestStats(t, conn, r, "")
+	if v := c.servers["server1"].Len() + c.servers["server2"].Len(); stats["curr_items"] != fmt.Sprint(v) {
+		t.Errorf("expected curr_items is %d but got %s", v, stats["curr_items"])
+	}
+	if _, ok := readTestStats(t, conn, r, "detail")["server0:error"]; !ok {
+		t.Error("the error of the server is missing")
+	}
+}
+
+func TestRouter_StatsBinary(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	c.set(t, "key", "value")
+
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeStat, 1, 0, nil, nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	stats := make(map[string]string)
+	for {
+		res := readTestResponse(t, conn)
+		if res.Opcode != client.OpcodeStat || res.Opaque != 1 || res.Status != client.StatusNoError {
+			t.Fatalf("unexpected response: %+v", res)
+		}
+		if len(res.Key) == 0 {
+			break
+		}
+		stats[string(res.Key)] = string(res.Value)
+	}
+	if stats["curr_items"] != "1" || stats["version"] != protocolVersion {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeStat, 2, 0, nil, []byte("router"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		res := readTestResponse(t, conn)
+		if len(res.Key) == 0 {
+			break
+		}
+		if string(res.Key) == "servers" && string(res.Value) != "2" {
+			t.Errorf("unexpected servers: %s", res.Value)
+		}
+	}
+
+	if _, err := conn.Write(encodeTestRequest(client.OpcodeStat, 3, 0, nil, []byte("unknown"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	if res := readTestResponse(t, conn); res.Status != client.StatusKeyNotFound || res.Opaque != 3 {
+		t.Errorf("unexpected response of the unknown group: %+v", res)
+	}
+}
+
+func TestRouter_StatsPipeline(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	r := bufio.NewReader(conn)
+	key := ownedKey(t, c.Ring, "server1")
+
+	// The command after stats is sent while a server doesn't respond to stats.
+	c.servers["server0"].Pause()
+	io.WriteString(conn, "stats\r\nset "+key+" 0 0 1\r\na\r\n")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.servers["server1"].Value(key); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.servers["server0"].Resume()
+			t.Fatal("the command after stats is not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.servers["server0"].Resume()
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+	}
+	if line, _ := r.ReadString('\n'); line != "STORED\r\n" {
+		t.Errorf("unexpected response of set: %q", line)
+	}
+}
@@ -0,0 +1,452 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/f110/memcached-operator/client"
+	"github.com/f110/memcached-operator/logger"
+)
+
+const (
+	// maxLineLength is the maximum length of the command line of the text protocol.
+	maxLineLength = 64 * 1024
+	// maxKeyLength is the maximum length of the key of memcached.
+	maxKeyLength = 250
+)
+
+var errLineTooLong = errors.New("router: line too long")
+
+var (
+	textStored       = []byte("STORED\r\n")
+	textNotStored    = []byte("NOT_STORED\r\n")
+	textExists       = []byte("EXISTS\r\n")
+	textNotFound     = []byte("NOT_FOUND\r\n")
+	textDeleted      = []byte("DELETED\r\n")
+	textTouched      = []byte("TOUCHED\r\n")
+	textEnd          = []byte("END\r\n")
+	textError        = []byte("ERROR\r\n")
+	textBadFormat    = []byte("CLIENT_ERROR bad command line format\r\n")
+	textBadDataChunk = []byte("CLIENT_ERROR bad data chunk\r\n")
+	textTooLarge     = []byte("SERVER_ERROR object too large for cache\r\n")
+	textNonNumeric   = []byte("CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+)
+
+// serveText reads the commands of the text protocol from r until the client quits.
+func (s *Router) serveText(r *bufio.Reader, queue chan<- *pending) {
+	for {
+		line, err := readLine(r)
+		if err == errLineTooLong {
+			queue <- &pending{raw: []byte("CLIENT_ERROR line too long\r\n"), quit: true}
+			return
+		}
+		if err != nil {
+			if err != io.EOF {
+				logger.Log.Debugw("failed to read the command", "err", err)
+			}
+			return
+		}
+
+		p, err := s.handleText(r, line)
+		if err != nil {
+			logger.Log.Debugw("failed to read the data block", "err", err)
+			return
+		}
+		queue <- p
+		if p.quit {
+			return
+		}
+	}
+}
+
+// readLine reads the line which ends with "\r\n" or "\n" and returns it without the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(line)+len(b) > maxLineLength {
+			return nil, errLineTooLong
+		}
+		line = append(line, b...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		line = line[:len(line)-1]
+		if len(line) > 0 && line[len(line)-1] == '\r' {
+			line = line[:len(line)-1]
+		}
+		return line, nil
+	}
+}
+
+// handleText processes the command line of the text protocol or the meta protocol.
+// The data block of the storage commands is read from r.
+// The error is returned only if r fails.
+func (s *Router) handleText(r *bufio.Reader, line []byte) (*pending, error) {
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return &pending{raw: textError}, nil
+	}
+
+	args := fields[1:]
+	switch string(fields[0]) {
+	case "get", "gets":
+		return s.textGet(args, string(fields[0]) == "gets"), nil
+	case "set", "add", "replace", "cas":
+		return s.textStore(r, string(fields[0]), args)
+	case "delete":
+		return s.textDelete(args), nil
+	case "incr", "decr":
+		return s.textCounter(string(fields[0]) == "incr", args), nil
+	case "touch":
+		return s.textTouch(args), nil
+	case "stats":
+		return s.textStats(args), nil
+	case "mg":
+		return s.metaGet(args), nil
+	case "ms":
+		return s.metaSet(r, args)
+	case "md":
+		return s.metaDelete(args), nil
+	case "ma":
+		return s.metaArithmetic(args), nil
+	case "mn":
+		return &pending{raw: []byte("MN\r\n")}, nil
+	case "version":
+		return &pending{raw: []byte("VERSION " + protocolVersion + "\r\n")}, nil
+	case "quit":
+		return &pending{quit: true}, nil
+	default:
+		return &pending{raw: textError}, nil
+	}
+}
+
+func (s *Router) textGet(keys [][]byte, cas bool) *pending {
+	if len(keys) == 0 {
+		return &pending{raw: textError}
+	}
+	for _, key := range keys {
+		if len(key) > maxKeyLength {
+			return &pending{raw: textBadFormat}
+		}
+	}
+
+	if len(keys) == 1 {
+		return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+			return c.Get(keys[0])
+		}, func(res *client.Item) []byte {
+			if res.Status == client.StatusKeyNotFound {
+				return textEnd
+			}
+			if res.Err != nil {
+				return textServerError(res)
+			}
+			return append(textValue(keys[0], res, cas), textEnd...)
+		})
+	}
+
+	return s.background(func(c *Cluster) []byte {
+		items, err := c.GetMulti(keys)
+		if err != nil {
+			logger.Log.Infow("failed to get the keys", "keys", len(keys), "err", err)
+		}
+		var b []byte
+		for _, key := range keys {
+			if v, ok := items[string(key)]; ok {
+				b = append(b, textValue(key, v, cas)...)
+			}
+		}
+		return append(b, textEnd...)
+	})
+}
+
+// compareZeroCAS processes the store with the cas unique 0, which the binary protocol treats as the store without CAS.
+// No item has the cas unique 0, so it fails with StatusKeyExists if key exists, otherwise with StatusKeyNotFound.
+func compareZeroCAS(c *Cluster, key []byte) (<-chan *client.Item, error) {
+	res, err := c.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(chan *client.Item, 1)
+	go func() {
+		v := <-res
+		if v.Err == nil {
+			v = &client.Item{Status: client.StatusKeyExists, Err: client.ErrKeyAlreadyExists}
+		}
+		result <- v
+	}()
+	return result, nil
+}
+
+// textValue encodes the item as "VALUE <key> <flags> <bytes> [<cas unique>]\r\n<data>\r\n".
+func textValue(key []byte, v *client.Item, cas bool) []byte {
+	var flags uint32
+	if len(v.Extra) == 4 {
+		flags = binary.BigEndian.Uint32(v.Extra)
+	}
+
+	b := make([]byte, 0, len(key)+len(v.Value)+64)
+	b = append(b, "VALUE "...)
+	b = append(b, key...)
+	b = append(b, ' ')
+	b = strconv.AppendUint(b, uint64(flags), 10)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(len(v.Value)), 10)
+	if cas {
+		b = append(b, ' ')
+		b = strconv.AppendUint(b, v.CAS, 10)
+	}
+	b = append(b, "\r\n"...)
+	b = append(b, v.Value...)
+	return append(b, "\r\n"...)
+}
+
+// textStore processes "<command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]" and its data block.
+func (s *Router) textStore(r *bufio.Reader, command string, args [][]byte) (*pending, error) {
+	n := 4
+	if command == "cas" {
+		n = 5
+	}
+	args, noreply := parseNoreply(args, n)
+	if len(args) != n {
+		return &pending{raw: textError}, nil
+	}
+	key := args[0]
+	flags, err1 := strconv.ParseUint(string(args[1]), 10, 32)
+	expiration, err2 := strconv.ParseInt(string(args[2]), 10, 64)
+	size, err3 := strconv.Atoi(string(args[3]))
+	var cas uint64
+	var err4 error
+	if command == "cas" {
+		cas, err4 = strconv.ParseUint(string(args[4]), 10, 64)
+	}
+	if len(key) > maxKeyLength || size < 0 || err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return &pending{raw: textBadFormat}, nil
+	}
+
+	value, p, err := s.readDataBlock(r, size)
+	if p != nil || err != nil {
+		return p, err
+	}
+
+	flag := make([]byte, 4)
+	binary.BigEndian.PutUint32(flag, uint32(flags))
+	exp := textExpiration(expiration)
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		switch {
+		case command == "cas" && cas == 0:
+			return compareZeroCAS(c, key)
+		case command == "add":
+			return c.Add(key, value, flag, exp)
+		case command == "replace":
+			return c.Replace(key, value, 0, flag, exp)
+		default:
+			return c.Set(key, value, cas, flag, exp)
+		}
+	}, func(res *client.Item) []byte {
+		if noreply {
+			return nil
+		}
+		switch res.Status {
+		case client.StatusNoError:
+			return textStored
+		case client.StatusKeyExists:
+			if command == "add" {
+				return textNotStored
+			}
+			return textExists
+		case client.StatusKeyNotFound:
+			if command == "cas" {
+				return textNotFound
+			}
+			return textNotStored
+		case client.StatusItemNotStored:
+			return textNotStored
+		case client.StatusValueTooLarge:
+			return textTooLarge
+		default:
+			return textServerError(res)
+		}
+	}), nil
+}
+
+// readDataBlock reads the data block of size bytes which is followed by "\r\n".
+// If the data block can't be stored, it returns the error response instead.
+func (s *Router) readDataBlock(r *bufio.Reader, size int) ([]byte, *pending, error) {
+	maxBodySize := s.MaxBodySize
+	if maxBodySize <= 0 {
+		maxBodySize = DefaultMaxBodySize
+	}
+	if size > maxBodySize {
+		// Swallow the data block
+		if _, err := io.CopyN(ioutil.Discard, r, int64(size)+2); err != nil {
+			return nil, nil, err
+		}
+		return nil, &pending{raw: textTooLarge}, nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return nil, &pending{raw: textBadDataChunk}, nil
+	}
+
+	return data[:size], nil, nil
+}
+
+// textDelete processes "delete <key> [0] [noreply]". The time argument is accepted only if it is zero as memcached.
+func (s *Router) textDelete(args [][]byte) *pending {
+	args, noreply := parseNoreply(args, 1)
+	if len(args) == 2 && string(args[1]) == "0" {
+		args = args[:1]
+	}
+	if len(args) != 1 || len(args[0]) > maxKeyLength {
+		return &pending{raw: textBadFormat}
+	}
+
+	key := args[0]
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		return c.Del(key)
+	}, func(res *client.Item) []byte {
+		if noreply {
+			return nil
+		}
+		switch res.Status {
+		case client.StatusNoError:
+			return textDeleted
+		case client.StatusKeyNotFound:
+			return textNotFound
+		default:
+			return textServerError(res)
+		}
+	})
+}
+
+// textCounter processes "incr <key> <value> [noreply]" and "decr <key> <value> [noreply]".
+// The text protocol doesn't create the missing item.
+func (s *Router) textCounter(incr bool, args [][]byte) *pending {
+	args, noreply := parseNoreply(args, 2)
+	if len(args) != 2 || len(args[0]) > maxKeyLength {
+		return &pending{raw: textError}
+	}
+	delta, err := strconv.ParseUint(string(args[1]), 10, 64)
+	if err != nil {
+		return &pending{raw: []byte("CLIENT_ERROR invalid numeric delta argument\r\n")}
+	}
+
+	key := args[0]
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		if incr {
+			return c.Incr(key, int64(delta), 0, client.ExpirationNoCreate)
+		}
+		return c.Decr(key, int64(delta), 0, client.ExpirationNoCreate)
+	}, func(res *client.Item) []byte {
+		if noreply {
+			return nil
+		}
+		switch res.Status {
+		case client.StatusNoError:
+			n, err := res.Counter()
+			if err != nil {
+				return textServerError(res)
+			}
+			return append(strconv.AppendUint(nil, n, 10), "\r\n"...)
+		case client.StatusKeyNotFound:
+			return textNotFound
+		case client.StatusNonNumericValue:
+			return textNonNumeric
+		default:
+			return textServerError(res)
+		}
+	})
+}
+
+// textTouch processes "touch <key> <exptime> [noreply]".
+func (s *Router) textTouch(args [][]byte) *pending {
+	args, noreply := parseNoreply(args, 2)
+	if len(args) != 2 || len(args[0]) > maxKeyLength {
+		return &pending{raw: textError}
+	}
+	expiration, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return &pending{raw: []byte("CLIENT_ERROR invalid exptime argument\r\n")}
+	}
+
+	key := args[0]
+	return s.send(func(c *Cluster) (<-chan *client.Item, error) {
+		return c.Touch(key, textExpiration(expiration))
+	}, func(res *client.Item) []byte {
+		if noreply {
+			return nil
+		}
+		switch res.Status {
+		case client.StatusNoError:
+			return textTouched
+		case client.StatusKeyNotFound:
+			return textNotFound
+		default:
+			return textServerError(res)
+		}
+	})
+}
+
+// textStats processes "stats [<group>]". See Router.stats for the groups.
+func (s *Router) textStats(args [][]byte) *pending {
+	if len(args) > 1 {
+		return &pending{raw: textError}
+	}
+	group := ""
+	if len(args) == 1 {
+		group = string(args[0])
+	}
+	if !isStatsGroup(group) {
+		return &pending{raw: textError}
+	}
+
+	return s.background(func(c *Cluster) []byte {
+		var b []byte
+		for _, v := range s.stats(c, group) {
+			b = append(b, "STAT "+v.Name+" "+v.Value+"\r\n"...)
+		}
+		return append(b, textEnd...)
+	})
+}
+
+// parseNoreply removes "noreply" which follows n arguments.
+func parseNoreply(args [][]byte, n int) ([][]byte, bool) {
+	if len(args) == n+1 && string(args[n]) == "noreply" {
+		return args[:n], true
+	}
+
+	return args, false
+}
+
+// textExpiration converts the exptime of the text protocol. The negative exptime expires the item immediately,
+// so it is converted to the unix time in the past because the binary protocol can't encode the negative value.
+func textExpiration(expiration int64) int {
+	if expiration < 0 {
+		return client.MaxRelativeExpiration + 1
+	}
+
+	return int(expiration)
+}
+
+func textServerError(res *client.Item) []byte {
+	err := res.Err
+	if err == nil {
+		err = client.StatusError(res.Status)
+	}
+
+	return []byte("SERVER_ERROR " + err.Error() + "\r\n")
+}
@@ -0,0 +1,160 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouter_Text(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster, MaxBodySize: 100})
+	r := bufio.NewReader(conn)
+
+	cases := []struct {
+		Request string
+		Expect  string
+	}{
+		{Request: "set foo 5 0 3\r\nbar\r\n", Expect: "STORED\r\n"},
+		{Request: "get foo\r\n", Expect: "VALUE foo 5 3\r\nbar\r\nEND\r\n"},
+		{Request: "get missing\r\n", Expect: "END\r\n"},
+		{Request: "add foo 0 0 1\r\nx\r\n", Expect: "NOT_STORED\r\n"},
+		{Request: "replace missing 0 0 1\r\nx\r\n", Expect: "NOT_STORED\r\n"},
+		{Request: "replace foo 0 0 3\r\nbaz\r\n", Expect: "STORED\r\n"},
+		{Request: "cas foo 0 0 1 1\r\nx\r\n", Expect: "EXISTS\r\n"},
+		{Request: "cas missing 0 0 1 1\r\nx\r\n", Expect: "NOT_FOUND\r\n"},
+		// No item has the cas unique 0.
+		{Request: "cas foo 0 0 1 0\r\nx\r\n", Expect: "EXISTS\r\n"},
+		{Request: "cas missing 0 0 1 0\r\nx\r\n", Expect: "NOT_FOUND\r\n"},
+		{Request: "get foo missing\r\n", Expect: "VALUE foo 0 3\r\nbaz\r\nEND\r\n"},
+		{Request: "set counter 0 0 2 noreply\r\n10\r\n", Expect: ""},
+		{Request: "incr counter 5\r\n", Expect: "15\r\n"},
+		{Request: "decr counter 20\r\n", Expect: "0\r\n"},
+		{Request: "incr missing 1\r\n", Expect: "NOT_FOUND\r\n"},
+		{Request: "incr foo 1\r\n", Expect: "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n"},
+		{Request: "touch foo 100\r\n", Expect: "TOUCHED\r\n"},
+		{Request: "touch missing 100\r\n", Expect: "NOT_FOUND\r\n"},
+		{Request: "get foo counter missing foo\r\n", Expect: "VALUE foo 0 3\r\nbaz\r\nVALUE counter 0 1\r\n0\r\nVALUE foo 0 3\r\nbaz\r\nEND\r\n"},
+		{Request: "delete foo\r\n", Expect: "DELETED\r\n"},
+		{Request: "delete foo\r\n", Expect: "NOT_FOUND\r\n"},
+		{Request: "version\r\n", Expect: "VERSION " + protocolVersion + "\r\n"},
+		{Request: "unknown\r\n", Expect: "ERROR\r\n"},
+		// The data block of the invalid request is read as the command as memcached.
+		{Request: "set foo bar 0 3\r\nbar\r\n", Expect: "CLIENT_ERROR bad command line format\r\nERROR\r\n"},
+		{Request: "set foo 0 0 3\r\nbarbaz\r\n", Expect: "CLIENT_ERROR bad data chunk\r\nERROR\r\n"},
+		{Request: "set large 0 0 200\r\n" + strings.Repeat("a", 200) + "\r\n", Expect: "SERVER_ERROR object too large for cache\r\n"},
+		{Request: "get " + strings.Repeat("k", 251) + "\r\n", Expect: "CLIENT_ERROR bad command line format\r\n"},
+	}
+	for _, tc := range cases {
+		if _, err := io.WriteString(conn, tc.Request); err != nil {
+			t.Fatal(err)
+		}
+		if tc.Expect == "" {
+			continue
+		}
+		got := make([]byte, len(tc.Expect))
+		if _, err := io.ReadFull(r, got); err != nil {
+			t.Fatalf("%q: %v", tc.Request, err)
+		}
+		if string(got) != tc.Expect {
+			t.Fatalf("%q: expected %q but got %q", tc.Request, tc.Expect, got)
+		}
+	}
+
+	// The value of gets has the cas unique which can be used by cas.
+	io.WriteString(conn, "set foo 0 0 3\r\nbar\r\ngets foo\r\n")
+	if line, _ := r.ReadString('\n'); line != "STORED\r\n" {
+		t.Fatalf("unexpected response: %q", line)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 5 || fields[0] != "VALUE" {
+		t.Fatalf("unexpected response: %q", line)
+	}
+	r.ReadString('\n')
+	r.ReadString('\n')
+	io.WriteString(conn, "cas foo 0 0 3 "+fields[4]+"\r\nnew\r\n")
+	if line, _ := r.ReadString('\n'); line != "STORED\r\n" {
+		t.Fatalf("unexpected response of cas: %q", line)
+	}
+
+	io.WriteString(conn, "stats\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "END\r\n" {
+			break
+		}
+		if !strings.HasPrefix(line, "STAT ") {
+			t.Fatalf("unexpected stats: %q", line)
+		}
+	}
+
+	io.WriteString(conn, "quit\r\n")
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection is closed but got %v", err)
+	}
+}
+
+func TestRouter_TextPipeline(t *testing.T) {
+	c := newTestCluster(t, 3, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+
+	var req, expect bytes.Buffer
+	for i := 0; i < 100; i++ {
+		key := "key" + strings.Repeat("x", i%7)
+		req.WriteString("set " + key + " 0 0 1\r\na\r\nget " + key + "\r\n")
+		expect.WriteString("STORED\r\nVALUE " + key + " 0 1\r\na\r\nEND\r\n")
+	}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, expect.Len())
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, expect.Bytes()) {
+		t.Fatalf("unexpected responses: %q", got)
+	}
+}
+
+func TestRouter_TextMultiGetPipeline(t *testing.T) {
+	c := newTestCluster(t, 2, 0, WriteAckAll)
+	conn := newTestRouter(t, &Router{Cluster: c.Cluster})
+	slow := ownedKey(t, c.Ring, "server0")
+	fast := ownedKey(t, c.Ring, "server1")
+	c.set(t, slow, "slow")
+
+	// The command after get is sent while the backend of get doesn't respond.
+	c.servers["server0"].Pause()
+	io.WriteString(conn, "get "+slow+" "+slow+"\r\nset "+fast+" 0 0 4\r\nfast\r\n")
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok := c.servers["server1"].Value(fast); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.servers["server0"].Resume()
+			t.Fatal("the command after get is not sent")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.servers["server0"].Resume()
+
+	expect := strings.Repeat("VALUE "+slow+" 0 4\r\nslow\r\n", 2) + "END\r\nSTORED\r\n"
+	got := make([]byte, len(expect))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != expect {
+		t.Fatalf("expected %q but got %q", expect, got)
+	}
+}